@@ -2,7 +2,7 @@
 # Configuration for the build
 # By J. Stuart McMurray
 # Created 20260128
-# Last Modified 20260205
+# Last Modified 20261018
 
 ##############################################################################
 # These are the user-settable parameters for building the miniroot image,    #
@@ -21,6 +21,28 @@ CRS_CBADDR ?= 10.0.0.10:4444
 # It should have the same domain or IP address as CRS_CBADDR.
 OQA_CBADDR ?= ${CRS_CBADDR:C,:[[:digit:]]+$,,}:5555
 
+# OQA_SECRET is an optional hex-encoded secret, up to 64 bytes, used to
+# authenticate shells to output_query_adapter, so strangers can't send it
+# output.  It is baked into the miniroot image.  Something like the output of
+# openssl rand -hex 32 works well.  If empty, anybody may send output.
+OQA_SECRET ?=
+
+# OQA_BATCH_WAIT is how many seconds shells wait to accumulate output lines
+# before sending them to output_query_adapter in a batch.  Batching is much
+# faster for lots of output, e.g. dmesg, at the cost of a bit of lag.  If 0,
+# each line is sent as soon as it's output.
+OQA_BATCH_WAIT ?= 0
+
+# OQA_COMPRESS, if not empty, causes batches of output lines to be gzipped,
+# which makes for far fewer requests for lots of output.  It has no effect
+# unless OQA_BATCH_WAIT is set.
+OQA_COMPRESS ?= yes
+
+# OQA_INPUT, if not empty, causes shells to poll output_query_adapter for
+# commands, queued with oqactl input, instead of getting them from
+# curlrevshell.  This is handy when long-lived connections don't last.
+OQA_INPUT ?=
+
 # TLS_CN is the common name to put in the generated TLS certificate.
 # It should be the same domain or IP address as OQA_CBADDR and CRS_CBADDR,
 # and by default is CBADDR's domain/IP.
@@ -0,0 +1,430 @@
+// Program oqactl - Control output_query_adapter
+package main
+
+/*
+ * oqactl.go
+ * Control output_query_adapter
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/magisterquis/curlrevshell/lib/pledgeunveil"
+)
+
+// DefaultAdminAddr is the default address of output_query_adapter's admin
+// API, as set by start.sh.
+const DefaultAdminAddr = "./output_query_adapter.sock"
+
+// AdminTokenID is the ID whose token authenticates requests to
+// output_query_adapter's admin API over TCP.
+const AdminTokenID = "/admin"
+
+// errUsage indicates a command was used incorrectly.
+var errUsage = errors.New("usage error")
+
+func main() {
+	/* Command-line flags. */
+	var (
+		adminAddr = flag.String(
+			"admin",
+			DefaultAdminAddr,
+			"Output_query_adapter's admin API `address` or unix "+
+				"socket path",
+		)
+		secretHex = flag.String(
+			"secret",
+			"",
+			"Output_query_adapter's hex-encoded -secret, for an "+
+				"admin API on TCP",
+		)
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %s [options] command [args...]
+
+Controls output_query_adapter via its admin API, which output_query_adapter
+serves with -admin.  An -admin address containing a / is a unix socket path.
+Otherwise, it's a TCP address and requests are authenticated with a token made
+from -secret, which should be the same as output_query_adapter's.
+
+Commands:
+list                 List open sessions
+show ID              Describe a session
+tail ID              Print a session's output as it's sent to curlrevshell
+close ID             Close a session
+keepalive ID timeout Change a session's keepalive timeout, e.g. to 5m
+input ID [command]   Queue a command for a shell polling for input, or
+                     commands read from stdin, one per line
+
+Options:
+`,
+			filepath.Base(os.Args[0]),
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	pledgeunveil.MustPledge("dns inet rpath stdio unix")
+
+	/* Do what we're asked. */
+	c := newClient(*adminAddr)
+	if "" != *secretHex {
+		var err error
+		if c.token, err = adminToken(*secretHex); nil != err {
+			log.Fatalf("Invalid secret: %s", err)
+		}
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "list":
+		err = c.list(os.Stdout, flag.Args()[1:])
+	case "show":
+		err = c.show(os.Stdout, flag.Args()[1:])
+	case "tail":
+		err = c.tail(os.Stdout, flag.Args()[1:])
+	case "close":
+		err = c.close(os.Stdout, flag.Args()[1:])
+	case "keepalive":
+		err = c.keepAlive(os.Stdout, flag.Args()[1:])
+	case "input":
+		err = c.input(os.Stdout, os.Stdin, flag.Args()[1:])
+	default:
+		err = errUsage
+	}
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	} else if nil != err {
+		log.Fatalf("Error: %s", err)
+	}
+}
+
+// sessionInfo describes one of output_query_adapter's sessions.
+type sessionInfo struct {
+	ID                string        `json:"id"`
+	RemoteAddr        string        `json:"remote_addr"`
+	Opened            time.Time     `json:"opened"`
+	LastLine          time.Time     `json:"last_line"`
+	Lines             int           `json:"lines"`
+	Bytes             int           `json:"bytes"`
+	KeepAliveDeadline time.Time     `json:"keepalive_deadline"`
+	KeepAliveTimeout  time.Duration `json:"keepalive_timeout"`
+}
+
+// client talks to output_query_adapter's admin API.
+type client struct {
+	hc    *http.Client
+	base  string
+	token string           /* Bearer token, if we have one. */
+	now   func() time.Time /* Test-settable. */
+}
+
+// adminToken returns the token for AdminTokenID made from the hex-encoded
+// secret, as output_query_adapter makes it.
+func adminToken(secretHex string) (string, error) {
+	secret, err := hex.DecodeString(secretHex)
+	if nil != err {
+		return "", fmt.Errorf("decoding hex: %w", err)
+	} else if 0 == len(secret) {
+		return "", errors.New("empty secret")
+	}
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(AdminTokenID))
+	return hex.EncodeToString(m.Sum(nil)), nil
+}
+
+// newClient returns a new client which talks to the admin API at addr.  If
+// addr contains a /, it's a unix socket path.
+func newClient(addr string) client {
+	if !strings.Contains(addr, "/") {
+		return client{
+			hc:   http.DefaultClient,
+			base: "http://" + addr,
+			now:  time.Now,
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(
+		ctx context.Context,
+		_ string,
+		_ string,
+	) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", addr)
+	}
+	return client{
+		hc:   &http.Client{Transport: t},
+		base: "http://output_query_adapter",
+		now:  time.Now,
+	}
+}
+
+// do makes a request to the admin API.  A non-200 response is returned as an
+// error.  The caller should close the returned response's body.
+func (c client) do(
+	method string,
+	path string,
+	body io.Reader,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if nil != err {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	if "" != c.token {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.hc.Do(req)
+	if nil != err {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	if http.StatusOK != res.StatusCode {
+		defer res.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf(
+			"%s (%s)",
+			res.Status,
+			strings.TrimSpace(string(b)),
+		)
+	}
+	return res, nil
+}
+
+// doJSON makes a request to the admin API and unmarshals the response into v.
+func (c client) doJSON(method, path string, body io.Reader, v any) error {
+	res, err := c.do(method, path, body)
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(v); nil != err {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// sessionPath returns the admin API path for the session with the given ID,
+// with the elements of more appended.
+func sessionPath(id string, more ...string) string {
+	p := "/sessions/" + url.PathEscape(id)
+	for _, m := range more {
+		p += "/" + m
+	}
+	return p
+}
+
+// list lists the open sessions.
+func (c client) list(w io.Writer, args []string) error {
+	if 0 != len(args) {
+		return errUsage
+	}
+	var sis []sessionInfo
+	if err := c.doJSON(http.MethodGet, "/sessions", nil, &sis); nil != err {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tREMOTE\tAGE\tIDLE\tLINES\tBYTES\tEXPIRES\n")
+	for _, si := range sis {
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			si.ID,
+			si.RemoteAddr,
+			c.since(si.Opened),
+			c.since(si.LastLine),
+			si.Lines,
+			si.Bytes,
+			c.until(si.KeepAliveDeadline),
+		)
+	}
+	return tw.Flush()
+}
+
+// show describes a session.
+func (c client) show(w io.Writer, args []string) error {
+	if 1 != len(args) {
+		return errUsage
+	}
+	var si sessionInfo
+	if err := c.doJSON(
+		http.MethodGet,
+		sessionPath(args[0]),
+		nil,
+		&si,
+	); nil != err {
+		return err
+	}
+	c.printSession(w, si)
+	return nil
+}
+
+// tail prints a session's output until the session ends.
+func (c client) tail(w io.Writer, args []string) error {
+	if 1 != len(args) {
+		return errUsage
+	}
+	res, err := c.do(http.MethodGet, sessionPath(args[0], "tail"), nil)
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(w, res.Body); nil != err {
+		return fmt.Errorf("reading output: %w", err)
+	}
+	return nil
+}
+
+// close closes a session.
+func (c client) close(w io.Writer, args []string) error {
+	if 1 != len(args) {
+		return errUsage
+	}
+	var si sessionInfo
+	if err := c.doJSON(
+		http.MethodDelete,
+		sessionPath(args[0]),
+		nil,
+		&si,
+	); nil != err {
+		return err
+	}
+	fmt.Fprintf(
+		w,
+		"Closed %s after %d lines (%d bytes)\n",
+		si.ID,
+		si.Lines,
+		si.Bytes,
+	)
+	return nil
+}
+
+// keepAlive changes a session's keepalive timeout.
+func (c client) keepAlive(w io.Writer, args []string) error {
+	if 2 != len(args) {
+		return errUsage
+	}
+	if _, err := time.ParseDuration(args[1]); nil != err {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	var si sessionInfo
+	if err := c.doJSON(
+		http.MethodPut,
+		sessionPath(args[0], "keepalive"),
+		strings.NewReader(args[1]),
+		&si,
+	); nil != err {
+		return err
+	}
+	fmt.Fprintf(
+		w,
+		"Keepalive timeout for %s is now %s, expires in %s\n",
+		si.ID,
+		si.KeepAliveTimeout,
+		c.until(si.KeepAliveDeadline),
+	)
+	return nil
+}
+
+// inputQueued describes commands queued with output_query_adapter.
+type inputQueued struct {
+	ID      string `json:"id"`
+	Queued  int    `json:"queued"`
+	LastSeq int    `json:"last_seq"`
+}
+
+// input queues a command for a shell.  If there's no command in args, the
+// commands are read from r instead.
+func (c client) input(w io.Writer, r io.Reader, args []string) error {
+	if 1 > len(args) {
+		return errUsage
+	}
+	body := r
+	if 1 < len(args) {
+		body = strings.NewReader(strings.Join(args[1:], " "))
+	}
+	var iq inputQueued
+	if err := c.doJSON(
+		http.MethodPost,
+		sessionPath(args[0], "input"),
+		body,
+		&iq,
+	); nil != err {
+		return err
+	}
+	fmt.Fprintf(
+		w,
+		"Queued %d commands for %s, last is number %d\n",
+		iq.Queued,
+		iq.ID,
+		iq.LastSeq,
+	)
+	return nil
+}
+
+// printSession prints a session's details, one per line.
+func (c client) printSession(w io.Writer, si sessionInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", si.ID)
+	fmt.Fprintf(tw, "Remote address:\t%s\n", si.RemoteAddr)
+	fmt.Fprintf(
+		tw,
+		"Opened:\t%s (%s ago)\n",
+		si.Opened.Format(time.RFC3339),
+		c.since(si.Opened),
+	)
+	if si.LastLine.IsZero() {
+		fmt.Fprintf(tw, "Last line:\tnever\n")
+	} else {
+		fmt.Fprintf(
+			tw,
+			"Last line:\t%s (%s ago)\n",
+			si.LastLine.Format(time.RFC3339),
+			c.since(si.LastLine),
+		)
+	}
+	fmt.Fprintf(tw, "Lines:\t%d\n", si.Lines)
+	fmt.Fprintf(tw, "Bytes:\t%d\n", si.Bytes)
+	fmt.Fprintf(tw, "Keepalive timeout:\t%s\n", si.KeepAliveTimeout)
+	fmt.Fprintf(
+		tw,
+		"Keepalive expires:\t%s (in %s)\n",
+		si.KeepAliveDeadline.Format(time.RFC3339),
+		c.until(si.KeepAliveDeadline),
+	)
+	tw.Flush()
+}
+
+// since returns how long ago t was, to the second, or - if t is the zero
+// time.
+func (c client) since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return c.now().Sub(t).Round(time.Second).String()
+}
+
+// until returns how long until t, to the second.
+func (c client) until(t time.Time) string {
+	return t.Sub(c.now()).Round(time.Second).String()
+}
@@ -0,0 +1,325 @@
+package main
+
+/*
+ * oqactl_test.go
+ * Tests for oqactl.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNow is the time used by test clients.
+var testNow = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+// testSession is what our fake admin API returns for a session.
+const testSession = `{
+	"id": "kittens",
+	"remote_addr": "192.0.2.1:12345",
+	"opened": "2026-10-18T11:58:00Z",
+	"last_line": "2026-10-18T11:59:55Z",
+	"lines": 10,
+	"bytes": 123,
+	"keepalive_deadline": "2026-10-18T12:00:11Z",
+	"keepalive_timeout": 16000000000
+}`
+
+// newTestClient returns a client connected to a fake admin API.  Requests
+// made to the API are recorded in reqs.
+func newTestClient(t *testing.T) (client, *[]string) {
+	var (
+		reqs []string
+		mux  = http.NewServeMux()
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if nil != err {
+			t.Errorf("Error reading request body: %s", err)
+		}
+		reqs = append(reqs, strings.TrimSpace(fmt.Sprintf(
+			"%s %s %s",
+			r.Method,
+			r.URL.EscapedPath(),
+			b,
+		)))
+		switch r.URL.EscapedPath() {
+		case "/sessions":
+			fmt.Fprintf(w, "[%s,{\"id\":\"new\","+
+				"\"remote_addr\":\"192.0.2.2:1\","+
+				"\"opened\":\"2026-10-18T12:00:00Z\","+
+				"\"keepalive_deadline\":"+
+				"\"2026-10-18T12:00:16Z\"}]", testSession)
+		case "/sessions/kittens", "/sessions/kittens/keepalive":
+			fmt.Fprint(w, testSession)
+		case "/sessions/kittens/tail":
+			fmt.Fprint(w, "line 1\nline 2\n")
+		case "/sessions/kittens/input":
+			fmt.Fprintf(
+				w,
+				`{"id":"kittens","queued":%d,"last_seq":5}`,
+				1+strings.Count(
+					strings.TrimSpace(string(b)),
+					"\n",
+				),
+			)
+		default:
+			ec := http.StatusNotFound
+			http.Error(w, http.StatusText(ec), ec)
+		}
+	})
+	svr := httptest.NewServer(mux)
+	t.Cleanup(svr.Close)
+	c := newClient(strings.TrimPrefix(svr.URL, "http://"))
+	c.now = func() time.Time { return testNow }
+	return c, &reqs
+}
+
+// Do commands make the right requests and print the right things?
+func TestClient(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		f    func(client, io.Writer, []string) error
+		args []string
+		req  string
+		want string
+	}{{
+		name: "list",
+		f:    client.list,
+		req:  "GET /sessions",
+		want: "" +
+			"ID       REMOTE           AGE   IDLE  LINES  BYTES  EXPIRES\n" +
+			"kittens  192.0.2.1:12345  2m0s  5s    10     123    11s\n" +
+			"new      192.0.2.2:1      0s    -     0      0      16s\n",
+	}, {
+		name: "show",
+		f:    client.show,
+		args: []string{"kittens"},
+		req:  "GET /sessions/kittens",
+		want: "" +
+			"ID:                kittens\n" +
+			"Remote address:    192.0.2.1:12345\n" +
+			"Opened:            2026-10-18T11:58:00Z (2m0s ago)\n" +
+			"Last line:         2026-10-18T11:59:55Z (5s ago)\n" +
+			"Lines:             10\n" +
+			"Bytes:             123\n" +
+			"Keepalive timeout: 16s\n" +
+			"Keepalive expires: 2026-10-18T12:00:11Z (in 11s)\n",
+	}, {
+		name: "tail",
+		f:    client.tail,
+		args: []string{"kittens"},
+		req:  "GET /sessions/kittens/tail",
+		want: "line 1\nline 2\n",
+	}, {
+		name: "close",
+		f:    client.close,
+		args: []string{"kittens"},
+		req:  "DELETE /sessions/kittens",
+		want: "Closed kittens after 10 lines (123 bytes)\n",
+	}, {
+		name: "keepalive",
+		f:    client.keepAlive,
+		args: []string{"kittens", "16s"},
+		req:  "PUT /sessions/kittens/keepalive 16s",
+		want: "Keepalive timeout for kittens is now 16s, " +
+			"expires in 11s\n",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				cl, reqs = newTestClient(t)
+				sb       strings.Builder
+			)
+			if err := c.f(cl, &sb, c.args); nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf(
+					"Incorrect output\ngot:\n%s\nwant:\n%s",
+					got,
+					c.want,
+				)
+			}
+			if 1 != len(*reqs) || c.req != (*reqs)[0] {
+				t.Errorf(
+					"Incorrect requests\n got: %q\nwant: %q",
+					*reqs,
+					c.req,
+				)
+			}
+		})
+	}
+}
+
+// Do we report errors and misuse?
+func TestClient_Errors(t *testing.T) {
+	cl, reqs := newTestClient(t)
+	err := cl.show(io.Discard, []string{"moose"})
+	if want := "404 Not Found (Not Found)"; nil == err ||
+		err.Error() != want {
+		t.Errorf("Incorrect error\n got: %v\nwant: %s", err, want)
+	}
+	for _, c := range []struct {
+		f    func(client, io.Writer, []string) error
+		args []string
+	}{
+		{f: client.list, args: []string{"kittens"}},
+		{f: client.show},
+		{f: client.tail, args: []string{"a", "b"}},
+		{f: client.close},
+		{f: client.keepAlive, args: []string{"kittens"}},
+	} {
+		if err := c.f(cl, io.Discard, c.args); !errors.Is(
+			err,
+			errUsage,
+		) {
+			t.Errorf("Incorrect error for %q: %v", c.args, err)
+		}
+	}
+	if err := cl.keepAlive(
+		io.Discard,
+		[]string{"kittens", "kittens"},
+	); nil == err {
+		t.Errorf("No error for invalid timeout")
+	}
+	if 1 != len(*reqs) {
+		t.Errorf("Unexpected requests: %q", *reqs)
+	}
+}
+
+// Can we queue commands from the command line and stdin?
+func TestClient_Input(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		args  []string
+		stdin string
+		req   string
+		want  string
+	}{{
+		name: "args",
+		args: []string{"kittens", "ls", "-l", "/tmp"},
+		req:  "POST /sessions/kittens/input ls -l /tmp",
+		want: "Queued 1 commands for kittens, last is number 5\n",
+	}, {
+		name:  "stdin",
+		args:  []string{"kittens"},
+		stdin: "uname -a\nls /tmp\n",
+		req:   "POST /sessions/kittens/input uname -a\nls /tmp",
+		want:  "Queued 2 commands for kittens, last is number 5\n",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				cl, reqs = newTestClient(t)
+				sb       strings.Builder
+			)
+			if err := cl.input(
+				&sb,
+				strings.NewReader(c.stdin),
+				c.args,
+			); nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf(
+					"Incorrect output\ngot:\n%s\nwant:\n%s",
+					got,
+					c.want,
+				)
+			}
+			if 1 != len(*reqs) || c.req != (*reqs)[0] {
+				t.Errorf(
+					"Incorrect requests\n got: %q\nwant: %q",
+					*reqs,
+					c.req,
+				)
+			}
+		})
+	}
+
+	/* Need at least an ID. */
+	cl, _ := newTestClient(t)
+	if err := cl.input(
+		io.Discard,
+		strings.NewReader(""),
+		nil,
+	); !errors.Is(err, errUsage) {
+		t.Errorf("Incorrect error without an ID: %v", err)
+	}
+}
+
+// Can we talk to the admin API over a unix socket?
+func TestClient_Unix(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", fn)
+	if nil != err {
+		t.Fatalf("Error listening: %s", err)
+	}
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		fmt.Fprint(w, "[]")
+	}))
+	svr.Listener = l
+	svr.Start()
+	defer svr.Close()
+
+	var sb strings.Builder
+	if err := newClient(fn).list(&sb, nil); nil != err {
+		t.Fatalf("Error: %s", err)
+	}
+	want := "ID  REMOTE  AGE  IDLE  LINES  BYTES  EXPIRES\n"
+	if got := sb.String(); got != want {
+		t.Errorf("Incorrect output\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// Do we send the token output_query_adapter expects?
+func TestClient_Token(t *testing.T) {
+	/* Token for the secret kittens, as output_query_adapter makes it. */
+	want := "Bearer 1be8ae7b8b98138e58f4b81c2c6cefcc" +
+		"f17a479a62a3e9992ecb5a69f93829fb"
+	var got string
+	svr := httptest.NewServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		got = r.Header.Get("Authorization")
+		fmt.Fprint(w, "[]")
+	}))
+	defer svr.Close()
+
+	c := newClient(strings.TrimPrefix(svr.URL, "http://"))
+	var err error
+	if c.token, err = adminToken("6b697474656e73"); nil != err {
+		t.Fatalf("Error making token: %s", err)
+	}
+	if err := c.list(io.Discard, nil); nil != err {
+		t.Fatalf("Error: %s", err)
+	}
+	if got != want {
+		t.Errorf(
+			"Incorrect Authorization header\n got: %s\nwant: %s",
+			got,
+			want,
+		)
+	}
+
+	/* Bad secrets should be caught. */
+	for _, s := range []string{"", "kittens"} {
+		if _, err := adminToken(s); nil == err {
+			t.Errorf("No error for secret %q", s)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Program oqareplay - Replay output_query_adapter transcripts
+package main
+
+/*
+ * oqareplay.go
+ * Replay output_query_adapter transcripts
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/magisterquis/curlrevshell/lib/crsdialer"
+	"github.com/magisterquis/curlrevshell/lib/pledgeunveil"
+	"github.com/magisterquis/curlrevshell/lib/sstls"
+)
+
+func main() {
+	/* Command-line flags. */
+	var (
+		baseURL = flag.String(
+			"curlrevshell",
+			"",
+			"Curlrevshell's base output `URL`, or unset to print "+
+				"lines to stdout",
+		)
+		crsFP = flag.String(
+			"curlrevshell-fingerprint",
+			"",
+			"Curlrevshell's TLS certificate `fingerprint`",
+		)
+		crsCA = flag.String(
+			"curlrevshell-ca",
+			"",
+			"CA bundle `file` for verifying curlrevshell's TLS "+
+				"certificate",
+		)
+		certFile = flag.String(
+			"tls",
+			"crs.txtar",
+			"Curlrevshell's TLS certificate and key `archive`",
+		)
+		id = flag.String(
+			"id",
+			"",
+			"Session `ID` for curlrevshell, if not the "+
+				"transcript's name",
+		)
+		speed = flag.Float64(
+			"speed",
+			1,
+			"Replay speed `factor`, or 0 for as fast as possible",
+		)
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %s [options] transcript
+
+Replays a transcript written by output_query_adapter with -record-dir, with
+lines printed or sent to curlrevshell as if they'd arrived at their original
+times, scaled by -speed.  Use it to watch a session again.
+
+With -curlrevshell, lines are sent to curlrevshell as output_query_adapter
+sends them, to the given URL with the ID appended, by default the transcript's
+name without its %s suffix.  Curlrevshell's certificate is verified
+with -curlrevshell-fingerprint, -curlrevshell-ca, or the certificate in the
+-tls archive.  A new request is made each time the transcript has a
+connection close or a shell restart.
+
+Options:
+`,
+			filepath.Base(os.Args[0]),
+			TranscriptSuffix,
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if 1 != flag.NArg() {
+		flag.Usage()
+		os.Exit(2)
+	}
+	fn := flag.Arg(0)
+
+	/* Read what we're replaying. */
+	f, err := os.Open(fn)
+	if nil != err {
+		log.Fatalf("Error opening transcript: %s", err)
+	}
+	es, err := ParseTranscript(f)
+	f.Close()
+	if nil != err {
+		log.Fatalf("Error reading %s: %s", fn, err)
+	}
+
+	/* Work out where the lines go. */
+	rp := Replayer{Speed: *speed}
+	promises := "stdio"
+	if "" == *baseURL {
+		s := NewWriterSession(os.Stdout)
+		rp.Open = func() (Session, error) { return s, nil }
+	} else {
+		if "" == *id {
+			*id = strings.TrimSuffix(
+				filepath.Base(fn),
+				TranscriptSuffix,
+			)
+		}
+		tc, err := upstreamTLSConfig(*crsFP, *crsCA, *certFile)
+		if nil != err {
+			log.Fatalf(
+				"Error setting up TLS to curlrevshell: %s",
+				err,
+			)
+		}
+		var (
+			hc = newHTTPClient(tc)
+			u  = strings.TrimRight(*baseURL, "/") + "/" +
+				url.PathEscape(*id)
+		)
+		rp.Open = func() (Session, error) {
+			log.Printf("Sending lines to %s", u)
+			return NewPostSession(hc, u), nil
+		}
+		promises += " inet"
+		if pu, err := url.Parse(*baseURL); nil != err ||
+			nil == net.ParseIP(pu.Hostname()) {
+			promises += " dns"
+		}
+	}
+	pledgeunveil.MustPledge(promises)
+
+	/* Replay until we're done or told to stop. */
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	if err := rp.Replay(ctx, es); errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted")
+	} else if nil != err {
+		log.Fatalf("Error replaying %s: %s", fn, err)
+	}
+}
+
+// upstreamTLSConfig returns a TLS config which verifies curlrevshell's
+// certificate with a fingerprint or a CA bundle file.  If neither are given,
+// the certificate must be the one in the txtar archive.
+func upstreamTLSConfig(
+	fp string,
+	caFile string,
+	archive string,
+) (*tls.Config, error) {
+	switch {
+	case "" != fp && "" != caFile:
+		return nil, errors.New(
+			"only one of a fingerprint or CA bundle may be used",
+		)
+	case "" != caFile:
+		b, err := os.ReadFile(caFile)
+		if nil != err {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf(
+				"no certificates found in %s",
+				caFile,
+			)
+		}
+		return &tls.Config{RootCAs: pool}, nil
+	case "" == fp:
+		cert, err := sstls.LoadCachedCertificate(archive)
+		if nil != err {
+			return nil, fmt.Errorf("loading certificate: %w", err)
+		}
+		if fp, err = sstls.PubkeyFingerprintTLS(cert); nil != err {
+			return nil, fmt.Errorf(
+				"getting certificate fingerprint: %w",
+				err,
+			)
+		}
+	}
+
+	/* Fingerprint verifier. */
+	vc, err := crsdialer.TLSFingerprintVerifier(fp)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"setting up TLS fingerprint verification: %w",
+			err,
+		)
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   vc,
+	}, nil
+}
+
+// newHTTPClient rolls an http.Client which verifies connected TLS servers'
+// certificates using tc, set up as output_query_adapter sets up its client
+// for curlrevshell.
+func newHTTPClient(tc *tls.Config) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ExpectContinueTimeout = 0
+	t.ForceAttemptHTTP2 = true
+	t.TLSClientConfig = tc
+	return &http.Client{Transport: t}
+}
@@ -0,0 +1,90 @@
+package main
+
+/*
+ * oqareplay_test.go
+ * Tests for oqareplay.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/magisterquis/curlrevshell/lib/sstls"
+)
+
+// Can we talk to a server with the certificate in an archive or with a
+// fingerprint?
+func TestUpstreamTLSConfig(t *testing.T) {
+	/* Server with a self-signed cert, saved in an archive. */
+	var (
+		archive = filepath.Join(t.TempDir(), "crs.txtar")
+		sech    = make(chan error, 1)
+		svr     = http.Server{ErrorLog: log.New(io.Discard, "", 0)}
+	)
+	l, err := sstls.Listen("tcp", "127.0.0.1:0", "", 0, archive)
+	if nil != err {
+		t.Fatalf("Error starting listener: %s", err)
+	}
+	go func() { sech <- svr.Serve(l) }()
+	defer func() {
+		if err := svr.Shutdown(context.Background()); nil != err {
+			t.Errorf("Shutting down server: %s", err)
+		}
+		if err := <-sech; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Server returned error: %s", err)
+		}
+	}()
+
+	for _, c := range []struct {
+		name    string
+		fp      string
+		archive string
+		ok      bool
+	}{{
+		name:    "archive",
+		archive: archive,
+		ok:      true,
+	}, {
+		name: "fingerprint",
+		fp:   l.Fingerprint,
+		ok:   true,
+	}, {
+		name: "wrong_fingerprint",
+		fp:   "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, err := upstreamTLSConfig(c.fp, "", c.archive)
+			if nil != err {
+				t.Fatalf("Error making TLS config: %s", err)
+			}
+			res, err := newHTTPClient(tc).Get(
+				"https://" + l.Addr().String(),
+			)
+			if nil == err {
+				res.Body.Close()
+			}
+			if c.ok && nil != err {
+				t.Errorf("Error making request: %s", err)
+			} else if !c.ok && nil == err {
+				t.Errorf("Request succeeded")
+			}
+		})
+	}
+
+	/* Only one way to verify at a time. */
+	if _, err := upstreamTLSConfig(
+		l.Fingerprint,
+		"ca.pem",
+		archive,
+	); nil == err {
+		t.Errorf("No error with a fingerprint and CA bundle")
+	}
+}
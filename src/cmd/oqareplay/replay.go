@@ -0,0 +1,181 @@
+package main
+
+/*
+ * replay.go
+ * Replay transcripts
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Session is where a connection's replayed lines go.
+type Session interface {
+	WriteLine(line string) error
+	Close() error
+}
+
+// Replayer replays transcripts.
+type Replayer struct {
+	// Speed is how much faster than the original to replay lines, e.g.
+	// 2 for twice as fast, or 0 to replay lines as fast as possible.
+	Speed float64
+	// Open opens a Session for each connection in the transcript.
+	Open func() (Session, error)
+}
+
+// Replay sends the lines in es to Sessions from r.Open, with the same time
+// between lines as in the transcript, scaled by r.Speed.  A new Session is
+// opened for the first line after a connection ended or after line numbers
+// went backwards, as they do when a shell restarts.  Replay returns nil once
+// the last line is sent, or ctx's error if ctx is done first.
+func (r Replayer) Replay(ctx context.Context, es []Entry) error {
+	var (
+		s    Session
+		last int
+	)
+	defer func() {
+		if nil != s {
+			s.Close()
+		}
+	}()
+	for i, e := range es {
+		/* Wait until it's time for this line. */
+		if 0 != i && 0 < r.Speed {
+			d := time.Duration(
+				float64(e.Time.Sub(es[i-1].Time)) / r.Speed,
+			)
+			if err := sleepContext(ctx, d); nil != err {
+				return err
+			}
+		} else if err := ctx.Err(); nil != err {
+			return err
+		}
+
+		/* Finish the last connection, if this isn't part of it. */
+		if nil != s && (0 == e.Seq || e.Seq <= last) {
+			err := s.Close()
+			s = nil
+			if nil != err {
+				return fmt.Errorf("closing session: %w", err)
+			}
+		}
+		last = e.Seq
+		if 0 == e.Seq {
+			continue
+		}
+
+		/* Send it off. */
+		if nil == s {
+			var err error
+			if s, err = r.Open(); nil != err {
+				return fmt.Errorf("opening session: %w", err)
+			}
+		}
+		if err := s.WriteLine(e.Line); nil != err {
+			return fmt.Errorf("sending line %d: %w", e.Seq, err)
+		}
+	}
+
+	/* Finish the last connection. */
+	if nil != s {
+		err := s.Close()
+		s = nil
+		if nil != err {
+			return fmt.Errorf("closing session: %w", err)
+		}
+	}
+	return nil
+}
+
+// sleepContext sleeps for d or until ctx is done, whichever is first.  It
+// returns ctx's error if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if 0 >= d {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriterSession is a Session which writes lines to an io.Writer.
+type WriterSession struct {
+	w io.Writer
+}
+
+// NewWriterSession returns a new WriterSession which writes to w.
+func NewWriterSession(w io.Writer) WriterSession {
+	return WriterSession{w: w}
+}
+
+// WriteLine implements Session.WriteLine.
+func (ws WriterSession) WriteLine(line string) error {
+	_, err := io.WriteString(ws.w, line+"\n")
+	return err
+}
+
+// Close implements Session.Close.  It is a no-op.
+func (ws WriterSession) Close() error { return nil }
+
+// PostSession is a Session which sends lines to curlrevshell in the body of a
+// POST request, as output_query_adapter does.
+type PostSession struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// NewPostSession returns a new PostSession which makes a request to u with
+// client.  The request is made in the background.
+func NewPostSession(client *http.Client, u string) *PostSession {
+	pr, pw := io.Pipe()
+	ps := &PostSession{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(ps.done)
+		ps.err = post(client, u, pr)
+		pr.CloseWithError(ps.err)
+	}()
+	return ps
+}
+
+// post sends body to u.  It returns nil if curlrevshell finished with the
+// request normally.
+func post(client *http.Client, u string, body io.Reader) error {
+	res, err := client.Post(u, "", body)
+	if nil != err {
+		return fmt.Errorf("sending POST request: %w", err)
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return fmt.Errorf("unexpected response: %s", res.Status)
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// WriteLine implements Session.WriteLine.
+func (ps *PostSession) WriteLine(line string) error {
+	_, err := io.WriteString(ps.pw, line+"\n")
+	return err
+}
+
+// Close implements Session.Close.  It waits for curlrevshell to finish with
+// the request.
+func (ps *PostSession) Close() error {
+	ps.pw.Close()
+	<-ps.done
+	return ps.err
+}
@@ -0,0 +1,221 @@
+package main
+
+/*
+ * replay_test.go
+ * Tests for replay.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// testSession records what's written to it, along with when.
+type testSession struct {
+	n     int /* Which session this is. */
+	start time.Time
+	log   *[]string
+}
+
+// WriteLine implements Session.WriteLine.
+func (ts testSession) WriteLine(line string) error {
+	*ts.log = append(*ts.log, fmt.Sprintf(
+		"%d %s %s",
+		ts.n,
+		time.Since(ts.start),
+		line,
+	))
+	return nil
+}
+
+// Close implements Session.Close.
+func (ts testSession) Close() error {
+	*ts.log = append(*ts.log, fmt.Sprintf("%d closed", ts.n))
+	return nil
+}
+
+// Do we replay lines at the right times, to the right sessions?
+func TestReplayer(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			log   []string
+			n     int
+			start = time.Now()
+			t0    = start.Add(-time.Hour)
+			rp    = Replayer{
+				Speed: 2,
+				Open: func() (Session, error) {
+					n++
+					return testSession{
+						n:     n,
+						start: start,
+						log:   &log,
+					}, nil
+				},
+			}
+		)
+		if err := rp.Replay(context.Background(), []Entry{{
+			Time: t0,
+			Seq:  1,
+			Line: "a",
+		}, {
+			Time: t0.Add(4 * time.Second),
+			Seq:  2,
+			Line: "b",
+		}, {
+			/* Shell restarted. */
+			Time: t0.Add(6 * time.Second),
+			Seq:  1,
+			Line: "c",
+		}, {
+			Time: t0.Add(8 * time.Second),
+		}, {
+			Time: t0.Add(8 * time.Second),
+		}, {
+			Time: t0.Add(10 * time.Second),
+			Seq:  5,
+			Line: "d",
+		}}); nil != err {
+			t.Fatalf("Error replaying: %s", err)
+		}
+		if got := time.Since(start); 5*time.Second != got {
+			t.Errorf("Replay took %s, expected 5s", got)
+		}
+		want := []string{
+			"1 0s a",
+			"1 2s b",
+			"1 closed",
+			"2 3s c",
+			"2 closed",
+			"3 5s d",
+			"3 closed",
+		}
+		if !slices.Equal(log, want) {
+			t.Errorf(
+				"Incorrect replay\n got: %q\nwant: %q",
+				log,
+				want,
+			)
+		}
+	})
+}
+
+// Does Replay stop when its context is done?
+func TestReplayer_Cancel(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			log   []string
+			start = time.Now()
+			rp    = Replayer{
+				Speed: 1,
+				Open: func() (Session, error) {
+					return testSession{
+						n:     1,
+						start: start,
+						log:   &log,
+					}, nil
+				},
+			}
+		)
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Second,
+		)
+		defer cancel()
+		err := rp.Replay(ctx, []Entry{{
+			Time: start,
+			Seq:  1,
+			Line: "a",
+		}, {
+			Time: start.Add(time.Hour),
+			Seq:  2,
+			Line: "b",
+		}})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Incorrect error: %v", err)
+		}
+		if got := time.Since(start); time.Second != got {
+			t.Errorf("Replay took %s, expected 1s", got)
+		}
+		if want := []string{"1 0s a", "1 closed"}; !slices.Equal(
+			log,
+			want,
+		) {
+			t.Errorf(
+				"Incorrect replay\n got: %q\nwant: %q",
+				log,
+				want,
+			)
+		}
+	})
+}
+
+// Do PostSessions send lines in a request body?
+func TestPostSession(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+		svr    = httptest.NewServer(http.HandlerFunc(func(
+			w http.ResponseWriter,
+			r *http.Request,
+		) {
+			if "/o/kittens" != r.URL.Path {
+				http.NotFound(w, r)
+				return
+			}
+			b, err := io.ReadAll(r.Body)
+			if nil != err {
+				t.Errorf("Error reading body: %s", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			bodies = append(bodies, string(b))
+		}))
+	)
+	defer svr.Close()
+
+	/* Two sessions' worth of lines. */
+	for _, ls := range [][]string{{"a", "b"}, {"c"}} {
+		ps := NewPostSession(svr.Client(), svr.URL+"/o/kittens")
+		for _, l := range ls {
+			if err := ps.WriteLine(l); nil != err {
+				t.Fatalf("Error writing %q: %s", l, err)
+			}
+		}
+		if err := ps.Close(); nil != err {
+			t.Fatalf("Error closing session: %s", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"a\nb\n", "c\n"}; !slices.Equal(bodies, want) {
+		t.Errorf(
+			"Incorrect bodies\n got: %q\nwant: %q",
+			bodies,
+			want,
+		)
+	}
+
+	/* Curlrevshell saying no should be an error. */
+	ps := NewPostSession(svr.Client(), svr.URL+"/o/moose")
+	err := ps.WriteLine("x")
+	if cerr := ps.Close(); nil == err {
+		err = cerr
+	}
+	if nil == err || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Incorrect error for refused request: %v", err)
+	}
+}
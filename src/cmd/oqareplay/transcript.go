@@ -0,0 +1,104 @@
+package main
+
+/*
+ * transcript.go
+ * Parse output_query_adapter transcripts
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TranscriptSuffix is the suffix output_query_adapter gives transcripts.
+const TranscriptSuffix = ".transcript"
+
+// maxTranscriptLine is the longest line we'll read from a transcript.
+const maxTranscriptLine = 1024 * 1024
+
+// transcriptRE matches a line in a transcript.  An empty line from a shell
+// may have lost the space after its number.
+var transcriptRE = regexp.MustCompile(
+	`^(\S+) \[(.*?)\] (?:--- (.*)|(\d+)(?: (.*))?)$`,
+)
+
+// Entry is a line from a shell, or the end of a connection, taken from a
+// transcript.
+type Entry struct {
+	// Time is when the line arrived or the connection ended.
+	Time time.Time
+	// RemoteAddr is where the line came from.
+	RemoteAddr string
+	// Seq is the line's number, or 0 if the connection ended.
+	Seq  int
+	Line string
+}
+
+// ParseTranscript parses a transcript written by output_query_adapter with
+// -record-dir.  Connections opening aren't returned.
+func ParseTranscript(r io.Reader) ([]Entry, error) {
+	var (
+		es []Entry
+		s  = bufio.NewScanner(r)
+	)
+	s.Buffer(nil, maxTranscriptLine)
+	for n := 1; s.Scan(); n++ {
+		e, ok, err := parseTranscriptLine(s.Text())
+		if nil != err {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		} else if ok {
+			es = append(es, e)
+		}
+	}
+	if err := s.Err(); nil != err {
+		return nil, fmt.Errorf("reading transcript: %w", err)
+	}
+	if 0 == len(es) {
+		return nil, errors.New("no lines found")
+	}
+	return es, nil
+}
+
+// parseTranscriptLine parses a single line from a transcript.  The returned
+// boolean is false if the line is neither a line from a shell nor the end of
+// a connection.
+func parseTranscriptLine(line string) (Entry, bool, error) {
+	ms := transcriptRE.FindStringSubmatch(line)
+	if nil == ms {
+		return Entry{}, false, errors.New("not a transcript line")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ms[1])
+	if nil != err {
+		return Entry{}, false, fmt.Errorf("parsing time: %w", err)
+	}
+	e := Entry{Time: t, RemoteAddr: ms[2]}
+
+	/* Connection events, of which we only want the end. */
+	if "" == ms[4] {
+		switch {
+		case "timed out" == ms[3], strings.HasPrefix(ms[3], "closed"):
+			return e, true, nil
+		default:
+			return Entry{}, false, nil
+		}
+	}
+
+	/* Lines from the shell. */
+	if e.Seq, err = strconv.Atoi(ms[4]); nil != err || 0 == e.Seq {
+		return Entry{}, false, fmt.Errorf(
+			"invalid line number %q",
+			ms[4],
+		)
+	}
+	e.Line = ms[5]
+	return e, true, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+/*
+ * transcript_test.go
+ * Tests for transcript.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRA is the remote address in test transcripts.
+const testRA = "192.0.2.1:12345"
+
+// Can we get lines out of transcripts?
+func TestParseTranscript(t *testing.T) {
+	var (
+		ra2 = "192.0.2.2:54321"
+		t0  = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	)
+	for _, c := range []struct {
+		name       string
+		transcript string
+		want       []Entry
+		wantErr    string
+	}{{
+		name: "transcript",
+		transcript: `2026-10-18T12:00:00Z [` + testRA + `] --- opened
+2026-10-18T12:00:00Z [` + testRA + `] 1 a
+2026-10-18T12:00:01.5Z [` + ra2 + `] 2 b  c
+2026-10-18T12:00:02Z [` + ra2 + `] 3
+2026-10-18T12:00:17Z [` + ra2 + `] --- timed out
+2026-10-18T12:00:17Z [` + ra2 + `] --- closed: kaboom
+`,
+		want: []Entry{{
+			Time:       t0,
+			RemoteAddr: testRA,
+			Seq:        1,
+			Line:       "a",
+		}, {
+			Time:       t0.Add(1500 * time.Millisecond),
+			RemoteAddr: ra2,
+			Seq:        2,
+			Line:       "b  c",
+		}, {
+			Time:       t0.Add(2 * time.Second),
+			RemoteAddr: ra2,
+			Seq:        3,
+		}, {
+			Time:       t0.Add(17 * time.Second),
+			RemoteAddr: ra2,
+		}, {
+			Time:       t0.Add(17 * time.Second),
+			RemoteAddr: ra2,
+		}},
+	}, {
+		name: "debug_log",
+		transcript: `2026/10/18 12:00:00 [` + testRA +
+			`] Sent "1 a" to kittens` + "\n",
+		wantErr: "line 1: not a transcript line",
+	}, {
+		name: "bad_time",
+		transcript: `2026-10-18T12:00:00Z [` + testRA + `] 1 a
+yesterday [` + testRA + `] 2 b
+`,
+		wantErr: `line 2: parsing time: parsing time "yesterday" ` +
+			`as "2006-01-02T15:04:05.999999999Z07:00": cannot ` +
+			`parse "yesterday" as "2006"`,
+	}, {
+		name: "line_zero",
+		transcript: `2026-10-18T12:00:00Z [` + testRA +
+			`] 0 run` + "\n",
+		wantErr: `line 1: invalid line number "0"`,
+	}, {
+		name: "nothing",
+		transcript: `2026-10-18T12:00:00Z [` + testRA +
+			`] --- opened` + "\n",
+		wantErr: "no lines found",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseTranscript(
+				strings.NewReader(c.transcript),
+			)
+			if "" != c.wantErr {
+				if nil == err || err.Error() != c.wantErr {
+					t.Errorf(
+						"Incorrect error\n"+
+							" got: %v\nwant: %s",
+						err,
+						c.wantErr,
+					)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if !slices.EqualFunc(got, c.want, func(
+				a Entry,
+				b Entry,
+			) bool {
+				return a.Time.Equal(b.Time) &&
+					a.RemoteAddr == b.RemoteAddr &&
+					a.Seq == b.Seq &&
+					a.Line == b.Line
+			}) {
+				t.Errorf(
+					"Incorrect entries\n got: %v\nwant: %v",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+}
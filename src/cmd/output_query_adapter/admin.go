@@ -0,0 +1,376 @@
+package main
+
+/*
+ * admin.go
+ * Admin JSON API
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tailBufLen is the number of lines buffered for each tail before lines are
+// dropped.
+const tailBufLen = 1024
+
+// maxKeepAliveBody is the maximum size of a request to change a keepalive
+// timeout.
+const maxKeepAliveBody = 1024
+
+// maxInputBody is the maximum size of a request to queue commands.
+const maxInputBody = 64 * 1024
+
+// AdminTokenID is the ID whose token authenticates admin API requests.
+const AdminTokenID = "/admin"
+
+// InputQueued describes commands queued with the admin API.
+type InputQueued struct {
+	ID string `json:"id"`
+	// Queued is the number of commands queued.
+	Queued int `json:"queued"`
+	// LastSeq is the number of the last command queued.
+	LastSeq int `json:"last_seq"`
+}
+
+// ListenAdmin listens on addr for the admin API.  If addr contains a /, it is
+// taken to be the path to a unix socket.  A unix socket left behind by a
+// previous run is removed.
+func ListenAdmin(addr string) (net.Listener, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+	l, err := net.Listen(network, addr)
+	if "unix" == network && errors.Is(err, syscall.EADDRINUSE) {
+		/* If nobody's listening, it's stale. */
+		c, derr := net.Dial(network, addr)
+		if nil == derr {
+			c.Close()
+		} else if errors.Is(derr, syscall.ECONNREFUSED) {
+			if err := os.Remove(addr); nil != err {
+				return nil, fmt.Errorf(
+					"removing stale socket: %w",
+					err,
+				)
+			}
+			l, err = net.Listen(network, addr)
+		}
+	}
+	if nil != err {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	return l, nil
+}
+
+// NewAdminMux returns a new [http.ServeMux] which serves the admin API for
+// cm.  If input isn't nil, commands may be queued in it.  If secret isn't
+// empty, requests must have an Authorization header with the token for
+// AdminTokenID, e.g. Authorization: Bearer {token}.
+func NewAdminMux(
+	cm *ConnManager,
+	input *InputQueue,
+	secret []byte,
+) *http.ServeMux {
+	return newAdminMux(adminHandler{
+		logf:   log.Printf,
+		cm:     cm,
+		tails:  newTailer(cm),
+		input:  input,
+		secret: secret,
+	})
+}
+
+// newAdminMux does what NewAdminMux says it does, but with an adminHandler,
+// for testing.
+func newAdminMux(h adminHandler) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	/* Every route needs a token, if we have a secret. */
+	handle := func(p string, f http.HandlerFunc) {
+		mux.HandleFunc(p, h.authenticate(f))
+	}
+	handle("GET /sessions", h.handleList)
+	handle("GET /sessions/{"+idParam+"}", h.handleInspect)
+	handle("DELETE /sessions/{"+idParam+"}", h.handleClose)
+	handle("PUT /sessions/{"+idParam+"}/keepalive", h.handleKeepAlive)
+	handle("GET /sessions/{"+idParam+"}/tail", h.handleTail)
+	if nil != h.input {
+		handle("POST /sessions/{"+idParam+"}/input", h.handleInput)
+	}
+
+	return mux
+}
+
+// adminHandler passes data to our admin HTTP handlers.
+type adminHandler struct {
+	logf   func(string, ...any) /* Test-settable. */
+	cm     *ConnManager
+	tails  *tailer
+	input  *InputQueue /* Nil to not queue input. */
+	secret []byte      /* Empty to not need a token. */
+}
+
+// authenticate wraps f to require the token for AdminTokenID as a bearer
+// token, if we have a secret.
+func (h adminHandler) authenticate(f http.HandlerFunc) http.HandlerFunc {
+	if 0 == len(h.secret) {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		tok, ok := strings.CutPrefix(
+			r.Header.Get("Authorization"),
+			"Bearer ",
+		)
+		if !ok || !ValidSessionToken(h.secret, AdminTokenID, tok) {
+			h.logf(
+				"[%s] Rejected unauthenticated admin request",
+				r.RemoteAddr,
+			)
+			ec := http.StatusForbidden
+			http.Error(w, http.StatusText(ec), ec)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// handleList lists the open sessions.
+func (h adminHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, r, h.cm.Sessions())
+}
+
+// handleInspect describes a single session.
+func (h adminHandler) handleInspect(w http.ResponseWriter, r *http.Request) {
+	si, err := h.cm.Session(r.PathValue(idParam))
+	if nil != err {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, si)
+}
+
+// handleClose closes a session.
+func (h adminHandler) handleClose(w http.ResponseWriter, r *http.Request) {
+	si, err := h.cm.ForceClose(r.PathValue(idParam))
+	if nil != err {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, si)
+}
+
+// handleKeepAlive changes a session's keepalive timeout to the duration in
+// the request body, e.g. 1m.
+func (h adminHandler) handleKeepAlive(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxKeepAliveBody))
+	if nil != err {
+		h.writeError(w, r, fmt.Errorf("reading body: %w", err))
+		return
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(string(b)))
+	if nil != err || 0 >= d {
+		ec := http.StatusBadRequest
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	si, err := h.cm.SetKeepAliveTimeout(r.PathValue(idParam), d)
+	if nil != err {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, si)
+}
+
+// handleTail streams a session's lines as they're written to the Sink, until
+// the session ends.  Lines are dropped if the client can't keep up.
+func (h adminHandler) handleTail(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue(idParam)
+
+	/* Subscribe first, so we don't miss the end of the session. */
+	ch, cancel := h.tails.subscribe(id)
+	defer cancel()
+	if _, err := h.cm.Session(id); nil != err {
+		h.writeError(w, r, err)
+		return
+	}
+
+	/* Send lines as we get them. */
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := io.WriteString(w, line+"\n"); nil != err {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleInput queues the commands in the request body, one per line, for a
+// shell to poll.  The session needn't be open yet.
+func (h adminHandler) handleInput(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue(idParam)
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxInputBody+1))
+	if nil != err {
+		h.writeError(w, r, fmt.Errorf("reading body: %w", err))
+		return
+	}
+	if maxInputBody < len(b) || 0 == len(b) {
+		ec := http.StatusBadRequest
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	var cmds []string
+	for l := range strings.Lines(string(b)) {
+		cmds = append(cmds, strings.TrimRight(l, "\r\n"))
+	}
+	last, err := h.input.Add(id, cmds...)
+	if nil != err {
+		h.writeError(w, r, err)
+		return
+	}
+	h.logf("[%s] Queued %d commands for %s", r.RemoteAddr, len(cmds), id)
+	h.writeJSON(w, r, InputQueued{
+		ID:      id,
+		Queued:  len(cmds),
+		LastSeq: last,
+	})
+}
+
+// writeError sends an error response appropriate for err.
+func (h adminHandler) writeError(
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
+	ec := http.StatusInternalServerError
+	if errors.Is(err, ErrNotOpen) {
+		ec = http.StatusNotFound
+	} else if errors.Is(err, ErrInputQueueFull) {
+		ec = http.StatusServiceUnavailable
+	} else {
+		h.logf("[%s] Admin request error: %s", r.RemoteAddr, err)
+	}
+	http.Error(w, http.StatusText(ec), ec)
+}
+
+// writeJSON sends v as indented JSON.
+func (h adminHandler) writeJSON(
+	w http.ResponseWriter,
+	r *http.Request,
+	v any,
+) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); nil != err {
+		h.logf(
+			"[%s] Error sending admin response: %s",
+			r.RemoteAddr,
+			err,
+		)
+	}
+}
+
+// tailer passes lines written to the Sink to subscribers.  Subscribers follow
+// the connection which was open when they subscribed, not anything which
+// replaces it after a restart.
+type tailer struct {
+	mu      sync.Mutex
+	current map[string]uint64       /* ID -> Open conn's Event.Conn */
+	subs    map[chan string]tailSub /* Subscriber -> What it follows */
+}
+
+// tailSub is what a tail subscriber follows.
+type tailSub struct {
+	id   string
+	conn uint64 /* Event.Conn, or 0 until the conn opens. */
+}
+
+// newTailer returns a new tailer which gets lines from cm.
+func newTailer(cm *ConnManager) *tailer {
+	t := &tailer{
+		current: make(map[string]uint64),
+		subs:    make(map[chan string]tailSub),
+	}
+	cm.OnEvent(t.handleEvent)
+	return t
+}
+
+// handleEvent sends delivered lines to subscribers and closes subscribers'
+// channels when their connections close.
+func (t *tailer) handleEvent(ev Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch ev.Type {
+	case EventOpened:
+		t.current[ev.ID] = ev.Conn
+		/* Subscribers waiting for this ID get this conn. */
+		for ch, sub := range t.subs {
+			if sub.id == ev.ID && 0 == sub.conn {
+				t.subs[ch] = tailSub{id: ev.ID, conn: ev.Conn}
+			}
+		}
+	case EventLineDelivered:
+		for ch, sub := range t.subs {
+			if sub.id != ev.ID || sub.conn != ev.Conn {
+				continue
+			}
+			select {
+			case ch <- ev.Line:
+			default: /* Slow reader. */
+			}
+		}
+	case EventClosed:
+		for ch, sub := range t.subs {
+			if sub.id == ev.ID && sub.conn == ev.Conn {
+				close(ch)
+				delete(t.subs, ch)
+			}
+		}
+		if t.current[ev.ID] == ev.Conn {
+			delete(t.current, ev.ID)
+		}
+	}
+}
+
+// subscribe returns a channel which receives lines written to the Sink for
+// id's open connection.  The channel is closed when the connection closes.
+// The returned function unsubscribes.
+func (t *tailer) subscribe(id string) (<-chan string, func()) {
+	ch := make(chan string, tailBufLen)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subs[ch] = tailSub{id: id, conn: t.current[id]}
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subs, ch) /* No-op if already closed. */
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+/*
+ * admin_test.go
+ * Tests for admin.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/synctesthttpserver"
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
+)
+
+// adminRequest makes a request to mux and returns the response.
+func adminRequest(
+	t *testing.T,
+	mux *http.ServeMux,
+	method string,
+	path string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = testRA
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+// checkSessionInfo checks that got and want describe the same session.
+func checkSessionInfo(t *testing.T, got, want SessionInfo) {
+	t.Helper()
+	if got.ID != want.ID ||
+		got.RemoteAddr != want.RemoteAddr ||
+		!got.Opened.Equal(want.Opened) ||
+		!got.LastLine.Equal(want.LastLine) ||
+		got.Lines != want.Lines ||
+		got.Bytes != want.Bytes ||
+		!got.KeepAliveDeadline.Equal(want.KeepAliveDeadline) ||
+		got.KeepAliveTimeout != want.KeepAliveTimeout {
+		t.Errorf(
+			"Incorrect session info\n got: %+v\nwant: %+v",
+			got,
+			want,
+		)
+	}
+}
+
+// Can we list, inspect, and close sessions?
+func TestAdmin(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			tl, lb = testlogger.New()
+			cm     = NewConnManager(NewWriterSink(io.Discard))
+			mux    = newAdminMux(adminHandler{
+				logf: tl.Printf,
+				cm:   cm,
+			})
+			id1   = ts("id1")
+			id2   = ts("id2")
+			start = time.Now()
+			later = start.Add(time.Second)
+		)
+		cm.logf = tl.Printf
+
+		/* Two sessions, one a bit older. */
+		for _, l := range []string{"1 a", "2 bb"} {
+			if _, err := cm.Send(id1, testRA, l); nil != err {
+				t.Fatalf("Error sending %q: %s", l, err)
+			}
+		}
+		time.Sleep(time.Second)
+		if _, err := cm.Send(id2, "192.0.2.2:1", "1 c"); nil != err {
+			t.Fatalf("Error sending line: %s", err)
+		}
+		synctest.Wait()
+		want := []SessionInfo{{
+			ID:                id1,
+			RemoteAddr:        testRA,
+			Opened:            start,
+			LastLine:          start,
+			Lines:             2,
+			Bytes:             5,
+			KeepAliveDeadline: start.Add(MaxKeepAliveWait),
+			KeepAliveTimeout:  MaxKeepAliveWait,
+		}, {
+			ID:                id2,
+			RemoteAddr:        "192.0.2.2:1",
+			Opened:            later,
+			LastLine:          later,
+			Lines:             1,
+			Bytes:             2,
+			KeepAliveDeadline: later.Add(MaxKeepAliveWait),
+			KeepAliveTimeout:  MaxKeepAliveWait,
+		}}
+
+		/* List them. */
+		rr := adminRequest(t, mux, http.MethodGet, "/sessions")
+		if http.StatusOK != rr.Code {
+			t.Fatalf("Listing sessions failed: %d", rr.Code)
+		}
+		if got, want := rr.Header().Get("Content-Type"),
+			"application/json"; got != want {
+			t.Errorf("Incorrect Content-Type %q", got)
+		}
+		var sis []SessionInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &sis); nil != err {
+			t.Fatalf("Error decoding session list: %s", err)
+		}
+		if len(want) != len(sis) {
+			t.Fatalf(
+				"Got %d sessions, want %d",
+				len(sis),
+				len(want),
+			)
+		}
+		for i, got := range sis {
+			checkSessionInfo(t, got, want[i])
+		}
+
+		/* Inspect one. */
+		rr = adminRequest(t, mux, http.MethodGet, "/sessions/"+id2)
+		var si SessionInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &si); nil != err {
+			t.Fatalf("Error decoding session: %s", err)
+		}
+		checkSessionInfo(t, si, want[1])
+		rr = adminRequest(t, mux, http.MethodGet, "/sessions/kittens")
+		if got, want := rr.Code, http.StatusNotFound; got != want {
+			t.Errorf(
+				"Incorrect unknown session status\n"+
+					" got: %d\n"+
+					"want: %d",
+				got,
+				want,
+			)
+		}
+
+		/* Close one. */
+		p := "/sessions/" + id1
+		rr = adminRequest(t, mux, http.MethodDelete, p)
+		if http.StatusOK != rr.Code {
+			t.Fatalf("Closing session failed: %d", rr.Code)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &si); nil != err {
+			t.Fatalf("Error decoding closed session: %s", err)
+		}
+		checkSessionInfo(t, si, want[0])
+		synctest.Wait()
+		if sis := cm.Sessions(); 1 != len(sis) || id2 != sis[0].ID {
+			t.Errorf("Incorrect sessions after close: %+v", sis)
+		}
+		rr = adminRequest(t, mux, http.MethodDelete, p)
+		if got, want := rr.Code, http.StatusNotFound; got != want {
+			t.Errorf(
+				"Incorrect second close status\n"+
+					" got: %d\n"+
+					"want: %d",
+				got,
+				want,
+			)
+		}
+		if _, err := cm.Send(id1, testRA, "3 d"); nil == err {
+			t.Errorf("Sent line after closing session")
+		}
+
+		if err := cm.CloseConn(id2, testRA); nil != err {
+			t.Errorf("Error closing %s: %s", id2, err)
+		}
+		lb.TestStartsWith(t, "Force-closed connection for "+id1)
+		lb.TestEmpty(t)
+	})
+}
+
+// Do admin requests need a token when we have a secret?
+func TestAdmin_Auth(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		secret = []byte("kittens")
+		mux    = newAdminMux(adminHandler{
+			logf:   tl.Printf,
+			cm:     NewConnManager(NewWriterSink(io.Discard)),
+			secret: secret,
+		})
+		good = SessionToken(secret, AdminTokenID)
+	)
+	for _, c := range []struct {
+		name string
+		auth string
+		want int
+	}{{
+		name: "no_token",
+		want: http.StatusForbidden,
+	}, {
+		name: "wrong_token",
+		auth: "Bearer " + SessionToken(secret, "/c"),
+		want: http.StatusForbidden,
+	}, {
+		name: "not_bearer",
+		auth: good,
+		want: http.StatusForbidden,
+	}, {
+		name: "good_token",
+		auth: "Bearer " + good,
+		want: http.StatusOK,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				http.MethodGet,
+				"/sessions",
+				nil,
+			)
+			req.RemoteAddr = testRA
+			if "" != c.auth {
+				req.Header.Set("Authorization", c.auth)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if got := rr.Code; got != c.want {
+				t.Errorf(
+					"Incorrect status\n"+
+						" got: %d\n"+
+						"want: %d",
+					got,
+					c.want,
+				)
+			}
+			if http.StatusForbidden == c.want {
+				lb.TestStartsWith(
+					t,
+					"["+testRA+"] Rejected "+
+						"unauthenticated admin request",
+				)
+			}
+			lb.TestEmpty(t)
+		})
+	}
+}
+
+// Can we serve the admin API on a unix socket?
+func TestListenAdmin_Unix(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := ListenAdmin(fn)
+	if nil != err {
+		t.Fatalf("Error listening: %s", err)
+	}
+	if got, want := l.Addr().Network(), "unix"; got != want {
+		t.Errorf("Incorrect network\n got: %s\nwant: %s", got, want)
+	}
+	if got := l.Addr().String(); fn != got {
+		t.Errorf("Incorrect address\n got: %s\nwant: %s", got, fn)
+	}
+
+	/* A live socket shouldn't be stolen. */
+	if l2, err := ListenAdmin(fn); nil == err {
+		l2.Close()
+		t.Errorf("Listened on a socket already in use")
+	}
+
+	/* A stale socket should be replaced. */
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = ListenAdmin(fn); nil != err {
+		t.Fatalf("Error listening on stale socket: %s", err)
+	}
+	l.Close()
+}
+
+// Can we change a session's keepalive timeout?
+func TestAdmin_KeepAlive(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			tl, lb = testlogger.New()
+			cm     = NewConnManager(NewWriterSink(io.Discard))
+			mux    = newAdminMux(adminHandler{
+				logf: tl.Printf,
+				cm:   cm,
+			})
+			id    = ts("id")
+			p     = "/sessions/" + id + "/keepalive"
+			start = time.Now()
+		)
+		cm.logf = tl.Printf
+		if _, err := cm.Send(id, testRA, "1 a"); nil != err {
+			t.Fatalf("Error sending line: %s", err)
+		}
+
+		/* Bad durations should be rejected. */
+		for _, have := range []string{"", "kittens", "-1s", "0"} {
+			req := httptest.NewRequest(
+				http.MethodPut,
+				p,
+				strings.NewReader(have),
+			)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if got, want := rr.Code, http.StatusBadRequest; got !=
+				want {
+				t.Errorf(
+					"Incorrect status for %q\n"+
+						" got: %d\n"+
+						"want: %d",
+					have,
+					got,
+					want,
+				)
+			}
+		}
+
+		/* A good one should stick. */
+		time.Sleep(time.Second)
+		req := httptest.NewRequest(
+			http.MethodPut,
+			p,
+			strings.NewReader("1m\n"),
+		)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if http.StatusOK != rr.Code {
+			t.Fatalf("Setting keepalive failed: %d", rr.Code)
+		}
+		var si SessionInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &si); nil != err {
+			t.Fatalf("Error decoding session: %s", err)
+		}
+		checkSessionInfo(t, si, SessionInfo{
+			ID:                id,
+			RemoteAddr:        testRA,
+			Opened:            start,
+			LastLine:          start,
+			Lines:             1,
+			Bytes:             2,
+			KeepAliveDeadline: start.Add(time.Second + time.Minute),
+			KeepAliveTimeout:  time.Minute,
+		})
+
+		/* The session should last until the new deadline. */
+		time.Sleep(time.Minute - time.Nanosecond)
+		if _, err := cm.Session(id); nil != err {
+			t.Errorf("Session closed early: %s", err)
+		}
+		time.Sleep(time.Nanosecond)
+		synctest.Wait()
+		if _, err := cm.Session(id); nil == err {
+			t.Errorf("Session not closed after keepalive timeout")
+		}
+
+		/* Closed sessions should 404. */
+		req = httptest.NewRequest(
+			http.MethodPut,
+			p,
+			strings.NewReader("1m"),
+		)
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if got, want := rr.Code, http.StatusNotFound; got != want {
+			t.Errorf(
+				"Incorrect closed session status\n"+
+					" got: %d\n"+
+					"want: %d",
+				got,
+				want,
+			)
+		}
+
+		lb.TestStartsWith(
+			t,
+			"Keepalive timeout for "+id+" set to 1m0s",
+			"Closed connection for "+id+" after timeout",
+		)
+		lb.TestEmpty(t)
+	})
+}
+
+// Can we watch a session's output?
+func TestAdmin_Tail(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			tl, lb = testlogger.New()
+			cm     = NewConnManager(NewWriterSink(io.Discard))
+			svr    = synctesthttpserver.NewServer(
+				NewAdminMux(cm, nil, nil),
+			)
+			id = ts("id")
+			n  = 5
+			tp = svr.URL + "/sessions/" + id + "/tail"
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+
+		/* Can't tail what doesn't exist. */
+		res, err := svr.Client().Get(tp)
+		if nil != err {
+			t.Fatalf("Error requesting unknown tail: %s", err)
+		}
+		res.Body.Close()
+		if got, want := res.StatusCode, http.StatusNotFound; got !=
+			want {
+			t.Errorf(
+				"Incorrect unknown tail status\n"+
+					" got: %d\n"+
+					"want: %d",
+				got,
+				want,
+			)
+		}
+
+		/* Lines sent before the tail starts shouldn't show up. */
+		if _, err := cm.Send(id, testRA, "1 early"); nil != err {
+			t.Fatalf("Error sending early line: %s", err)
+		}
+		synctest.Wait()
+		res, err = svr.Client().Get(tp)
+		if nil != err {
+			t.Fatalf("Error requesting tail: %s", err)
+		}
+		defer res.Body.Close()
+		if http.StatusOK != res.StatusCode {
+			t.Fatalf("Tail failed: %s", res.Status)
+		}
+
+		/* Send a few lines and close the session, which should end
+		the tail. */
+		var want string
+		for i := range n {
+			l := fmt.Sprintf("line %d", i+1)
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d %s", i+2, l),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", i+2, err)
+			}
+			want += l + "\n"
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing session: %s", err)
+		}
+		got, err := io.ReadAll(res.Body)
+		if nil != err {
+			t.Fatalf("Error reading tail: %s", err)
+		}
+		if string(got) != want {
+			t.Errorf(
+				"Incorrect tail\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Do tails follow the connection open when they started, and not whatever
+// replaces it after a restart?
+func TestTailer_Restart(t *testing.T) {
+	var (
+		tl = newTailer(NewConnManager(NewWriterSink(io.Discard)))
+		id = ts("id")
+		ev = func(et EventType, conn uint64, line string) {
+			tl.handleEvent(Event{
+				Type: et,
+				ID:   id,
+				Conn: conn,
+				Line: line,
+			})
+		}
+		read = func(ch <-chan string) []string {
+			var ls []string
+			for {
+				select {
+				case l, ok := <-ch:
+					if !ok {
+						return append(ls, "closed")
+					}
+					ls = append(ls, l)
+				default:
+					return ls
+				}
+			}
+		}
+	)
+
+	/* Subscribed before the first conn opens. */
+	early, cancel := tl.subscribe(id)
+	defer cancel()
+	ev(EventOpened, 1, "")
+	old, cancel := tl.subscribe(id)
+	defer cancel()
+	ev(EventLineDelivered, 1, "old")
+
+	/* The shell restarts, and the old conn closes after the new one
+	opens. */
+	ev(EventOpened, 2, "")
+	cur, cancel := tl.subscribe(id)
+	defer cancel()
+	ev(EventLineDelivered, 1, "old-last")
+	ev(EventLineDelivered, 2, "new")
+	ev(EventClosed, 1, "")
+	ev(EventLineDelivered, 2, "new-last")
+
+	for _, c := range []struct {
+		name string
+		ch   <-chan string
+		want []string
+	}{{
+		name: "early",
+		ch:   early,
+		want: []string{"old", "old-last", "closed"},
+	}, {
+		name: "old",
+		ch:   old,
+		want: []string{"old", "old-last", "closed"},
+	}, {
+		name: "current",
+		ch:   cur,
+		want: []string{"new", "new-last"},
+	}} {
+		if got := read(c.ch); !slices.Equal(got, c.want) {
+			t.Errorf(
+				"Incorrect %s tail\n"+
+					" got: %q\n"+
+					"want: %q",
+				c.name,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+// Can we queue commands for shells?
+func TestAdmin_Input(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		input  = NewInputQueue()
+		mux    = newAdminMux(adminHandler{
+			logf:  tl.Printf,
+			cm:    NewConnManager(NewWriterSink(io.Discard)),
+			input: input,
+		})
+		id = ts("id")
+		p  = "/sessions/" + id + "/input"
+	)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			p,
+			strings.NewReader(body),
+		)
+		req.RemoteAddr = testRA
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	/* Empty bodies should be rejected. */
+	if got, want := post("").Code, http.StatusBadRequest; got != want {
+		t.Errorf(
+			"Incorrect empty body status\n got: %d\nwant: %d",
+			got,
+			want,
+		)
+	}
+
+	/* Commands should be queued, one per line. */
+	for i, c := range []struct {
+		body string
+		want InputQueued
+	}{{
+		body: "uname -a\r\nls /tmp\n",
+		want: InputQueued{ID: id, Queued: 2, LastSeq: 2},
+	}, {
+		body: "cat /tmp/ai/ai.log",
+		want: InputQueued{ID: id, Queued: 1, LastSeq: 3},
+	}} {
+		rr := post(c.body)
+		if http.StatusOK != rr.Code {
+			t.Fatalf("Queueing %d failed: %d", i, rr.Code)
+		}
+		var got InputQueued
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); nil != err {
+			t.Fatalf("Error decoding response %d: %s", i, err)
+		}
+		if got != c.want {
+			t.Errorf(
+				"Incorrect response %d\n got: %+v\nwant: %+v",
+				i,
+				got,
+				c.want,
+			)
+		}
+	}
+	got, err := input.Get(context.Background(), id, 0)
+	if nil != err {
+		t.Fatalf("Error getting queued commands: %s", err)
+	}
+	if want := []InputCommand{
+		{Seq: 1, Command: "uname -a"},
+		{Seq: 2, Command: "ls /tmp"},
+		{Seq: 3, Command: "cat /tmp/ai/ai.log"},
+	}; !slices.Equal(got, want) {
+		t.Errorf(
+			"Incorrect queued commands\n got: %v\nwant: %v",
+			got,
+			want,
+		)
+	}
+
+	lb.TestStartsWith(
+		t,
+		"["+testRA+"] Queued 2 commands for "+id,
+		"["+testRA+"] Queued 1 commands for "+id,
+	)
+	lb.TestEmpty(t)
+}
@@ -0,0 +1,220 @@
+package main
+
+/*
+ * autoinstall.go
+ * Serve autoinstall(8) response files
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Autoinstall modes, as in the names of response files.
+const (
+	AutoInstallInstall = "install"
+	AutoInstallUpgrade = "upgrade"
+)
+
+// autoInstallSuffix ends every response file's name.
+const autoInstallSuffix = ".conf"
+
+// ErrNoResponseFile is returned by AutoInstaller.Render when there's no
+// template for a response file.
+var ErrNoResponseFile = errors.New("no response file")
+
+// macRE matches a MAC address as autoinstall(8) puts it in a response file's
+// name.
+var macRE = regexp.MustCompile(`^([[:xdigit:]]{2}:){5}[[:xdigit:]]{2}$`)
+
+// AutoInstallData is passed to response file templates.
+type AutoInstallData struct {
+	// MAC is the MAC address from the requested file's name, lowercase,
+	// or the empty string if there wasn't one.
+	MAC string
+	// IP is the requesting installer's IP address.
+	IP string
+	// Mode is either AutoInstallInstall or AutoInstallUpgrade.
+	Mode string
+	// Path is the path query parameter the installer sends, e.g.
+	// 7.8/amd64.
+	Path string
+}
+
+// ParseResponseFileName parses the name of a response file requested by
+// autoinstall(8), either mode.conf or MAC-mode.conf.  The MAC address is
+// returned lowercase.
+func ParseResponseFileName(name string) (mac, mode string, err error) {
+	base, ok := strings.CutSuffix(name, autoInstallSuffix)
+	if !ok {
+		return "", "", fmt.Errorf("not a .conf file: %q", name)
+	}
+	if i := strings.LastIndexByte(base, '-'); -1 != i {
+		mac, base = strings.ToLower(base[:i]), base[i+1:]
+		if !macRE.MatchString(mac) {
+			return "", "", fmt.Errorf("invalid MAC address %q", mac)
+		}
+	}
+	switch base {
+	case AutoInstallInstall, AutoInstallUpgrade:
+		return mac, base, nil
+	default:
+		return "", "", fmt.Errorf("unknown mode %q", base)
+	}
+}
+
+// AutoInstaller renders response files for autoinstall(8) from templates in
+// a directory.  Templates are read for every request, so they may be changed
+// without restarting.
+type AutoInstaller struct {
+	root *os.Root
+}
+
+// NewAutoInstaller returns a new AutoInstaller which renders templates in
+// dir.  For an installer in mode with the MAC address mac and IP address ip,
+// the first template found of mac-mode.conf, ip-mode.conf, and mode.conf is
+// used.  Templates are passed an AutoInstallData.
+func NewAutoInstaller(dir string) (*AutoInstaller, error) {
+	root, err := os.OpenRoot(dir)
+	if nil != err {
+		return nil, fmt.Errorf("opening directory: %w", err)
+	}
+	return &AutoInstaller{root: root}, nil
+}
+
+// Render writes the response file for d to w and returns the name of the
+// template used.  If there's no template, Render returns ErrNoResponseFile.
+func (ai *AutoInstaller) Render(
+	w io.Writer,
+	d AutoInstallData,
+) (string, error) {
+	/* Find the most specific template. */
+	var names []string
+	for _, s := range []string{d.MAC, d.IP} {
+		if "" != s {
+			names = append(names, s+"-"+d.Mode+autoInstallSuffix)
+		}
+	}
+	names = append(names, d.Mode+autoInstallSuffix)
+	var (
+		name string
+		b    []byte
+		err  error
+	)
+	for _, name = range names {
+		b, err = ai.root.ReadFile(name)
+		if nil == err || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNoResponseFile
+	} else if nil != err {
+		return "", fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	/* Fill it in. */
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(
+		string(b),
+	)
+	if nil != err {
+		return "", fmt.Errorf("parsing %s: %w", name, err)
+	}
+	if err := tmpl.Execute(w, d); nil != err {
+		return "", fmt.Errorf("executing %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// NewAutoInstallMux returns a new [http.ServeMux] which serves response files
+// from ai, as autoinstall(8) requests them.
+func NewAutoInstallMux(ai *AutoInstaller) *http.ServeMux {
+	return newAutoInstallMux(autoInstallHandler{
+		logf:   log.Printf,
+		debugf: Debugf,
+		ai:     ai,
+	})
+}
+
+// newAutoInstallMux does what NewAutoInstallMux says it does, but with an
+// autoInstallHandler, for testing.
+func newAutoInstallMux(h autoInstallHandler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{"+nameParam+"}", h.handleResponseFile)
+	return mux
+}
+
+// autoInstallHandler passes data to our autoinstall HTTP handlers.
+type autoInstallHandler struct {
+	logf   func(string, ...any) /* Test-settable. */
+	debugf func(string, ...any) /* Test-settable. */
+	ai     *AutoInstaller
+}
+
+// handleResponseFile sends an installer its response file.
+func (h autoInstallHandler) handleResponseFile(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	var (
+		ra   = r.RemoteAddr
+		name = r.PathValue(nameParam)
+	)
+	mac, mode, err := ParseResponseFileName(name)
+	if nil != err {
+		h.logf("[%s] Invalid response file request: %s", ra, err)
+		ec := http.StatusNotFound
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	ip, _, err := net.SplitHostPort(ra)
+	if nil != err {
+		ip = ra
+	}
+
+	/* Work out what to send. */
+	var buf bytes.Buffer
+	tname, err := h.ai.Render(&buf, AutoInstallData{
+		MAC:  mac,
+		IP:   ip,
+		Mode: mode,
+		Path: r.URL.Query().Get("path"),
+	})
+	if errors.Is(err, ErrNoResponseFile) {
+		h.logf("[%s] No response file for %s", ra, name)
+		ec := http.StatusNotFound
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	} else if nil != err {
+		h.logf("[%s] Error rendering response file: %s", ra, err)
+		ec := http.StatusInternalServerError
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	h.debugf("[%s] Response file from %s:\n%s", ra, tname, buf.String())
+
+	/* Send it off. */
+	if _, err := buf.WriteTo(w); nil != err {
+		h.logf(
+			"[%s] Error sending response file %s: %s",
+			ra,
+			tname,
+			err,
+		)
+		return
+	}
+	h.logf("[%s] Sent response file %s for %s", ra, tname, name)
+}
@@ -0,0 +1,280 @@
+package main
+
+/*
+ * autoinstall_test.go
+ * Tests for autoinstall.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
+)
+
+// testAutoInstallDir returns a directory with response file templates.
+func testAutoInstallDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"install.conf": "System hostname = default\n" +
+			"Location of sets = {{.Path}}\n",
+		"00:11:22:aa:bb:cc-install.conf": "System hostname = " +
+			"mac-{{.MAC}}-{{.IP}}\n",
+		"192.0.2.1-install.conf": "System hostname = ip-{{.IP}}\n",
+		"upgrade.conf":           "Mode = {{.Mode}}\n",
+		"192.0.2.2-upgrade.conf": "Mode = {{.Kittens}}\n",
+	} {
+		if err := os.WriteFile(
+			filepath.Join(dir, name),
+			[]byte(contents),
+			0600,
+		); nil != err {
+			t.Fatalf("Error writing %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+// Do we understand what autoinstall asks for?
+func TestParseResponseFileName(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		wantMAC  string
+		wantMode string
+		wantErr  string
+	}{{
+		name:     "install.conf",
+		wantMode: AutoInstallInstall,
+	}, {
+		name:     "upgrade.conf",
+		wantMode: AutoInstallUpgrade,
+	}, {
+		name:     "00:11:22:AA:BB:CC-install.conf",
+		wantMAC:  "00:11:22:aa:bb:cc",
+		wantMode: AutoInstallInstall,
+	}, {
+		name:    "install",
+		wantErr: `not a .conf file: "install"`,
+	}, {
+		name:    "disklabel.conf",
+		wantErr: `unknown mode "disklabel"`,
+	}, {
+		name:    "kittens-install.conf",
+		wantErr: `invalid MAC address "kittens"`,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			mac, mode, err := ParseResponseFileName(c.name)
+			if "" != c.wantErr {
+				if nil == err || err.Error() != c.wantErr {
+					t.Errorf(
+						"Incorrect error\n"+
+							" got: %v\n"+
+							"want: %s",
+						err,
+						c.wantErr,
+					)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if mac != c.wantMAC || mode != c.wantMode {
+				t.Errorf(
+					"Incorrect parse\n"+
+						" got: MAC:%q Mode:%q\n"+
+						"want: MAC:%q Mode:%q",
+					mac,
+					mode,
+					c.wantMAC,
+					c.wantMode,
+				)
+			}
+		})
+	}
+}
+
+// Do we pick the right template?
+func TestAutoInstaller_Render(t *testing.T) {
+	ai, err := NewAutoInstaller(testAutoInstallDir(t))
+	if nil != err {
+		t.Fatalf("Error creating AutoInstaller: %s", err)
+	}
+	for _, c := range []struct {
+		name     string
+		data     AutoInstallData
+		wantName string
+		want     string
+	}{{
+		name: "mac",
+		data: AutoInstallData{
+			MAC:  "00:11:22:aa:bb:cc",
+			IP:   "192.0.2.1",
+			Mode: AutoInstallInstall,
+		},
+		wantName: "00:11:22:aa:bb:cc-install.conf",
+		want: "System hostname = " +
+			"mac-00:11:22:aa:bb:cc-192.0.2.1\n",
+	}, {
+		name: "ip",
+		data: AutoInstallData{
+			MAC:  "00:11:22:aa:bb:cd",
+			IP:   "192.0.2.1",
+			Mode: AutoInstallInstall,
+		},
+		wantName: "192.0.2.1-install.conf",
+		want:     "System hostname = ip-192.0.2.1\n",
+	}, {
+		name: "default",
+		data: AutoInstallData{
+			IP:   "192.0.2.3",
+			Mode: AutoInstallInstall,
+			Path: "7.8/amd64",
+		},
+		wantName: "install.conf",
+		want: "System hostname = default\n" +
+			"Location of sets = 7.8/amd64\n",
+	}, {
+		name: "upgrade",
+		data: AutoInstallData{
+			IP:   "192.0.2.1",
+			Mode: AutoInstallUpgrade,
+		},
+		wantName: "upgrade.conf",
+		want:     "Mode = upgrade\n",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			var sb strings.Builder
+			name, err := ai.Render(&sb, c.data)
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if name != c.wantName {
+				t.Errorf(
+					"Incorrect template\n"+
+						" got: %s\n"+
+						"want: %s",
+					name,
+					c.wantName,
+				)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf(
+					"Incorrect response\n"+
+						" got: %q\n"+
+						"want: %q",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+
+	/* Broken templates should be errors. */
+	if _, err := ai.Render(new(strings.Builder), AutoInstallData{
+		IP:   "192.0.2.2",
+		Mode: AutoInstallUpgrade,
+	}); nil == err {
+		t.Errorf("No error for broken template")
+	}
+
+	/* As should no templates. */
+	if err := os.Remove(filepath.Join(
+		ai.root.Name(),
+		"upgrade.conf",
+	)); nil != err {
+		t.Fatalf("Error removing upgrade.conf: %s", err)
+	}
+	if _, err := ai.Render(new(strings.Builder), AutoInstallData{
+		IP:   "192.0.2.1",
+		Mode: AutoInstallUpgrade,
+	}); !errors.Is(err, ErrNoResponseFile) {
+		t.Errorf("Incorrect error with no template: %v", err)
+	}
+}
+
+// Do installers get their response files?
+func TestAutoInstallMux(t *testing.T) {
+	ai, err := NewAutoInstaller(testAutoInstallDir(t))
+	if nil != err {
+		t.Fatalf("Error creating AutoInstaller: %s", err)
+	}
+	for _, c := range []struct {
+		path     string
+		want     int
+		wantBody string
+		wantLog  string
+	}{{
+		path: "/00:11:22:aa:bb:cc-install.conf?path=7.8/amd64",
+		want: http.StatusOK,
+		wantBody: "System hostname = " +
+			"mac-00:11:22:aa:bb:cc-192.0.2.1\n",
+		wantLog: "[" + testRA + "] Sent response file " +
+			"00:11:22:aa:bb:cc-install.conf for " +
+			"00:11:22:aa:bb:cc-install.conf",
+	}, {
+		path:     "/install.conf?path=7.8/amd64",
+		want:     http.StatusOK,
+		wantBody: "System hostname = ip-192.0.2.1\n",
+		wantLog: "[" + testRA + "] Sent response file " +
+			"192.0.2.1-install.conf for install.conf",
+	}, {
+		path: "/disklabel",
+		want: http.StatusNotFound,
+		wantLog: "[" + testRA + "] Invalid response file request: " +
+			`not a .conf file: "disklabel"`,
+	}, {
+		path: "/kittens/install.conf",
+		want: http.StatusNotFound,
+	}} {
+		t.Run(c.path, func(t *testing.T) {
+			var (
+				tl, lb = testlogger.New()
+				mux    = newAutoInstallMux(autoInstallHandler{
+					logf:   tl.Printf,
+					debugf: func(string, ...any) {},
+					ai:     ai,
+				})
+				req = httptest.NewRequest(
+					http.MethodGet,
+					c.path,
+					nil,
+				)
+				rr = httptest.NewRecorder()
+			)
+			req.RemoteAddr = testRA
+			mux.ServeHTTP(rr, req)
+			if rr.Code != c.want {
+				t.Errorf(
+					"Incorrect status\n got: %d\nwant: %d",
+					rr.Code,
+					c.want,
+				)
+			}
+			if "" != c.wantBody {
+				if got := rr.Body.String(); got != c.wantBody {
+					t.Errorf(
+						"Incorrect body\n"+
+							" got: %q\n"+
+							"want: %q",
+						got,
+						c.wantBody,
+					)
+				}
+			}
+			if "" != c.wantLog {
+				lb.TestStartsWith(t, c.wantLog)
+			}
+			lb.TestEmpty(t)
+		})
+	}
+}
@@ -5,27 +5,60 @@ package main
  * Manage persistent connections to the target
  * By J. Stuart McMurray
  * Created 20260117
- * Last Modified 20260205
+ * Last Modified 20261018
  */
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"maps"
 	"regexp"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
 // MaxKeepAliveWait is how long we wait to get a keepalive before closing a
 // connection.
-// It is three keepalives plus a second.
+// It is three keepalives plus a second.  It may be changed per-connection with
+// ConnManager.SetKeepAliveTimeout.
 const MaxKeepAliveWait = 16 * time.Second
 
+// DefaultReorderLimit is the default maximum number of early lines held per
+// connection while waiting for a missing line.
+const DefaultReorderLimit = 64
+
+// DefaultReorderTimeout is the default amount of time we wait for a missing
+// line before giving up on it.
+const DefaultReorderTimeout = 10 * time.Second
+
+// DefaultQueueLines is the default maximum number of lines queued per
+// connection.
+const DefaultQueueLines = 4096
+
+// DefaultQueueBytes is the default maximum number of bytes queued per
+// connection.
+const DefaultQueueBytes = 1024 * 1024
+
+// DefaultReconnectTries is the default number of times we try to reopen a
+// connection's SinkConn after it fails.
+const DefaultReconnectTries = 5
+
+// DefaultReconnectWait is the default amount of time we wait before the first
+// reconnect.  It doubles for each subsequent try.
+const DefaultReconnectWait = time.Second
+
+// MaxReconnectWait is the longest we'll wait between reconnects.
+const MaxReconnectWait = 30 * time.Second
+
+// DefaultReplayLines is the default number of lines sent before a connection
+// fails which are sent again after reconnecting, as they may not have made it
+// to the Sink.
+const DefaultReplayLines = 10
+
 // lineRE matches the sort of line we expect in a user-agent string.
 var lineRE = regexp.MustCompile(`^\s*(\d+)(?:\s(.*))?$`)
 
@@ -37,34 +70,297 @@ var ErrNotOpen = errors.New("connection not open")
 // an open connection.
 var ErrNoConnection = errors.New("no exsiting connection")
 
+// ErrStaleLine is returned when a line arrives with a number we gave up
+// waiting for.
+var ErrStaleLine = errors.New("stale line number")
+
+// ErrDuplicateLine is returned when a line arrives with a number which has
+// already been sent or is already being held.  The line is not sent again.
+// This is expected when ftp(1) retries a request which we'd already handled.
+var ErrDuplicateLine = errors.New("duplicate line number")
+
+// ErrQueueFull is returned when a connection's queue is full and its
+// OverflowPolicy is OverflowReject.
+var ErrQueueFull = errors.New("queue full")
+
+// ErrShutdown is returned by Send and Resend after ConnManager.Shutdown has
+// been called.
+var ErrShutdown = errors.New("shutting down")
+
+// SessionInfo describes an open connection.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Opened     time.Time `json:"opened"`
+	// LastLine is when the last line arrived from the shell, or the zero
+	// time if none have.
+	LastLine time.Time `json:"last_line,omitzero"`
+	// Lines and Bytes count what's been written to the Sink, including
+	// lines sent again after reconnecting.
+	Lines int `json:"lines"`
+	Bytes int `json:"bytes"`
+	// KeepAliveDeadline is when the connection will be closed if nothing
+	// keeps it alive.
+	KeepAliveDeadline time.Time `json:"keepalive_deadline"`
+	// KeepAliveTimeout is how long the connection may go without a
+	// keepalive.
+	KeepAliveTimeout time.Duration `json:"keepalive_timeout"`
+}
+
+// LineRange is an inclusive range of line numbers.
+type LineRange struct {
+	Start int
+	End   int
+}
+
+// Status describes which lines have been sent on a connection.
+type Status struct {
+	// Contiguous is the number of the last line sent for which every
+	// previous line has also been sent.
+	Contiguous int
+	// Highest is the highest line number received, sent or not.
+	Highest int
+	// Missing are the ranges of line numbers after Contiguous which
+	// haven't been sent, either because we gave up on them or because we
+	// are still waiting for them.  Missing is sorted.
+	Missing []LineRange
+}
+
+// conn is a single connection's output.  Lines are queued by ConnManager.Send
+// and written to a SinkConn by the conn's own writer goroutine, so a slow
+// SinkConn only slows down its own conn.
 type conn struct {
-	pw  *io.PipeWriter
-	kat *time.Timer /* KeepAlive Timer. */
+	mu sync.Mutex
+
+	kat      *time.Timer   /* KeepAlive Timer. */
+	kaWait   time.Duration /* Time between keepalives before kat fires. */
+	deadline time.Time     /* When kat fires. */
+
+	next    int                /* Next line number to send. */
+	pending map[int]queuedLine /* Early lines, by number. */
+	gapt    *time.Timer        /* Gap Timer, nil if no gap. */
+	skipped []LineRange        /* Lines we gave up waiting for, sorted. */
+
+	queue    []queuedLine  /* Lines waiting for the writer. */
+	qBytes   int           /* Bytes in queue, with newlines. */
+	notify   chan struct{} /* Wakes up the writer. */
+	space    chan struct{} /* Wakes up a Send waiting for room. */
+	dropped  int           /* Lines dropped from a full queue. */
+	rejected int           /* Lines rejected due to a full queue. */
+	closed   bool          /* No more lines will be queued. */
+	done     chan struct{} /* Closed when the writer's finished. */
+	err      error         /* Why the conn failed, if it did. */
+
+	sent  []queuedLine /* Recently-sent lines, for replay. */
+	tries int          /* Failed connections since the last success. */
+
+	run   string          /* Run marker, to spot restarts. */
+	first string          /* Line 1, to spot restarts without a marker. */
+	prev  <-chan struct{} /* Previous conn's done, after a restart. */
+
+	num      uint64    /* Tells conns for the same ID apart. */
+	ra       string    /* Address of the latest request. */
+	opened   time.Time /* When the conn was made. */
+	lastLine time.Time /* When the last line arrived. */
+	lines    int       /* Lines written to the Sink. */
+	bytes    int       /* Bytes written to the Sink, with newlines. */
+}
+
+// queuedLine is a line waiting to be written to the Sink.
+type queuedLine struct {
+	n        int       /* Line number. */
+	line     string    /* Line, without its number. */
+	received time.Time /* When the line arrived. */
+	ra       string    /* Where the line came from. */
+	replay   bool      /* Sent before a SinkConn failed. */
 }
 
-// ConnManager sends lines to curlrevshell.
+// keepAlive pushes back c's keepalive deadline.  keepAlive requires the caller
+// to hold c's lock.
+func (c *conn) keepAlive() {
+	c.kat.Reset(c.kaWait)
+	c.deadline = time.Now().Add(c.kaWait)
+}
+
+// wasSkipped returns true if line n was skipped.
+func (c *conn) wasSkipped(n int) bool {
+	for _, r := range c.skipped {
+		if r.Start <= n && n <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSeen returns an error wrapping ErrDuplicateLine if line n has already
+// been sent or is being held, or ErrStaleLine if we gave up waiting for it and
+// late is false.  checkSeen requires the caller to hold c's lock.
+func (c *conn) checkSeen(n int, late bool) error {
+	switch {
+	case n < c.next && c.wasSkipped(n) && late:
+		return nil
+	case n < c.next && c.wasSkipped(n):
+		return fmt.Errorf(
+			"cannot send line with number %d: %w",
+			n,
+			ErrStaleLine,
+		)
+	case n < c.next:
+		return fmt.Errorf(
+			"already sent line with number %d: %w",
+			n,
+			ErrDuplicateLine,
+		)
+	}
+	if _, ok := c.pending[n]; ok {
+		return fmt.Errorf(
+			"already holding line with number %d: %w",
+			n,
+			ErrDuplicateLine,
+		)
+	}
+	return nil
+}
+
+// unskip removes n from c's skipped lines.
+func (c *conn) unskip(n int) {
+	for i, r := range c.skipped {
+		if n < r.Start || r.End < n {
+			continue
+		}
+		/* Split the range around n, keeping whatever's not empty. */
+		var rs []LineRange
+		if r.Start < n {
+			rs = append(rs, LineRange{Start: r.Start, End: n - 1})
+		}
+		if n < r.End {
+			rs = append(rs, LineRange{Start: n + 1, End: r.End})
+		}
+		c.skipped = slices.Replace(c.skipped, i, i+1, rs...)
+		return
+	}
+}
+
+// wake wakes up c's writer, if it's not already awake.
+func (c *conn) wake() {
+	nudge(c.notify)
+}
+
+// nudge sends to ch, if ch isn't already full.
+func nudge(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// ConnManager sends lines to a Sink, normally curlrevshell.
+// Lines are sent in order of their line numbers.  Lines which arrive early
+// are held until the lines before them arrive, until either ReorderLimit
+// lines are held or a missing line hasn't arrived for ReorderTimeout, at
+// which point the missing lines are skipped.
+// Lines waiting to be sent are queued up to QueueLines lines or QueueBytes
+// bytes per connection, after which Overflow says what happens.
+// If a connection's SinkConn fails, it is reopened up to ReconnectTries
+// times, and the last ReplayLines lines sent are sent again along with
+// whatever's queued.
 type ConnManager struct {
-	mu sync.Mutex
+	// ReorderLimit is the maximum number of early lines held per
+	// connection.  It should not be changed after the first call to Send.
+	ReorderLimit int
+	// ReorderTimeout is how long to wait for a missing line.  It should
+	// not be changed after the first call to Send.
+	ReorderTimeout time.Duration
+	// QueueLines is the maximum number of lines queued per connection,
+	// or 0 for no limit.  It should not be changed after the first call
+	// to Send.
+	QueueLines int
+	// QueueBytes is the maximum number of bytes queued per connection,
+	// or 0 for no limit.  It should not be changed after the first call
+	// to Send.
+	QueueBytes int
+	// Overflow says what to do when a connection's queue is full.  It
+	// should not be changed after the first call to Send.
+	Overflow OverflowPolicy
+	// ReconnectTries is the number of times to try to reopen a
+	// connection's SinkConn after a failure.  It should not be changed
+	// after the first call to Send.
+	ReconnectTries int
+	// ReconnectWait is how long to wait before the first reconnect.  It
+	// doubles with each try, up to MaxReconnectWait.  It should not be
+	// changed after the first call to Send.
+	ReconnectWait time.Duration
+	// ReplayLines is the number of lines sent before a failure to send
+	// again after reconnecting.  It should not be changed after the first
+	// call to Send.
+	ReplayLines int
+	// Metrics, if not nil, counts lines, connection lifecycle events,
+	// and how long Send takes.  It should not be changed after the first
+	// call to Send.
+	Metrics *Metrics
+
+	mu sync.Mutex /* Only protects conns and shutdown. */
 
-	logf    func(string, ...any) /* Test-settable. */
-	baseURL string
-	client  *http.Client
-	conns   map[string]conn /* id -> HTTP Connection */
+	logf     func(string, ...any) /* Test-settable. */
+	sink     Sink
+	conns    map[string]*conn /* id -> Connection */
+	nConns   uint64           /* Conns made, to number them. */
+	shutdown bool
+	stop     chan struct{} /* Closed on shutdown. */
+
+	emu     sync.RWMutex
+	onEvent []func(Event)
 }
 
-// NewConnManager returns a new ConnManager, ready for use.
-func NewConnManager(baseURL string, client *http.Client) *ConnManager {
+// NewConnManager returns a new ConnManager, ready for use, which sends lines
+// to sink.
+func NewConnManager(sink Sink) *ConnManager {
 	return &ConnManager{
-		logf:    log.Printf,
-		baseURL: strings.TrimRight(baseURL, "/") + "/",
-		client:  client,
-		conns:   make(map[string]conn),
+		ReorderLimit:   DefaultReorderLimit,
+		ReorderTimeout: DefaultReorderTimeout,
+		QueueLines:     DefaultQueueLines,
+		QueueBytes:     DefaultQueueBytes,
+		Overflow:       OverflowBlock,
+		ReconnectTries: DefaultReconnectTries,
+		ReconnectWait:  DefaultReconnectWait,
+		ReplayLines:    DefaultReplayLines,
+		logf:           log.Printf,
+		sink:           sink,
+		conns:          make(map[string]*conn),
+		stop:           make(chan struct{}),
 	}
 }
 
-// Send sends the line and a newline to curlrevshell.
+// Send queues the line, which came from ra, to be sent to the Sink.  Lines
+// which arrive before the lines preceding them are held until the preceding
+// lines arrive.
+// A line numbered 0 is a run marker, which a shell sends once when it starts
+// and which is not sent to the Sink.  A run marker different from the open
+// connection's is taken to mean the shell restarted; the old connection is
+// closed and a new one opened once the old one's finished.  The same run
+// marker again is a duplicate.  A line numbered 1 different from the open
+// connection's first line also means the shell restarted, in case the run
+// marker didn't make it; the same line 1 again is a duplicate.
 // The returned boolean is true if this caused a connection open.
-func (cm *ConnManager) Send(id, line string) (bool, error) {
+func (cm *ConnManager) Send(id, ra, line string) (bool, error) {
+	return cm.send(id, ra, line, false)
+}
+
+// Resend is like Send, but also sends lines which Send would have rejected
+// with ErrStaleLine, after the lines which followed them.  Resend never opens
+// a new connection.
+func (cm *ConnManager) Resend(id, ra, line string) error {
+	_, err := cm.send(id, ra, line, true)
+	return err
+}
+
+// send does what Send and Resend say they do.  If late is true, lines which
+// were skipped are sent.
+func (cm *ConnManager) send(id, ra, line string, late bool) (bool, error) {
+	defer func(start time.Time) {
+		cm.Metrics.Send(time.Since(start))
+	}(time.Now())
+
 	/* Make sure our line is formatted correctly, and grab the number for
 	if we need to make a new connection. */
 	ms := lineRE.FindStringSubmatch(line)
@@ -75,141 +371,821 @@ func (cm *ConnManager) Send(id, line string) (bool, error) {
 	if nil != err {
 		return false, fmt.Errorf("parsing line number %s: %w", ms[1], err)
 	}
-	line = ms[2]
+	ql := queuedLine{n: lineN, line: ms[2], ra: ra}
+	if 0 == lineN {
+		return cm.startRun(id, ra, ql.line, late)
+	}
 
-	/* Get the connection for this path.  We could probably make a
-	per-connection lock, but for something which won't likely be hugely
-	parallel, premature optimization. */
+	/* Get the connection for this path.  We'll make a new one if we don't
+	have one and this is the first line in the series. */
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	if cm.shutdown {
+		cm.mu.Unlock()
+		return false, ErrShutdown
+	}
 	c, ok := cm.conns[id]
-	if !ok {
-		/* Don't have a connection.  We'll make a new one if this is
-		the first line in the series. */
-		if 1 != lineN {
-			return false, fmt.Errorf(
-				"cannot send line with number %d: %w",
-				lineN,
-				ErrNoConnection,
-			)
-		}
-		/* Try to make a new connection. */
-		c = cm.newConnection(id)
+	if !ok && 1 == lineN && !late {
+		c = cm.newConnection(id, ra, "", nil)
 		cm.conns[id] = c
 	}
+	cm.mu.Unlock()
+	if nil == c {
+		return false, fmt.Errorf(
+			"cannot send line with number %d: %w",
+			lineN,
+			ErrNoConnection,
+		)
+	}
 
-	/* Write the line to the connection, or at least try. */
-	if _, err := io.WriteString(c.pw, line+"\n"); nil != err {
-		if cerr := cm.closeConn(id); nil != cerr {
-			cm.logf("Error closing conn for %s: %s", id, cerr)
-		}
-		return false, fmt.Errorf("sending line: %w", err)
+	/* A different first line also means the shell's started over, in
+	case we missed its run marker. */
+	c.mu.Lock()
+	if ok && 1 == lineN && !late && 1 < c.next && !c.wasSkipped(1) &&
+		ql.line != c.first {
+		c.mu.Unlock()
+		cm.logf("Session for %s restarted", id)
+		c, ok = cm.restart(id, ra, "", c), false
+		c.mu.Lock()
+	}
+
+	/* Everything else only needs this conn. */
+	defer c.mu.Unlock()
+	if c.closed {
+		return false, fmt.Errorf(
+			"cannot send line with number %d: %w",
+			lineN,
+			ErrNoConnection,
+		)
 	}
 
 	/* Got a line, so likely alive. */
-	if err := cm.keepAlive(id); nil != err {
-		cm.logf("Error resetting keepalive timer for %s: %s", id, err)
+	c.keepAlive()
+	c.ra = ra
+	c.lastLine = time.Now()
+	ql.received = c.lastLine
+
+	/* If we've already seen this line, don't send it again, nor wait for
+	room for it. */
+	if err := c.checkSeen(lineN, late); nil != err {
+		return false, err
+	}
+
+	/* Make sure we've room for the line.  If we had to wait, it may have
+	turned up in another request in the meantime. */
+	if err := cm.waitForRoom(id, c, len(ql.line)+1); nil != err {
+		return false, fmt.Errorf(
+			"cannot send line with number %d: %w",
+			lineN,
+			err,
+		)
+	}
+	if err := c.checkSeen(lineN, late); nil != err {
+		return false, err
 	}
+	if 1 == lineN {
+		c.first = ql.line
+	}
+
+	/* Late lines fill in what we skipped.  If the line's early, hold on to
+	it until the gap is filled, or we give up on the gap. */
+	switch {
+	case lineN < c.next:
+		cm.enqueue(c, ql)
+		c.unskip(lineN)
+		return false, nil
+	case lineN > c.next:
+		c.pending[lineN] = ql
+		if len(c.pending) > cm.ReorderLimit {
+			cm.logf(
+				"Holding more than %d lines for %s",
+				cm.ReorderLimit,
+				id,
+			)
+			cm.skipGap(id, c)
+		} else if nil == c.gapt {
+			cm.startGapTimer(id, c)
+		}
+		return !ok, nil
+	}
+
+	/* Queue the line and whatever it was holding up. */
+	cm.enqueue(c, ql)
+	c.next++
+	cm.flushPending(id, c)
 
 	return !ok, nil
 }
 
-// CloseConn closes the conn for the given URL path, if one exists.
-func (cm *ConnManager) CloseConn(id string) error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	return cm.closeConn(id)
-}
+// startRun handles a run marker for id, as described in Send.
+func (cm *ConnManager) startRun(
+	id string,
+	ra string,
+	run string,
+	late bool,
+) (bool, error) {
+	if late {
+		return false, errors.New("cannot resend run marker")
+	} else if "" == run {
+		return false, errors.New("empty run marker")
+	}
 
-// closeConn does what CloseConn says it does, but requires the caller to hold
-// cm's lock.
-func (cm *ConnManager) closeConn(id string) error {
+	/* If we've no connection, this is a new shell. */
+	cm.mu.Lock()
+	if cm.shutdown {
+		cm.mu.Unlock()
+		return false, ErrShutdown
+	}
 	c, ok := cm.conns[id]
 	if !ok {
-		return ErrNotOpen
+		cm.conns[id] = cm.newConnection(id, ra, run, nil)
+		cm.mu.Unlock()
+		return true, nil
 	}
-	delete(cm.conns, id)
-	return c.pw.Close()
-}
-
-// newConnection opens a new connection to the server.
-func (cm *ConnManager) newConnection(id string) conn {
-	/* Connect to the server. */
-	pr, pw := io.Pipe()
-
-	/* Proxy lines from the pipe. */
-	go func() {
-		var err error
-		defer func() {
-			pr.CloseWithError(err)
-			pw.CloseWithError(err)
-		}()
-		res, err := cm.client.Post(cm.baseURL+id, "", pr)
-		if nil != err {
-			err = fmt.Errorf("sending POST request: %w", err)
-			return
+	cm.mu.Unlock()
+
+	/* If we've seen this run before, it's likely a retry. */
+	c.mu.Lock()
+	if !c.closed && c.run == run {
+		defer c.mu.Unlock()
+		c.keepAlive()
+		c.ra = ra
+		return false, fmt.Errorf(
+			"already started run %q: %w",
+			run,
+			ErrDuplicateLine,
+		)
+	}
+	c.mu.Unlock()
+
+	/* A different run means the shell's started over, likely with the
+	same ID. */
+	cm.logf("Session for %s restarted", id)
+	cm.restart(id, ra, run, c)
+	return true, nil
+}
+
+// waitForRoom makes sure there's room in c's queue for n more bytes, as
+// dictated by cm.Overflow.  waitForRoom requires the caller to hold c's lock,
+// which may be released and reacquired while waiting.
+func (cm *ConnManager) waitForRoom(id string, c *conn, n int) error {
+	/* If we're making room by dropping lines, we'll always have room. */
+	if OverflowDropOldest == cm.Overflow {
+		return nil
+	}
+
+	for cm.queueFull(c, n) {
+		if OverflowReject == cm.Overflow {
+			if 0 == c.rejected {
+				cm.logf("Rejecting lines for %s: queue full", id)
+			}
+			c.rejected++
+			return ErrQueueFull
+		}
+		/* Wait for the writer to make some room. */
+		c.mu.Unlock()
+		select {
+		case <-c.space:
+		case <-c.done:
 		}
-		defer res.Body.Close()
+		c.mu.Lock()
+		if c.closed {
+			return ErrNoConnection
+		}
+	}
 
-		/* Make sure we got the go-ahead. */
-		if http.StatusOK != res.StatusCode {
-			err = fmt.Errorf(
-				"got non-OK response status %s",
-				res.Status,
-			)
-			return
+	/* If there's more room, let the next waiter know. */
+	if !cm.queueFull(c, 0) {
+		nudge(c.space)
+	}
+
+	return nil
+}
+
+// queueFull returns true if c's queue doesn't have room for another n bytes.
+// A line always fits in an empty queue.  queueFull requires the caller to
+// hold c's lock.
+func (cm *ConnManager) queueFull(c *conn, n int) bool {
+	if 0 == len(c.queue) {
+		return false
+	}
+	return (0 < cm.QueueLines && len(c.queue) >= cm.QueueLines) ||
+		(0 < cm.QueueBytes && c.qBytes+n > cm.QueueBytes)
+}
+
+// enqueue queues the line for the writer.  If cm.Overflow is
+// OverflowDropOldest and the queue is too full, the oldest lines are dropped.
+// enqueue requires the caller to hold c's lock.
+func (cm *ConnManager) enqueue(c *conn, ql queuedLine) {
+	c.queue = append(c.queue, ql)
+	c.qBytes += len(ql.line) + 1
+	if OverflowDropOldest == cm.Overflow {
+		for 1 < len(c.queue) && cm.queueFull(c, 0) {
+			c.qBytes -= len(c.queue[0].line) + 1
+			c.queue[0] = queuedLine{}
+			c.queue = c.queue[1:]
+			c.dropped++
+		}
+	}
+	c.wake()
+}
+
+// flushPending queues held lines, for as long as there's no gap in the line
+// numbers.  If lines are still held afterwards, the gap timer is restarted for
+// the next gap.  flushPending requires the caller to hold c's lock.
+func (cm *ConnManager) flushPending(id string, c *conn) {
+	/* Send everything we can. */
+	for {
+		ql, ok := c.pending[c.next]
+		if !ok {
+			break
 		}
-		io.Copy(io.Discard, res.Body)
-		/* Connection is done, close it. */
-		if err := cm.CloseConn(id); errors.Is(err, ErrNotOpen) {
+		delete(c.pending, c.next)
+		cm.enqueue(c, ql)
+		c.next++
+	}
+
+	/* Work out if we're still waiting on something. */
+	if nil != c.gapt {
+		c.gapt.Stop()
+		c.gapt = nil
+	}
+	if 0 != len(c.pending) {
+		cm.startGapTimer(id, c)
+	}
+}
+
+// skipGap gives up on the lines before the lowest-numbered held line and
+// queues whatever held lines it can.  skipGap requires the caller to hold c's
+// lock.
+func (cm *ConnManager) skipGap(id string, c *conn) {
+	/* Work out where the gap ends. */
+	if 0 == len(c.pending) {
+		return
+	}
+	end := -1
+	for n := range c.pending {
+		if -1 == end || n < end {
+			end = n
+		}
+	}
+
+	/* Skip ahead and send what we can. */
+	if 1 == end-c.next {
+		cm.logf("Skipped missing line %d for %s", c.next, id)
+	} else {
+		cm.logf(
+			"Skipped missing lines %d-%d for %s",
+			c.next,
+			end-1,
+			id,
+		)
+	}
+	c.skipped = append(c.skipped, LineRange{Start: c.next, End: end - 1})
+	c.next = end
+	cm.flushPending(id, c)
+}
+
+// startGapTimer starts c's gap timer, which skips the gap if it's not filled
+// in time.  startGapTimer requires the caller to hold c's lock.
+func (cm *ConnManager) startGapTimer(id string, c *conn) {
+	var t *time.Timer
+	t = time.AfterFunc(cm.ReorderTimeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		/* Make sure we're still the timer for the gap for the
+		connection. */
+		if c.gapt != t || c.closed {
 			return
-		} else if nil != err {
-			cm.logf(
-				"Error closing ended connection for %s: %s",
+		}
+		c.gapt = nil
+		cm.logf("Timed out waiting for line %d for %s", c.next, id)
+		cm.skipGap(id, c)
+	})
+	c.gapt = t
+}
+
+// Status returns which lines have and haven't been sent for id.
+func (cm *ConnManager) Status(id string) (Status, error) {
+	c, ok := cm.getConn(id)
+	if !ok {
+		return Status{}, ErrNotOpen
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	/* Missing lines are the ones we gave up on plus the ones we're
+	waiting for. */
+	st := Status{Highest: c.next - 1}
+	ms := slices.Clone(c.skipped)
+	if 0 != len(c.pending) {
+		ns := slices.Sorted(maps.Keys(c.pending))
+		prev := c.next - 1
+		for _, n := range ns {
+			if prev+1 != n {
+				ms = append(ms, LineRange{Start: prev + 1, End: n - 1})
+			}
+			prev = n
+		}
+		st.Highest = prev
+	}
+	st.Contiguous = st.Highest
+	if 0 != len(ms) {
+		st.Contiguous = ms[0].Start - 1
+		st.Missing = ms
+	}
+
+	return st, nil
+}
+
+// Sessions returns information about every open connection, sorted by ID.
+func (cm *ConnManager) Sessions() []SessionInfo {
+	cm.mu.Lock()
+	conns := maps.Clone(cm.conns)
+	cm.mu.Unlock()
+
+	sis := make([]SessionInfo, 0, len(conns))
+	for _, id := range slices.Sorted(maps.Keys(conns)) {
+		sis = append(sis, conns[id].info(id))
+	}
+	return sis
+}
+
+// Session returns information about id's connection.
+func (cm *ConnManager) Session(id string) (SessionInfo, error) {
+	c, ok := cm.getConn(id)
+	if !ok {
+		return SessionInfo{}, ErrNotOpen
+	}
+	return c.info(id), nil
+}
+
+// info returns a SessionInfo describing c.
+func (c *conn) info(id string) SessionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return SessionInfo{
+		ID:                id,
+		RemoteAddr:        c.ra,
+		Opened:            c.opened,
+		LastLine:          c.lastLine,
+		Lines:             c.lines,
+		Bytes:             c.bytes,
+		KeepAliveDeadline: c.deadline,
+		KeepAliveTimeout:  c.kaWait,
+	}
+}
+
+// ForceClose closes id's connection without waiting for the shell to ask.
+// Queued lines are still sent, but ForceClose doesn't wait for them.  The
+// returned SessionInfo describes the connection as it was closed.
+func (cm *ConnManager) ForceClose(id string) (SessionInfo, error) {
+	c, ok := cm.getConn(id)
+	if !ok || !cm.endConn(id, c) {
+		return SessionInfo{}, ErrNotOpen
+	}
+	cm.logf("Force-closed connection for %s", id)
+	return c.info(id), nil
+}
+
+// SetKeepAliveTimeout changes how long id's connection may go without a
+// keepalive before it's closed, and restarts its keepalive timer.  The
+// returned SessionInfo describes the updated connection.
+func (cm *ConnManager) SetKeepAliveTimeout(
+	id string,
+	d time.Duration,
+) (SessionInfo, error) {
+	if 0 >= d {
+		return SessionInfo{}, fmt.Errorf("non-positive timeout %s", d)
+	}
+	c, ok := cm.getConn(id)
+	if !ok {
+		return SessionInfo{}, ErrNotOpen
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return SessionInfo{}, ErrNotOpen
+	}
+	c.kaWait = d
+	c.keepAlive()
+	c.mu.Unlock()
+	cm.logf("Keepalive timeout for %s set to %s", id, d)
+	return c.info(id), nil
+}
+
+// CloseConn closes the conn for the given URL path, if one exists, at the
+// request of ra.  It waits for queued lines to be sent and for the Sink to
+// finish with the connection.
+func (cm *ConnManager) CloseConn(id, ra string) error {
+	c, ok := cm.getConn(id)
+	if !ok {
+		return ErrNotOpen
+	}
+	c.mu.Lock()
+	if !c.closed {
+		c.ra = ra
+	}
+	c.mu.Unlock()
+	if !cm.endConn(id, c) {
+		return ErrNotOpen
+	}
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Shutdown closes every connection and waits for their queued lines to be
+// sent and for the Sink to finish with them, or for ctx to be done, whichever
+// is first.  Send and Resend return ErrShutdown once Shutdown has been
+// called.  The returned error describes any connections which failed, or
+// which hadn't finished when ctx was done.
+func (cm *ConnManager) Shutdown(ctx context.Context) error {
+	/* Stop new lines and grab everything still open. */
+	cm.mu.Lock()
+	if !cm.shutdown {
+		cm.shutdown = true
+		close(cm.stop) /* Don't wait to reconnect. */
+	}
+	conns := maps.Clone(cm.conns)
+	cm.mu.Unlock()
+
+	/* Tell every conn to finish up. */
+	for id, c := range conns {
+		cm.endConn(id, c)
+	}
+
+	/* Wait for them to do so. */
+	var errs []error
+	for id, c := range conns {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf(
+				"waiting for %s: %w",
 				id,
-				err,
-			)
-			return
+				context.Cause(ctx),
+			))
+			continue
 		}
-		cm.logf("Connection for %s ended", id)
-	}()
+		c.mu.Lock()
+		if nil != c.err {
+			errs = append(errs, fmt.Errorf("%s: %w", id, c.err))
+		}
+		c.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// restart replaces old with a new conn for id and run, which starts sending
+// once old is finished, and ends old.  If old has already been replaced, its
+// replacement is returned.
+func (cm *ConnManager) restart(id, ra, run string, old *conn) *conn {
+	cm.mu.Lock()
+	c, ok := cm.conns[id]
+	if !ok || c == old {
+		c = cm.newConnection(id, ra, run, old.done)
+		cm.conns[id] = c
+	}
+	cm.mu.Unlock()
+	cm.endConn(id, old)
+	return c
+}
+
+// getConn gets the conn for the id, if we have one.
+func (cm *ConnManager) getConn(id string) (*conn, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	c, ok := cm.conns[id]
+	return c, ok
+}
+
+// endConn removes c from cm, if it's still there, sends whatever lines c is
+// holding, and tells c's writer to finish up.  It doesn't wait for the writer.
+// The returned boolean is false if c was already ended.
+func (cm *ConnManager) endConn(id string, c *conn) bool {
+	/* Don't let anybody else find this one. */
+	cm.mu.Lock()
+	if cm.conns[id] == c {
+		delete(cm.conns, id)
+	}
+	cm.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+
+	/* Don't lose anything we're still holding. */
+	for 0 != len(c.pending) {
+		cm.skipGap(id, c)
+	}
+	if nil != c.gapt {
+		c.gapt.Stop()
+		c.gapt = nil
+	}
+	c.kat.Stop()
+
+	/* Note if we've lost anything to a full queue. */
+	if 0 != c.dropped {
+		cm.logf(
+			"Dropped %d lines for %s: queue full",
+			c.dropped,
+			id,
+		)
+	}
+	if 0 != c.rejected {
+		cm.logf(
+			"Rejected %d lines for %s: queue full",
+			c.rejected,
+			id,
+		)
+	}
+
+	/* Let the writer finish. */
+	c.closed = true
+	c.wake()
+
+	return true
+}
+
+// newConnection opens a new connection to the server for a request from ra,
+// for the shell run run, and starts a writer for it.  If prev isn't nil, the
+// writer waits for it to be closed before sending anything.  The caller must
+// hold cm.mu.
+func (cm *ConnManager) newConnection(
+	id string,
+	ra string,
+	run string,
+	prev <-chan struct{},
+) *conn {
+	cm.nConns++
+	c := &conn{
+		num:     cm.nConns,
+		run:     run,
+		next:    1,
+		pending: make(map[int]queuedLine),
+		notify:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		prev:    prev,
+		ra:      ra,
+		opened:  time.Now(),
+		kaWait:  MaxKeepAliveWait,
+	}
+
+	/* Start sending lines to the server. */
+	go cm.writeLines(id, c)
 
 	/* Shut down the connection if nothing's kept it alive. */
-	t := time.AfterFunc(MaxKeepAliveWait, func() {
-		err := cm.CloseConn(id)
-		if errors.Is(err, ErrNotOpen) {
-			/* Normal. */
-			return
-		} else if nil != err {
-			cm.logf(
-				"Error closing connection for %s after "+
-					"timeout: %s",
-				id,
-				err,
-			)
+	c.deadline = c.opened.Add(c.kaWait)
+	c.kat = time.AfterFunc(c.kaWait, func() {
+		/* Note the timeout before the writer can note the close. */
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
 			return
 		}
-		cm.logf("Closed connection for %s after timeout", id)
+		cm.event(EventTimedOut, id, c, queuedLine{}, nil)
+		if cm.endConn(id, c) {
+			cm.logf("Closed connection for %s after timeout", id)
+		}
 	})
 
 	/* All looks good. */
-	return conn{pw: pw, kat: t}
+	return c
 }
 
-// KeepAlive resets id's keepalive timer, if it exists.
-func (cm *ConnManager) KeepAlive(id string) error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	return cm.keepAlive(id)
+// writeLines sends lines queued on c to the Sink until c is closed,
+// reconnecting as needed.  c.done is closed when writeLines returns.
+func (cm *ConnManager) writeLines(id string, c *conn) {
+	cm.event(EventOpened, id, c, queuedLine{}, nil)
+	var ferr error /* Why we finished, if we failed. */
+	defer func() {
+		cm.event(EventClosed, id, c, queuedLine{}, ferr)
+		close(c.done)
+	}()
+
+	/* If we're replacing a conn, let it finish first. */
+	if nil != c.prev {
+		<-c.prev
+	}
+
+	/* If we're shutting down, we'll only try to reconnect once more. */
+	var stopping bool
+	for {
+		/* Send lines until something goes wrong. */
+		err := cm.connectAndWrite(id, c)
+		if nil == err {
+			/* Either we closed it or the sink did. */
+			if cm.endConn(id, c) {
+				cm.logf("Connection for %s ended", id)
+			}
+			return
+		}
+		cm.event(EventUpstreamError, id, c, queuedLine{}, err)
+
+		/* See if we should try again.  If we've nothing more to send,
+		no point. */
+		c.mu.Lock()
+		var (
+			giveUp = c.tries >= cm.ReconnectTries ||
+				(c.closed && 0 == len(c.queue)) ||
+				stopping
+			wait = cm.reconnectWait(c.tries)
+		)
+		c.tries++
+		if giveUp {
+			c.err = err
+			ferr = err
+			c.mu.Unlock()
+			if cm.endConn(id, c) {
+				cm.logf("Connection for %s failed: %s", id, err)
+			}
+			return
+		}
+
+		/* Send again what might not have made it. */
+		for i := range c.sent {
+			c.sent[i].replay = true
+			c.qBytes += len(c.sent[i].line) + 1
+		}
+		c.queue = append(c.sent, c.queue...)
+		c.sent = nil
+		if 0 != len(c.queue) {
+			c.wake()
+		}
+		cm.logf(
+			"Connection for %s failed, reconnecting in %s: %s",
+			id,
+			wait,
+			err,
+		)
+		c.mu.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-cm.stop:
+			t.Stop()
+			stopping = true
+		}
+	}
 }
 
-// keepAlive does what keepAlive says it does, but requires the caller to hold
-// cm's lock.
-func (cm *ConnManager) keepAlive(id string) error {
-	c, ok := cm.conns[id]
+// reconnectWait returns how long to wait to reconnect after tries failed
+// tries, which is cm.ReconnectWait doubled tries times, up to
+// MaxReconnectWait.
+func (cm *ConnManager) reconnectWait(tries int) time.Duration {
+	wait := cm.ReconnectWait
+	for range tries {
+		if 0 >= wait || MaxReconnectWait <= wait {
+			break
+		}
+		wait *= 2
+	}
+	return min(wait, MaxReconnectWait)
+}
+
+// connectAndWrite opens a SinkConn for id and sends it lines queued on c
+// until c is closed or the SinkConn fails.  It returns the reason the
+// SinkConn failed, or nil if it was closed normally.
+func (cm *ConnManager) connectAndWrite(id string, c *conn) error {
+	/* Connect to the sink. */
+	sc, err := cm.sink.Open(id)
+	if nil != err {
+		return fmt.Errorf("opening sink: %w", err)
+	}
+	ready := sc.Ready()
+
+	for {
+		select {
+		case <-c.notify:
+		case <-ready:
+			/* We're connected, so any future failure is a new
+			one. */
+			c.mu.Lock()
+			c.tries = 0
+			c.mu.Unlock()
+			ready = nil
+			continue
+		case <-sc.Done():
+			return sc.Close()
+		}
+		for {
+			/* Grab the next queued line.  We do it one at a
+			time, so lines we're stuck sending still count
+			against the queue limits. */
+			c.mu.Lock()
+			if 0 == len(c.queue) {
+				closed := c.closed
+				c.mu.Unlock()
+				/* If we're all done, tell the sink. */
+				if closed {
+					return sc.Close()
+				}
+				break
+			}
+			ql := c.queue[0]
+			c.queue[0] = queuedLine{}
+			c.queue = c.queue[1:]
+			c.qBytes -= len(ql.line) + 1
+			nudge(c.space)
+			c.mu.Unlock()
+
+			/* Send it off.  If this fails, Close will tell us
+			why, and we'll keep the line for next time. */
+			if err := sc.WriteLine(ql.line); nil != err {
+				c.mu.Lock()
+				c.queue = slices.Insert(c.queue, 0, ql)
+				c.qBytes += len(ql.line) + 1
+				c.mu.Unlock()
+				return sc.Close()
+			}
+
+			/* Remember it for if we need to replay it. */
+			c.mu.Lock()
+			c.sent = append(c.sent, ql)
+			if n := len(c.sent) - cm.ReplayLines; 0 < n {
+				c.sent = slices.Delete(c.sent, 0, n)
+			}
+			c.lines++
+			c.bytes += len(ql.line) + 1
+			c.mu.Unlock()
+			cm.event(EventLineDelivered, id, c, ql, nil)
+		}
+	}
+}
+
+// KeepAlive resets id's keepalive timer at the request of ra, if the
+// connection exists.
+func (cm *ConnManager) KeepAlive(id, ra string) error {
+	c, ok := cm.getConn(id)
 	if !ok {
 		return ErrNotOpen
 	}
-	c.kat.Reset(MaxKeepAliveWait)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrNotOpen
+	}
+	c.keepAlive()
+	c.ra = ra
+	c.mu.Unlock()
+	cm.event(EventKeepAlive, id, c, queuedLine{}, nil)
 	return nil
 }
+
+// OnEvent registers f to be called with every Event.  f is called
+// synchronously by whichever goroutine caused the event, so it should return
+// quickly.  Functions are called in the order in which they were registered.
+func (cm *ConnManager) OnEvent(f func(Event)) {
+	cm.emu.Lock()
+	defer cm.emu.Unlock()
+	cm.onEvent = append(cm.onEvent, f)
+}
+
+// event sends an Event about c to the functions registered with OnEvent.  ql
+// is the line delivered, for EventLineDelivered.  The caller must not hold c's
+// lock.
+func (cm *ConnManager) event(
+	t EventType,
+	id string,
+	c *conn,
+	ql queuedLine,
+	err error,
+) {
+	cm.emu.RLock()
+	fs := cm.onEvent
+	cm.emu.RUnlock()
+	if 0 == len(fs) && nil == cm.Metrics {
+		return
+	}
+
+	c.mu.Lock()
+	ra := c.ra
+	if "" != ql.ra {
+		ra = ql.ra
+	}
+	ev := Event{
+		Type:       t,
+		ID:         id,
+		Conn:       c.num,
+		RemoteAddr: ra,
+		Time:       time.Now(),
+		Opened:     c.opened,
+		Line:       ql.line,
+		Seq:        ql.n,
+		Received:   ql.received,
+		Replayed:   ql.replay,
+		Err:        err,
+	}
+	c.mu.Unlock()
+
+	cm.Metrics.Event(ev)
+	for _, f := range fs {
+		f(ev)
+	}
+}
@@ -5,17 +5,20 @@ package main
  * Manage persistent connections to the target
  * By J. Stuart McMurray
  * Created 20260117
- * Last Modified 20260206
+ * Last Modified 20261018
  */
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -69,7 +72,10 @@ func TestConnManager(t *testing.T) {
 
 	/* Can we send output? */
 	var (
-		cm           = NewConnManager(svr.URL+"/o", svr.Client())
+		cm = NewConnManager(NewHTTPSink(
+			svr.URL+"/o",
+			svr.Client(),
+		))
 		nCannedHaves = 10
 		extraHaves   = []string{
 			"        Significant whitespace",
@@ -102,7 +108,7 @@ func TestConnManager(t *testing.T) {
 
 	/* Work out what we'll want. */
 	for i, have := range haves {
-		opened, err := cm.Send(id, have)
+		opened, err := cm.Send(id, testRA, have)
 		if nil != err {
 			t.Errorf(
 				"Error sending line %d/%d: %s",
@@ -118,12 +124,12 @@ func TestConnManager(t *testing.T) {
 	}
 
 	/* Can we close the connection? */
-	if err := cm.CloseConn(id); nil != err {
+	if err := cm.CloseConn(id, testRA); nil != err {
 		t.Errorf("Error closing connection: %s", err)
 	}
 
 	/* Do we get an error if we close it again? */
-	if err := cm.CloseConn(id); nil == err {
+	if err := cm.CloseConn(id, testRA); nil == err {
 		t.Errorf("No error closing a closed connection")
 	} else if !errors.Is(err, ErrNotOpen) {
 		t.Errorf(
@@ -179,7 +185,7 @@ func synctestConnManagerKeepAlive(t *testing.T) {
 			io.Copy(&buf, r.Body)
 			close(hdone)
 		}))
-		cm    = NewConnManager(svr.URL, svr.Client())
+		cm    = NewConnManager(NewHTTPSink(svr.URL, svr.Client()))
 		lines = []string{
 			ts("open"),
 			ts("still open"),
@@ -190,29 +196,29 @@ func synctestConnManagerKeepAlive(t *testing.T) {
 	defer svr.Close()
 
 	/* Start a connection. */
-	if opened, err := cm.Send(id, "1 "+lines[0]); nil != err {
+	if opened, err := cm.Send(id, testRA, "1 "+lines[0]); nil != err {
 		t.Fatalf("Error sending open line: %s", err)
 	} else if !opened {
 		t.Errorf("Initial line did not open a connection")
 	}
-	defer cm.CloseConn(id)
+	defer cm.CloseConn(id, testRA)
 
 	/* Wait a bit, should still be open. */
 	time.Sleep(MaxKeepAliveWait - time.Nanosecond)
 	synctest.Wait()
-	if opened, err := cm.Send(id, "2 "+lines[1]); nil != err {
+	if opened, err := cm.Send(id, testRA, "2 "+lines[1]); nil != err {
 		t.Fatalf("Error sending still open line: %s", err)
 	} else if opened {
 		t.Errorf("Still open line opened a connection")
 	}
 
 	/* Send a keepalive, should keep it open. */
-	if err := cm.KeepAlive(id); nil != err {
+	if err := cm.KeepAlive(id, testRA); nil != err {
 		t.Fatalf("Error sending keepalive: %s", err)
 	}
 	time.Sleep(MaxKeepAliveWait - time.Nanosecond)
 	synctest.Wait()
-	if opened, err := cm.Send(id, "3 "+lines[2]); nil != err {
+	if opened, err := cm.Send(id, testRA, "3 "+lines[2]); nil != err {
 		t.Fatalf("Error sending after keepalive line: %s", err)
 	} else if opened {
 		t.Errorf("Keepalive line opened a connection")
@@ -221,7 +227,11 @@ func synctestConnManagerKeepAlive(t *testing.T) {
 	/* Let time out. */
 	time.Sleep(2*time.Nanosecond + MaxKeepAliveWait)
 	synctest.Wait()
-	if opened, err := cm.Send(id, "4 should fail"); nil == err && opened {
+	if opened, err := cm.Send(
+		id,
+		testRA,
+		"4 should fail",
+	); nil == err && opened {
 		t.Errorf("Line number 4 started a new connection")
 	} else if nil == err && !opened {
 		t.Errorf("Connection did not time out")
@@ -275,7 +285,7 @@ func synctestConnManagerSendKeepAlive(t *testing.T) {
 		) {
 			io.Copy(io.Discard, r.Body)
 		}))
-		cm     = NewConnManager(svr.URL, svr.Client())
+		cm     = NewConnManager(NewHTTPSink(svr.URL, svr.Client()))
 		id     = ts("id")
 		lineN  int
 		start  = time.Now()
@@ -287,7 +297,11 @@ func synctestConnManagerSendKeepAlive(t *testing.T) {
 	/* sendLine sends the next numbered line. */
 	sendLine := func() (bool, error) {
 		lineN++
-		return cm.Send(id, fmt.Sprintf("%d %s", lineN, ts("line")))
+		return cm.Send(
+			id,
+			testRA,
+			fmt.Sprintf("%d %s", lineN, ts("line")),
+		)
 	}
 
 	/* First line should make a connection. */
@@ -296,7 +310,7 @@ func synctestConnManagerSendKeepAlive(t *testing.T) {
 	} else if !opened {
 		t.Errorf("Initial line did not open a connection")
 	}
-	defer cm.CloseConn(id)
+	defer cm.CloseConn(id, testRA)
 
 	/* Send lines until the keepalive should expire. */
 	for time.Now().Before(start.Add(MaxKeepAliveWait)) {
@@ -321,6 +335,1475 @@ func synctestConnManagerSendKeepAlive(t *testing.T) {
 	lb.TestEmpty(t)
 }
 
+// Are out-of-order lines put back in order?
+func TestConnManagerSend_Reorder(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			id             = ts("id")
+			lines          = []string{
+				ts("line1"),
+				ts("line2"),
+				ts("line3"),
+				ts("line4"),
+				ts("line5"),
+			}
+		)
+		for _, n := range []int{1, 3, 5, 2, 4} {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d %s", n, lines[n-1]),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n, err)
+			}
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(), strings.Join(
+			lines,
+			"\n",
+		)+"\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Do we skip missing lines if we've got too many lines held?
+func TestConnManagerSend_ReorderLimit(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			id             = ts("id")
+		)
+		cm.ReorderLimit = 2
+		for _, n := range []int{1, 4, 5, 6, 7} {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n, n),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n, err)
+			}
+		}
+		/* Lines which were skipped shouldn't be sent. */
+		if _, err := cm.Send(id, testRA, "2 line2"); !errors.Is(
+			err,
+			ErrStaleLine,
+		) {
+			t.Errorf(
+				"Incorrect error sending skipped line: %s",
+				err,
+			)
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(),
+			"line1\nline4\nline5\nline6\nline7\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestStartsWith(
+			t,
+			"Holding more than 2 lines for "+id,
+			"Skipped missing lines 2-3 for "+id,
+		)
+		lb.TestEmpty(t)
+	})
+}
+
+// Do we skip missing lines if they take too long?
+func TestConnManagerSend_ReorderTimeout(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			id             = ts("id")
+		)
+		for _, n := range []int{1, 3, 4} {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n, n),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n, err)
+			}
+		}
+
+		/* checkStatus makes sure we're missing line 2.  It also makes
+		sure the gap timer and logging happen-before or -after the
+		call. */
+		checkStatus := func() {
+			t.Helper()
+			st, err := cm.Status(id)
+			if nil != err {
+				t.Fatalf("Error getting status: %s", err)
+			}
+			if want := (Status{
+				Contiguous: 1,
+				Highest:    4,
+				Missing:    []LineRange{{Start: 2, End: 2}},
+			}); !reflect.DeepEqual(st, want) {
+				t.Errorf(
+					"Incorrect status\n"+
+						" got: %+v\n"+
+						"want: %+v",
+					st,
+					want,
+				)
+			}
+		}
+
+		/* Shouldn't give up just yet. */
+		time.Sleep(cm.ReorderTimeout - time.Nanosecond)
+		synctest.Wait()
+		checkStatus()
+		lb.TestEmpty(t)
+		checkStatus()
+
+		/* Should give up now. */
+		time.Sleep(time.Nanosecond)
+		synctest.Wait()
+		checkStatus()
+		lb.TestStartsWith(
+			t,
+			"Timed out waiting for line 2 for "+id,
+			"Skipped missing line 2 for "+id,
+		)
+		lb.TestEmpty(t)
+
+		/* Later lines should go through as normal. */
+		if _, err := cm.Send(id, testRA, "5 line5"); nil != err {
+			t.Fatalf("Error sending line 5: %s", err)
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(),
+			"line1\nline3\nline4\nline5\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Are held lines sent when the connection's closed?
+func TestConnManagerCloseConn_Held(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			id             = ts("id")
+		)
+		for _, n := range []int{1, 3, 6} {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n, n),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n, err)
+			}
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(), "line1\nline3\nline6\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestStartsWith(
+			t,
+			"Skipped missing line 2 for "+id,
+			"Skipped missing lines 4-5 for "+id,
+		)
+		lb.TestEmpty(t)
+	})
+}
+
+// Are duplicate lines ignored?
+func TestConnManagerSend_Duplicate(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			id             = ts("id")
+		)
+		for _, l := range []struct {
+			n   int
+			dup bool
+		}{
+			{n: 1},
+			{n: 1, dup: true}, /* Already sent. */
+			{n: 3},
+			{n: 3, dup: true}, /* Already held. */
+			{n: 2},
+			{n: 2, dup: true},
+			{n: 3, dup: true},
+			{n: 4},
+		} {
+			_, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", l.n, l.n),
+			)
+			if l.dup && !errors.Is(err, ErrDuplicateLine) {
+				t.Errorf(
+					"Incorrect error sending duplicate "+
+						"line %d: %v",
+					l.n,
+					err,
+				)
+			} else if !l.dup && nil != err {
+				t.Fatalf("Error sending line %d: %s", l.n, err)
+			}
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(),
+			"line1\nline2\nline3\nline4\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Does Status report missing lines, and can we resend them?
+func TestConnManagerStatus(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			id             = ts("id")
+		)
+		cm.ReorderLimit = 2
+
+		/* Unknown IDs have no status. */
+		if _, err := cm.Status(id); !errors.Is(err, ErrNotOpen) {
+			t.Errorf("Incorrect error for unknown ID: %v", err)
+		}
+
+		/* Skip a couple of lines and leave a gap. */
+		for _, n := range []int{1, 3, 5, 6, 8} {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n, n),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n, err)
+			}
+		}
+		lb.TestStartsWith(
+			t,
+			"Holding more than 2 lines for "+id,
+			"Skipped missing line 2 for "+id,
+			"Holding more than 2 lines for "+id,
+			"Skipped missing line 4 for "+id,
+		)
+		lb.TestEmpty(t)
+		st, err := cm.Status(id)
+		if nil != err {
+			t.Fatalf("Error getting status: %s", err)
+		}
+		if want := (Status{
+			Contiguous: 1,
+			Highest:    8,
+			Missing: []LineRange{
+				{Start: 2, End: 2},
+				{Start: 4, End: 4},
+				{Start: 7, End: 7},
+			},
+		}); !reflect.DeepEqual(st, want) {
+			t.Errorf(
+				"Incorrect status\n got: %+v\nwant: %+v",
+				st,
+				want,
+			)
+		}
+
+		/* Resending the missing lines should fill in the holes. */
+		for _, n := range []int{4, 2, 7} {
+			if err := cm.Resend(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n, n),
+			); nil != err {
+				t.Fatalf("Error resending line %d: %s", n, err)
+			}
+		}
+		if err := cm.Resend(id, testRA, "2 line2"); !errors.Is(
+			err,
+			ErrDuplicateLine,
+		) {
+			t.Errorf("Incorrect error resending line 2: %v", err)
+		}
+		st, err = cm.Status(id)
+		if nil != err {
+			t.Fatalf("Error getting status: %s", err)
+		}
+		if want := (Status{
+			Contiguous: 8,
+			Highest:    8,
+		}); !reflect.DeepEqual(st, want) {
+			t.Errorf(
+				"Incorrect status\n got: %+v\nwant: %+v",
+				st,
+				want,
+			)
+		}
+
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(), "line1\nline3\nline5\nline6\n"+
+			"line4\nline2\nline7\nline8\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// errStalled is returned by stallingTransport when a stalled request is
+// released.
+var errStalled = errors.New("stalled")
+
+// stallingTransport is an http.RoundTripper which never reads the body of
+// requests to stallPath, until release is closed.  Released requests fail
+// with errStalled unless pass is true, in which case they're passed to the
+// wrapped RoundTripper, as are other requests.
+type stallingTransport struct {
+	http.RoundTripper
+	stallPath string
+	release   chan struct{}
+	pass      bool
+}
+
+// RoundTrip implements http.RoundTripper.
+func (st stallingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if st.stallPath != r.URL.Path {
+		return st.RoundTripper.RoundTrip(r)
+	}
+	<-st.release
+	if st.pass {
+		return st.RoundTripper.RoundTrip(r)
+	}
+	return nil, errStalled
+}
+
+// newStallingClient returns an HTTP client which wraps c's transport with a
+// stallingTransport and the channel to close to release stalled requests.
+func newStallingClient(c *http.Client, stallPath string) (
+	*http.Client,
+	chan<- struct{},
+) {
+	st := stallingTransport{
+		RoundTripper: c.Transport,
+		stallPath:    stallPath,
+		release:      make(chan struct{}),
+	}
+	return &http.Client{Transport: st}, st.release
+}
+
+// errFailed is returned by failingTransport for failed requests.
+var errFailed = errors.New("failed")
+
+// failingTransport is an http.RoundTripper which reads a line from each of the
+// first fail requests' bodies and then fails them with errFailed.  Later
+// requests are passed to the wrapped RoundTripper.
+type failingTransport struct {
+	http.RoundTripper
+	fail atomic.Int64
+}
+
+// RoundTrip implements http.RoundTripper.
+func (ft *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if 0 > ft.fail.Add(-1) {
+		return ft.RoundTripper.RoundTrip(r)
+	}
+	b := make([]byte, 1)
+	for {
+		if _, err := r.Body.Read(b); nil != err || '\n' == b[0] {
+			break
+		}
+	}
+	r.Body.Close()
+	return nil, errFailed
+}
+
+// Does one stalled curlrevshell leave the other connections alone?
+func TestConnManager_StalledUpstream(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			stalled = ts("stalled")
+			other   = ts("other")
+			obuf    bytes.Buffer
+			svr     = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(_ http.ResponseWriter, r *http.Request) {
+					io.Copy(&obuf, r.Body)
+				},
+			))
+			client, release = newStallingClient(
+				svr.Client(),
+				"/"+stalled,
+			)
+			cm     = NewConnManager(NewHTTPSink(svr.URL, client))
+			tl, lb = testlogger.New()
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+		cm.ReconnectTries = 0
+
+		/* Sending to the stalled connection shouldn't block. */
+		for i := range 10 {
+			if _, err := cm.Send(
+				stalled,
+				testRA,
+				fmt.Sprintf("%d stalled", i+1),
+			); nil != err {
+				t.Fatalf("Error sending stalled line: %s", err)
+			}
+		}
+		if err := cm.KeepAlive(stalled, testRA); nil != err {
+			t.Errorf("Error sending keepalive to stalled: %s", err)
+		}
+
+		/* Nor should it stop another connection from working. */
+		if _, err := cm.Send(other, testRA, "1 other"); nil != err {
+			t.Fatalf("Error sending other line: %s", err)
+		}
+		if err := cm.KeepAlive(other, testRA); nil != err {
+			t.Errorf("Error sending other keepalive: %s", err)
+		}
+		if err := cm.CloseConn(other, testRA); nil != err {
+			t.Errorf("Error closing other connection: %s", err)
+		}
+		if got, want := obuf.String(), "other\n"; got != want {
+			t.Errorf(
+				"Incorrect output\n got: %q\nwant: %q",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+
+		/* When the stalled request fails, the connection should go
+		away. */
+		close(release)
+		synctest.Wait()
+		if err := cm.KeepAlive(
+			stalled,
+			testRA,
+		); !errors.Is(err, ErrNotOpen) {
+			t.Errorf(
+				"Incorrect error sending keepalive to "+
+					"failed connection: %v",
+				err,
+			)
+		}
+		lb.TestStartsWith(t, fmt.Sprintf(
+			"Connection for %s failed: sending POST request: "+
+				"Post %q: %s",
+			stalled,
+			svr.URL+"/"+stalled,
+			errStalled,
+		))
+		lb.TestEmpty(t)
+	})
+}
+
+// newSynctestFullConnManager is like newSynctestConnManager, but requests
+// to curlrevshell for id don't read anything until the returned channel is
+// closed.
+func newSynctestFullConnManager(t *testing.T, id string) (
+	*ConnManager,
+	*testlogger.TestLogBuffer,
+	func() string,
+	chan<- struct{},
+) {
+	cm, lb, output := newSynctestConnManager(t)
+	hs := cm.sink.(HTTPSink)
+	st := stallingTransport{
+		RoundTripper: hs.client.Transport,
+		stallPath:    "/" + id,
+		release:      make(chan struct{}),
+		pass:         true,
+	}
+	hs.client = &http.Client{Transport: st}
+	cm.sink = hs
+	return cm, lb, output, st.release
+}
+
+// Does OverflowReject reject lines when the queue's full?
+func TestConnManagerSend_OverflowReject(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id                      = ts("id")
+			cm, lb, output, release = newSynctestFullConnManager(
+				t,
+				id,
+			)
+		)
+		cm.QueueLines = 2
+		cm.Overflow = OverflowReject
+
+		/* First line gets stuck in the writer, the next two are
+		queued. */
+		for n := range 3 {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n+1, n+1),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n+1, err)
+			}
+			synctest.Wait()
+		}
+
+		/* Next one should be rejected, but be sendable later. */
+		if _, err := cm.Send(id, testRA, "4 line4"); !errors.Is(
+			err,
+			ErrQueueFull,
+		) {
+			t.Errorf("Incorrect error with full queue: %v", err)
+		}
+		lb.TestStartsWith(t, "Rejecting lines for "+id+": queue full")
+		lb.TestEmpty(t)
+
+		/* A retried line isn't rejected, it's a duplicate. */
+		if _, err := cm.Send(id, testRA, "3 line3"); !errors.Is(
+			err,
+			ErrDuplicateLine,
+		) {
+			t.Errorf("Incorrect error with duplicate: %v", err)
+		}
+		close(release)
+		synctest.Wait()
+		if _, err := cm.Send(id, testRA, "4 line4"); nil != err {
+			t.Fatalf("Error resending line 4: %s", err)
+		}
+
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(),
+			"line1\nline2\nline3\nline4\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestStartsWith(t, "Rejected 1 lines for "+id+": queue full")
+		lb.TestEmpty(t)
+	})
+}
+
+// Does OverflowDropOldest drop the oldest lines when the queue's full?
+func TestConnManagerSend_OverflowDropOldest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id                      = ts("id")
+			cm, lb, output, release = newSynctestFullConnManager(
+				t,
+				id,
+			)
+		)
+		cm.QueueBytes = len("line4\nline5\n")
+		cm.Overflow = OverflowDropOldest
+
+		/* First line gets stuck in the writer, the rest are queued
+		and mostly dropped. */
+		for n := range 5 {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n+1, n+1),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n+1, err)
+			}
+			synctest.Wait()
+		}
+		lb.TestEmpty(t)
+		close(release)
+
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(), "line1\nline4\nline5\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestStartsWith(t, "Dropped 2 lines for "+id+": queue full")
+		lb.TestEmpty(t)
+	})
+}
+
+// Does OverflowBlock wait for room in the queue?
+func TestConnManagerSend_OverflowBlock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id                      = ts("id")
+			cm, lb, output, release = newSynctestFullConnManager(
+				t,
+				id,
+			)
+			sent = make(chan error, 2)
+		)
+		cm.QueueLines = 1
+
+		/* First line gets stuck in the writer, the next is queued. */
+		for n := range 2 {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n+1, n+1),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n+1, err)
+			}
+			synctest.Wait()
+		}
+
+		/* A retried line shouldn't wait. */
+		if _, err := cm.Send(id, testRA, "2 line2"); !errors.Is(
+			err,
+			ErrDuplicateLine,
+		) {
+			t.Errorf("Incorrect error with duplicate: %v", err)
+		}
+
+		/* Third should wait, without blocking anything else.  So
+		should a retry of it, which is a duplicate once there's
+		room. */
+		for range 2 {
+			go func() {
+				_, err := cm.Send(id, testRA, "3 line3")
+				sent <- err
+			}()
+		}
+		synctest.Wait()
+		select {
+		case err := <-sent:
+			t.Fatalf("Send didn't block, err: %v", err)
+		default:
+		}
+		if err := cm.KeepAlive(id, testRA); nil != err {
+			t.Errorf("Error sending keepalive: %s", err)
+		}
+		if _, err := cm.Status(id); nil != err {
+			t.Errorf("Error getting status: %s", err)
+		}
+
+		/* Unstick curlrevshell and we should be good to go. */
+		close(release)
+		var nDup int
+		for range 2 {
+			if err := <-sent; errors.Is(err, ErrDuplicateLine) {
+				nDup++
+			} else if nil != err {
+				t.Errorf("Error sending blocked line: %s", err)
+			}
+		}
+		if 1 != nDup {
+			t.Errorf("Got %d duplicates, expected 1", nDup)
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		if got, want := output(), "line1\nline2\nline3\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Do we reconnect to curlrevshell and replay lines when a connection fails?
+func TestConnManager_Reconnect(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id      = ts("id")
+			obuf    bytes.Buffer
+			reqDone = make(chan struct{})
+			svr     = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					defer close(reqDone)
+					io.Copy(&obuf, r.Body)
+				},
+			))
+			ft = &failingTransport{
+				RoundTripper: svr.Client().Transport,
+			}
+			cm = NewConnManager(NewHTTPSink(
+				svr.URL,
+				&http.Client{Transport: ft},
+			))
+			tl, lb = testlogger.New()
+			errMsg = fmt.Sprintf(
+				"sending POST request: Post %q: %s",
+				svr.URL+"/"+id,
+				errFailed,
+			)
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+		ft.fail.Store(2)
+
+		/* Lines sent while we're failing shouldn't be lost. */
+		for n := range 3 {
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line%d", n+1, n+1),
+			); nil != err {
+				t.Fatalf("Error sending line %d: %s", n+1, err)
+			}
+		}
+		synctest.Wait()
+		time.Sleep(cm.ReconnectWait)
+		synctest.Wait()
+		if _, err := cm.Send(id, testRA, "4 line4"); nil != err {
+			t.Fatalf("Error sending line 4: %s", err)
+		}
+		time.Sleep(2 * cm.ReconnectWait)
+		synctest.Wait()
+
+		/* Should be connected now. */
+		if _, err := cm.Send(id, testRA, "5 line5"); nil != err {
+			t.Fatalf("Error sending line 5: %s", err)
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		<-reqDone
+
+		/* Closing the connection waits for the writer, so it's safe to
+		check the log now. */
+		lb.TestStartsWith(
+			t,
+			fmt.Sprintf(
+				"Connection for %s failed, reconnecting "+
+					"in %s: %s",
+				id,
+				cm.ReconnectWait,
+				errMsg,
+			),
+			fmt.Sprintf(
+				"Connection for %s failed, reconnecting "+
+					"in %s: %s",
+				id,
+				2*cm.ReconnectWait,
+				errMsg,
+			),
+		)
+		if got, want := obuf.String(), "line1\nline2\nline3\n"+
+			"line4\nline5\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Do we give up reconnecting eventually?
+func TestConnManager_ReconnectGiveUp(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id  = ts("id")
+			svr = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					t.Errorf(
+						"Unexpected request for %s",
+						r.URL,
+					)
+				},
+			))
+			ft = &failingTransport{
+				RoundTripper: svr.Client().Transport,
+			}
+			cm = NewConnManager(NewHTTPSink(
+				svr.URL,
+				&http.Client{Transport: ft},
+			))
+			tl, lb = testlogger.New()
+			errMsg = fmt.Sprintf(
+				"sending POST request: Post %q: %s",
+				svr.URL+"/"+id,
+				errFailed,
+			)
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+		cm.ReconnectTries = 2
+		ft.fail.Store(3)
+
+		if _, err := cm.Send(id, testRA, "1 line1"); nil != err {
+			t.Fatalf("Error sending line: %s", err)
+		}
+		time.Sleep(3 * cm.ReconnectWait)
+		synctest.Wait()
+		lb.TestStartsWith(
+			t,
+			fmt.Sprintf(
+				"Connection for %s failed, reconnecting "+
+					"in %s: %s",
+				id,
+				cm.ReconnectWait,
+				errMsg,
+			),
+			fmt.Sprintf(
+				"Connection for %s failed, reconnecting "+
+					"in %s: %s",
+				id,
+				2*cm.ReconnectWait,
+				errMsg,
+			),
+			fmt.Sprintf(
+				"Connection for %s failed: %s",
+				id,
+				errMsg,
+			),
+		)
+		lb.TestEmpty(t)
+		if err := cm.KeepAlive(
+			id,
+			testRA,
+		); !errors.Is(err, ErrNotOpen) {
+			t.Errorf("Incorrect keepalive error: %v", err)
+		}
+	})
+}
+
+// Does the wait between reconnects stop doubling at MaxReconnectWait, even
+// after lots of tries?
+func TestConnManagerReconnectWait(t *testing.T) {
+	cm := NewConnManager(nil)
+	cm.ReconnectWait = time.Second
+	for tries, want := range map[int]time.Duration{
+		0:    time.Second,
+		1:    2 * time.Second,
+		4:    16 * time.Second,
+		5:    MaxReconnectWait,
+		34:   MaxReconnectWait,
+		64:   MaxReconnectWait,
+		1000: MaxReconnectWait,
+	} {
+		if got := cm.reconnectWait(tries); got != want {
+			t.Errorf(
+				"Incorrect wait after %d tries\n"+
+					" got: %s\n"+
+					"want: %s",
+				tries,
+				got,
+				want,
+			)
+		}
+	}
+}
+
+// Does Shutdown stop a connection waiting to reconnect from waiting?
+func TestConnManager_ReconnectShutdown(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id  = ts("id")
+			svr = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					t.Errorf(
+						"Unexpected request for %s",
+						r.URL,
+					)
+				},
+			))
+			ft = &failingTransport{
+				RoundTripper: svr.Client().Transport,
+			}
+			cm = NewConnManager(NewHTTPSink(
+				svr.URL,
+				&http.Client{Transport: ft},
+			))
+			tl, lb = testlogger.New()
+			errMsg = fmt.Sprintf(
+				"sending POST request: Post %q: %s",
+				svr.URL+"/"+id,
+				errFailed,
+			)
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+		cm.ReconnectTries = 100
+		cm.ReconnectWait = MaxReconnectWait
+		ft.fail.Store(100)
+
+		if _, err := cm.Send(id, testRA, "1 line1"); nil != err {
+			t.Fatalf("Error sending line: %s", err)
+		}
+		synctest.Wait()
+		lb.TestStartsWith(t, fmt.Sprintf(
+			"Connection for %s failed, reconnecting in %s: %s",
+			id,
+			MaxReconnectWait,
+			errMsg,
+		))
+
+		/* Shutdown should try once more, but not wait. */
+		start := time.Now()
+		if err := cm.Shutdown(
+			context.Background(),
+		); !errors.Is(err, errFailed) {
+			t.Errorf("Incorrect shutdown error: %v", err)
+		}
+		if d := time.Since(start); 0 != d {
+			t.Errorf("Shutdown took %s", d)
+		}
+		if got, want := ft.fail.Load(), int64(98); got != want {
+			t.Errorf(
+				"Incorrect number of tries\n got: %d\nwant: %d",
+				100-got,
+				100-want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Does a new run marker start a new connection, even with the same line 1, as
+// does a different line 1 without a marker?
+func TestConnManagerSend_Restart(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			mu     sync.Mutex
+			bodies []string
+			svr    = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					b, err := io.ReadAll(r.Body)
+					if nil != err {
+						t.Errorf("Read error: %s", err)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					bodies = append(bodies, string(b))
+				},
+			))
+			cm = NewConnManager(NewHTTPSink(
+				svr.URL,
+				svr.Client(),
+			))
+			tl, lb = testlogger.New()
+			id     = ts("id")
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+
+		for _, l := range []struct {
+			line   string
+			opened bool
+			dup    bool
+		}{
+			{line: "0 run1", opened: true},
+			{line: "1 banner"},
+			{line: "2 old-a"},
+			{line: "3 old-b"},
+			/* Retries, not restarts. */
+			{line: "1 banner", dup: true},
+			{line: "0 run1", dup: true},
+			{line: "0 run2", opened: true},
+			{line: "1 banner"},
+			{line: "2 new-a"},
+			{line: "3 new-b"},
+			{line: "1 banner", dup: true},
+			/* A restart whose marker went missing. */
+			{line: "1 again", opened: true},
+			{line: "2 again-a"},
+		} {
+			opened, err := cm.Send(id, testRA, l.line)
+			if l.dup && !errors.Is(err, ErrDuplicateLine) {
+				t.Errorf(
+					"Incorrect error sending duplicate "+
+						"%q: %v",
+					l.line,
+					err,
+				)
+			} else if !l.dup && nil != err {
+				t.Fatalf("Error sending %q: %s", l.line, err)
+			}
+			if opened != l.opened {
+				t.Errorf(
+					"Sending %q: opened:%t, expected %t",
+					l.line,
+					opened,
+					l.opened,
+				)
+			}
+		}
+		/* Run markers are only sent once. */
+		for _, l := range []string{"0", "0 "} {
+			if _, err := cm.Send(id, testRA, l); nil == err {
+				t.Errorf("No error sending empty marker %q", l)
+			}
+		}
+		if err := cm.Resend(id, testRA, "0 run3"); nil == err {
+			t.Errorf("No error resending run marker")
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+
+		/* Old stream should be finished before the new one. */
+		if want := []string{
+			"banner\nold-a\nold-b\n",
+			"banner\nnew-a\nnew-b\n",
+			"again\nagain-a\n",
+		}; !slices.Equal(
+			bodies,
+			want,
+		) {
+			t.Errorf(
+				"Incorrect output\ngot:\n%q\nwant:\n%q",
+				bodies,
+				want,
+			)
+		}
+		lb.TestStartsWith(t, "Session for "+id+" restarted")
+		lb.TestStartsWith(t, "Session for "+id+" restarted")
+		lb.TestEmpty(t)
+	})
+}
+
+// Does Shutdown send everything queued and close the connections?
+func TestConnManager_Shutdown(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			mu   sync.Mutex
+			outs = make(map[string]string)
+			svr  = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					b, err := io.ReadAll(r.Body)
+					if nil != err {
+						t.Errorf("Read error: %s", err)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					outs[strings.TrimPrefix(
+						r.URL.Path,
+						"/",
+					)] = string(b)
+				},
+			))
+			cm = NewConnManager(NewHTTPSink(
+				svr.URL,
+				svr.Client(),
+			))
+			tl, lb = testlogger.New()
+			ids    = []string{ts("id1"), ts("id2")}
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+
+		/* Send a couple of lines, one with a gap. */
+		for i, id := range ids {
+			for _, line := range []string{"1 a", fmt.Sprintf(
+				"%d c",
+				3-i,
+			)} {
+				if _, err := cm.Send(
+					id,
+					testRA,
+					line,
+				); nil != err {
+					t.Fatalf(
+						"Error sending %q to %s: %s",
+						line,
+						id,
+						err,
+					)
+				}
+			}
+		}
+		if err := cm.Shutdown(t.Context()); nil != err {
+			t.Fatalf("Error shutting down: %s", err)
+		}
+
+		/* Should have everything we held, and no more lines. */
+		for _, id := range ids {
+			if got, want := outs[id], "a\nc\n"; got != want {
+				t.Errorf(
+					"Incorrect output for %s\n"+
+						"got:\n%s\nwant:\n%s",
+					id,
+					got,
+					want,
+				)
+			}
+		}
+		if _, err := cm.Send(ids[0], testRA, "4 d"); !errors.Is(
+			err,
+			ErrShutdown,
+		) {
+			t.Errorf("Incorrect error after shutdown: %v", err)
+		}
+		lb.TestStartsWith(t, "Skipped missing line 2 for "+ids[0])
+		lb.TestEmpty(t)
+
+		/* Timers should all be gone. */
+		time.Sleep(2 * MaxKeepAliveWait)
+		synctest.Wait()
+		lb.TestEmpty(t)
+	})
+}
+
+// Does Shutdown give up when its context is done?
+func TestConnManager_ShutdownTimeout(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			id                 = ts("id")
+			cm, lb, _, release = newSynctestFullConnManager(t, id)
+			timeout            = time.Second
+		)
+		if _, err := cm.Send(id, testRA, "1 line1"); nil != err {
+			t.Fatalf("Error sending line: %s", err)
+		}
+		ctx, cancel := context.WithTimeout(t.Context(), timeout)
+		defer cancel()
+		start := time.Now()
+		if err := cm.Shutdown(ctx); !errors.Is(
+			err,
+			context.DeadlineExceeded,
+		) {
+			t.Errorf("Incorrect error: %v", err)
+		}
+		if d := time.Since(start); d != timeout {
+			t.Errorf("Shutdown took %s, expected %s", d, timeout)
+		}
+		close(release)
+		synctest.Wait()
+		lb.TestEmpty(t)
+	})
+}
+
+// eventRecorder records Events, for testing.
+type eventRecorder struct {
+	mu  sync.Mutex
+	evs []Event
+}
+
+// record records ev.  It is meant to be passed to ConnManager.OnEvent.
+func (er *eventRecorder) record(ev Event) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.evs = append(er.evs, ev)
+}
+
+// check makes sure the recorded events' types, IDs, remote addresses, lines,
+// and whether or not they have errors match want, and that they happened at
+// now.  It clears the recorded events.
+func (er *eventRecorder) check(t *testing.T, now time.Time, want []Event) {
+	t.Helper()
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	got := er.evs
+	er.evs = nil
+	if len(got) != len(want) {
+		t.Errorf(
+			"Got %d events, expected %d\ngot:  %s\nwant: %s",
+			len(got),
+			len(want),
+			got,
+			want,
+		)
+		return
+	}
+	for i, g := range got {
+		w := want[i]
+		if g.Type != w.Type ||
+			g.ID != w.ID ||
+			g.RemoteAddr != w.RemoteAddr ||
+			g.Line != w.Line ||
+			(nil == g.Err) != (nil == w.Err) ||
+			!g.Time.Equal(now) {
+			t.Errorf(
+				"Incorrect event %d\n got: %s (%s)\n"+
+					"want: %s (%s)",
+				i,
+				g,
+				g.Time,
+				w,
+				now,
+			)
+		}
+	}
+}
+
+// Do we get events for a connection's lifecycle?
+func TestConnManager_Events(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			er             eventRecorder
+			id             = ts("id")
+			ra2            = "192.0.2.2:54321"
+			start          = time.Now()
+		)
+		cm.OnEvent(er.record)
+
+		if _, err := cm.Send(id, testRA, "1 a"); nil != err {
+			t.Fatalf("Error sending line 1: %s", err)
+		}
+		synctest.Wait()
+		er.check(t, start, []Event{
+			{Type: EventOpened, ID: id, RemoteAddr: testRA},
+			{
+				Type:       EventLineDelivered,
+				ID:         id,
+				RemoteAddr: testRA,
+				Line:       "a",
+			},
+		})
+
+		/* Keepalives may come from elsewhere. */
+		time.Sleep(time.Second)
+		if err := cm.KeepAlive(id, ra2); nil != err {
+			t.Fatalf("Error sending keepalive: %s", err)
+		}
+		er.check(t, start.Add(time.Second), []Event{{
+			Type:       EventKeepAlive,
+			ID:         id,
+			RemoteAddr: ra2,
+		}})
+
+		time.Sleep(time.Second)
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		er.check(t, start.Add(2*time.Second), []Event{{
+			Type:       EventClosed,
+			ID:         id,
+			RemoteAddr: testRA,
+		}})
+		if got, want := output(), "a\n"; got != want {
+			t.Errorf(
+				"Incorrect output\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+		lb.TestEmpty(t)
+	})
+}
+
+// Do we get events when connections time out or fail?
+func TestConnManager_EventsTimeoutError(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			svr = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					io.Copy(io.Discard, r.Body)
+				},
+			))
+			ft = &failingTransport{
+				RoundTripper: svr.Client().Transport,
+			}
+			cm = NewConnManager(NewHTTPSink(
+				svr.URL,
+				&http.Client{Transport: ft},
+			))
+			tl, lb = testlogger.New()
+			er     eventRecorder
+			id     = ts("id")
+			start  = time.Now()
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+		cm.ReconnectTries = 0
+		cm.OnEvent(er.record)
+
+		/* The line makes it to the transport, which then fails. */
+		ft.fail.Store(1)
+		if _, err := cm.Send(id, testRA, "1 a"); nil != err {
+			t.Fatalf("Error sending line 1: %s", err)
+		}
+		synctest.Wait()
+		er.check(t, start, []Event{
+			{Type: EventOpened, ID: id, RemoteAddr: testRA},
+			{
+				Type:       EventLineDelivered,
+				ID:         id,
+				RemoteAddr: testRA,
+				Line:       "a",
+			},
+			{
+				Type:       EventUpstreamError,
+				ID:         id,
+				RemoteAddr: testRA,
+				Err:        errFailed,
+			},
+			{
+				Type:       EventClosed,
+				ID:         id,
+				RemoteAddr: testRA,
+				Err:        errFailed,
+			},
+		})
+		lb.TestStartsWith(t, fmt.Sprintf(
+			"Connection for %s failed: sending POST request: "+
+				"Post %q: %s",
+			id,
+			svr.URL+"/"+id,
+			errFailed,
+		))
+		lb.TestEmpty(t)
+
+		/* A working connection which times out. */
+		if _, err := cm.Send(id, testRA, "1 b"); nil != err {
+			t.Fatalf("Error sending line 1 again: %s", err)
+		}
+		synctest.Wait()
+		er.check(t, start, []Event{
+			{Type: EventOpened, ID: id, RemoteAddr: testRA},
+			{
+				Type:       EventLineDelivered,
+				ID:         id,
+				RemoteAddr: testRA,
+				Line:       "b",
+			},
+		})
+		time.Sleep(MaxKeepAliveWait)
+		synctest.Wait()
+		er.check(t, start.Add(MaxKeepAliveWait), []Event{
+			{Type: EventTimedOut, ID: id, RemoteAddr: testRA},
+			{Type: EventClosed, ID: id, RemoteAddr: testRA},
+		})
+		lb.TestStartsWith(
+			t,
+			"Closed connection for "+id+" after timeout",
+		)
+		lb.TestEmpty(t)
+	})
+}
+
+// How fast can we send lines to lots of connections at once, even with one
+// which is stalled?
+func BenchmarkConnManagerSend(b *testing.B) {
+	var (
+		stalled = ts("stalled")
+		svr     = httptest.NewServer(http.HandlerFunc(func(
+			_ http.ResponseWriter,
+			r *http.Request,
+		) {
+			io.Copy(io.Discard, r.Body)
+		}))
+		client, release = newStallingClient(svr.Client(), "/"+stalled)
+		cm              = NewConnManager(NewHTTPSink(svr.URL, client))
+		tl, _           = testlogger.New()
+		nID             atomic.Uint64
+	)
+	defer svr.Close()
+	defer close(release)
+	cm.logf = tl.Printf
+	if _, err := cm.Send(stalled, testRA, "1 stalled"); nil != err {
+		b.Fatalf("Error sending stalled line: %s", err)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			id    = fmt.Sprintf("id-%d", nID.Add(1))
+			lineN int
+		)
+		for pb.Next() {
+			lineN++
+			if _, err := cm.Send(
+				id,
+				testRA,
+				fmt.Sprintf("%d line", lineN),
+			); nil != err {
+				b.Errorf(
+					"Error sending line %d: %s",
+					lineN,
+					err,
+				)
+				return
+			}
+			/* Interleave the other calls as well. */
+			if 0 == lineN%10 {
+				if err := cm.KeepAlive(id, testRA); nil != err {
+					b.Errorf(
+						"Error sending keepalive: %s",
+						err,
+					)
+					return
+				}
+			}
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			b.Errorf("Error closing connection: %s", err)
+		}
+	})
+}
+
+// newSynctestConnManager returns a ConnManager which sends to a
+// synctest-friendly mock curlrevshell and logs to the returned buffer.  The
+// returned function waits for the first connection to curlrevshell to finish
+// and returns what was sent to it.
+func newSynctestConnManager(t *testing.T) (
+	*ConnManager,
+	*testlogger.TestLogBuffer,
+	func() string,
+) {
+	var (
+		buf   bytes.Buffer
+		hdone = make(chan struct{})
+		once  sync.Once
+		svr   = synctesthttpserver.NewServer(http.HandlerFunc(func(
+			_ http.ResponseWriter,
+			r *http.Request,
+		) {
+			once.Do(func() {
+				defer close(hdone)
+				io.Copy(&buf, r.Body)
+			})
+		}))
+		cm     = NewConnManager(NewHTTPSink(svr.URL, svr.Client()))
+		tl, lb = testlogger.New()
+	)
+	t.Cleanup(svr.Close)
+	cm.logf = tl.Printf
+	return cm, lb, func() string {
+		<-hdone
+		return buf.String()
+	}
+}
+
+// testRA is the remote address we pretend requests come from.
+const testRA = "192.0.2.1:12345"
+
 // ts returns s to which a hyped and a base36 uint64 have been appended.
 func ts(s string) string {
 	return fmt.Sprintf("%s-%s", s, strconv.FormatUint(rand.Uint64(), 36))
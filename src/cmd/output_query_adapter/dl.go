@@ -0,0 +1,154 @@
+package main
+
+/*
+ * dl.go
+ * Serve files for shells to download
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// DownloadsPath is the URL path under which downloads are served.  With a
+// secret, it's followed by the token for DownloadsPath itself, as if it were
+// an ID.
+const DownloadsPath = "/dl"
+
+// DownloadsSumsName is the name of the list of downloads' checksums, served
+// as if it were a file in the downloads directory.
+const DownloadsSumsName = "SHA256"
+
+// Download is a file which may be downloaded.
+type Download struct {
+	// Name is the file's path, relative to the downloads directory.
+	Name string
+	// Sum is the file's hex-encoded SHA256.
+	Sum string
+}
+
+// Downloads serves the files in a directory, read-only, along with their
+// checksums.
+type Downloads struct {
+	root   *os.Root
+	secret []byte
+	fs     http.Handler
+}
+
+// NewDownloads returns a new Downloads which serves the files in dir.  Files
+// outside of dir will not be served.  If secret isn't empty, the URL path
+// has a token.
+func NewDownloads(dir string, secret []byte) (*Downloads, error) {
+	root, err := os.OpenRoot(dir)
+	if nil != err {
+		return nil, fmt.Errorf("opening directory: %w", err)
+	}
+	d := &Downloads{root: root, secret: secret}
+	d.fs = http.StripPrefix(d.Path(), http.FileServerFS(root.FS()))
+	return d, nil
+}
+
+// Path returns the URL path under which downloads should be fetched, without
+// a trailing slash.
+func (d *Downloads) Path() string {
+	if 0 == len(d.secret) {
+		return DownloadsPath
+	}
+	return DownloadsPath + "/" + SessionToken(d.secret, DownloadsPath)
+}
+
+// List returns the regular files in the downloads directory, and
+// subdirectories, with their checksums, sorted by name.
+func (d *Downloads) List() ([]Download, error) {
+	var dls []Download
+	if err := fs.WalkDir(d.root.FS(), ".", func(
+		name string,
+		de fs.DirEntry,
+		err error,
+	) error {
+		if nil != err {
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		sum, err := d.sum(name)
+		if nil != err {
+			return fmt.Errorf("hashing %s: %w", name, err)
+		}
+		dls = append(dls, Download{Name: name, Sum: sum})
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	return dls, nil
+}
+
+// sum returns the hex-encoded SHA256 of the named file.
+func (d *Downloads) sum(name string) (string, error) {
+	f, err := d.root.Open(name)
+	if nil != err {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); nil != err {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Command returns a command which downloads dl to the current directory from
+// addr and checks its checksum.  The installer should have our TLS
+// certificate in cafile.
+func (d *Downloads) Command(dl Download, addr, cafile string) string {
+	/* Names starting with a - shouldn't look like options. */
+	b := path.Base(dl.Name)
+	if strings.HasPrefix(b, "-") {
+		b = "./" + b
+	}
+	u := url.URL{
+		Scheme: "https",
+		Host:   addr,
+		Path:   d.Path() + "/" + dl.Name,
+	}
+	return fmt.Sprintf(
+		`%s %s && [ "$(sha256 -q %s)" = %s ]`,
+		ftpWithArgs(b, cafile),
+		shellQuote(u.String()),
+		shellQuote(b),
+		dl.Sum,
+	)
+}
+
+// WriteSums writes the downloads' checksums to w, in the same format as
+// sha256(1), suitable for sha256 -C.
+func (d *Downloads) WriteSums(w io.Writer) error {
+	dls, err := d.List()
+	if nil != err {
+		return err
+	}
+	var sb strings.Builder
+	for _, dl := range dls {
+		fmt.Fprintf(&sb, "SHA256 (%s) = %s\n", dl.Name, dl.Sum)
+	}
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// ServeHTTP serves the file named in r's URL path, which should start with
+// d.Path().
+func (d *Downloads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.fs.ServeHTTP(w, r)
+}
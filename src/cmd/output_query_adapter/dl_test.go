@@ -0,0 +1,121 @@
+package main
+
+/*
+ * dl_test.go
+ * Tests for dl.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testDownloadsDir returns a directory with a couple of files to download.
+func testDownloadsDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); nil != err {
+		t.Fatalf("Error making subdirectory: %s", err)
+	}
+	for name, contents := range map[string]string{
+		"busybox":         "kittens",
+		"sub/install.sub": "moose",
+	} {
+		if err := os.WriteFile(
+			filepath.Join(dir, name),
+			[]byte(contents),
+			0600,
+		); nil != err {
+			t.Fatalf("Error writing %s: %s", name, err)
+		}
+	}
+	if err := os.Symlink(
+		"busybox",
+		filepath.Join(dir, "link"),
+	); nil != err {
+		t.Fatalf("Error making symlink: %s", err)
+	}
+	return dir
+}
+
+// Do we find files and their checksums?
+func TestDownloads_List(t *testing.T) {
+	d, err := NewDownloads(testDownloadsDir(t), nil)
+	if nil != err {
+		t.Fatalf("Error creating Downloads: %s", err)
+	}
+	got, err := d.List()
+	if nil != err {
+		t.Fatalf("Error listing downloads: %s", err)
+	}
+	if want := []Download{
+		{Name: "busybox", Sum: sumOf("kittens")},
+		{Name: "sub/install.sub", Sum: sumOf("moose")},
+	}; !slices.Equal(got, want) {
+		t.Errorf("Incorrect list\n got: %v\nwant: %v", got, want)
+	}
+
+	/* The sums should work with sha256 -C. */
+	var sb strings.Builder
+	if err := d.WriteSums(&sb); nil != err {
+		t.Fatalf("Error writing sums: %s", err)
+	}
+	want := "SHA256 (busybox) = " + sumOf("kittens") + "\n" +
+		"SHA256 (sub/install.sub) = " + sumOf("moose") + "\n"
+	if got := sb.String(); got != want {
+		t.Errorf("Incorrect sums\n got: %s\nwant: %s", got, want)
+	}
+}
+
+// Do we make usable commands?
+func TestDownloads_Command(t *testing.T) {
+	secret := []byte("kittens")
+	d, err := NewDownloads(testDownloadsDir(t), secret)
+	if nil != err {
+		t.Fatalf("Error creating Downloads: %s", err)
+	}
+	prefix := "https://192.0.2.10:5555/dl/" +
+		SessionToken(secret, DownloadsPath)
+	for _, c := range []struct {
+		name string
+		want string
+	}{{
+		name: "sub/install.sub",
+		want: "ftp -M -oinstall.sub -S cafile=/etc/ssl/crs_cert.pem " +
+			"-V -w 15 " + prefix + "/sub/install.sub && " +
+			`[ "$(sha256 -q install.sub)" = ` + sumOf("moose") +
+			" ]",
+	}, {
+		name: "it's $(reboot); a file",
+		want: `ftp -M -o'it'\''s $(reboot); a file' ` +
+			"-S cafile=/etc/ssl/crs_cert.pem -V -w 15 " +
+			"'" + prefix + "/it%27s%20$%28reboot%29;%20a%20file' " +
+			`&& [ "$(sha256 -q 'it'\''s $(reboot); a file')" = ` +
+			sumOf("moose") + " ]",
+	}, {
+		name: "-rf",
+		want: "ftp -M -o./-rf -S cafile=/etc/ssl/crs_cert.pem " +
+			"-V -w 15 " + prefix + "/-rf && " +
+			`[ "$(sha256 -q ./-rf)" = ` + sumOf("moose") + " ]",
+	}} {
+		got := d.Command(
+			Download{Name: c.name, Sum: sumOf("moose")},
+			"192.0.2.10:5555",
+			DefaultStagerCAFile,
+		)
+		if got != c.want {
+			t.Errorf(
+				"Incorrect command for %q\n got: %s\nwant: %s",
+				c.name,
+				got,
+				c.want,
+			)
+		}
+	}
+}
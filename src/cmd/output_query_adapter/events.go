@@ -0,0 +1,93 @@
+package main
+
+/*
+ * events.go
+ * Connection lifecycle events
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType is the sort of thing which happened to a connection.
+type EventType int
+
+// Event types.
+const (
+	// EventOpened is sent when a connection is opened.
+	EventOpened EventType = iota + 1
+	// EventLineDelivered is sent when a line is written to the Sink.
+	EventLineDelivered
+	// EventKeepAlive is sent when a connection is kept alive.
+	EventKeepAlive
+	// EventTimedOut is sent when a connection is closed for want of a
+	// keepalive.
+	EventTimedOut
+	// EventClosed is sent when a connection has finished.
+	EventClosed
+	// EventUpstreamError is sent when a connection's SinkConn fails.  The
+	// SinkConn may be reopened.
+	EventUpstreamError
+)
+
+// eventTypeNames are the names of the event types, for String.
+var eventTypeNames = map[EventType]string{
+	EventOpened:        "opened",
+	EventLineDelivered: "line-delivered",
+	EventKeepAlive:     "keepalive",
+	EventTimedOut:      "timed-out",
+	EventClosed:        "closed",
+	EventUpstreamError: "upstream-error",
+}
+
+// String implements fmt.Stringer.
+func (et EventType) String() string {
+	if s, ok := eventTypeNames[et]; ok {
+		return s
+	}
+	return fmt.Sprintf("EventType(%d)", int(et))
+}
+
+// Event describes something which happened to a connection.
+type Event struct {
+	Type EventType
+	ID   string
+	// Conn tells apart connections with the same ID, e.g. before and
+	// after a restart.  It is never 0.
+	Conn uint64
+	// RemoteAddr is the address from which the connection's most recent
+	// request came, or for EventLineDelivered, from which the line came.
+	RemoteAddr string
+	// Time is when the event happened.
+	Time time.Time
+	// Opened is when the connection was opened.
+	Opened time.Time
+	// Line is the line delivered, for EventLineDelivered.
+	Line string
+	// Seq is the line's number, for EventLineDelivered.
+	Seq int
+	// Received is when the line arrived, for EventLineDelivered.
+	Received time.Time
+	// Replayed is true for EventLineDelivered if the line was delivered
+	// before and is being sent again after a reconnect.
+	Replayed bool
+	// Err is the error for EventUpstreamError, and for EventClosed if the
+	// connection failed.
+	Err error
+}
+
+// String implements fmt.Stringer.
+func (ev Event) String() string {
+	s := fmt.Sprintf("[%s] %s %s", ev.RemoteAddr, ev.ID, ev.Type)
+	if EventLineDelivered == ev.Type {
+		s += fmt.Sprintf(" %q", ev.Line)
+	}
+	if nil != ev.Err {
+		s += ": " + ev.Err.Error()
+	}
+	return s
+}
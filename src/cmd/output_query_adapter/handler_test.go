@@ -5,31 +5,40 @@ package main
  * Tests for handler.go
  * By J. Stuart McMurray
  * Created 20260117
- * Last Modified 20260206
+ * Last Modified 20261018
  */
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"testing"
+	"testing/synctest"
 
 	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
 )
 
 // testLineHandler mocks ConnManager
 type testLineHandler struct {
-	mu     sync.Mutex
-	closed bool
-	open   bool
-	buf    bytes.Buffer
+	mu      sync.Mutex
+	closed  bool
+	open    bool
+	buf     bytes.Buffer
+	sendErr error  /* Returned by Send, if set. */
+	status  Status /* Returned by Status. */
 }
 
-func (lh *testLineHandler) CloseConn(_ string) error {
+func (lh *testLineHandler) CloseConn(_, _ string) error {
 	lh.mu.Lock()
 	defer lh.mu.Unlock()
 	if lh.closed {
@@ -39,19 +48,41 @@ func (lh *testLineHandler) CloseConn(_ string) error {
 	lh.open = false
 	return nil
 }
-func (lh *testLineHandler) Send(_, line string) (bool, error) {
+func (lh *testLineHandler) Send(_, _, line string) (bool, error) {
 	lh.mu.Lock()
 	defer lh.mu.Unlock()
 	if lh.closed {
 		return false, errors.New("send after close")
 	}
+	if nil != lh.sendErr {
+		return false, lh.sendErr
+	}
 	lh.buf.WriteString(line + "\n")
 	opened := !lh.open
 	lh.open = true
 	return opened, nil
 }
 
-func (lh *testLineHandler) KeepAlive(_ string) error {
+func (lh *testLineHandler) Resend(_, _, line string) error {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	if lh.closed {
+		return errors.New("resend after close")
+	}
+	lh.buf.WriteString("resend " + line + "\n")
+	return nil
+}
+
+func (lh *testLineHandler) Status(_ string) (Status, error) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	if lh.closed {
+		return Status{}, ErrNotOpen
+	}
+	return lh.status, nil
+}
+
+func (lh *testLineHandler) KeepAlive(_, _ string) error {
 	lh.mu.Lock()
 	defer lh.mu.Unlock()
 	if lh.closed {
@@ -190,3 +221,721 @@ func TestHandler(t *testing.T) {
 	lb.TestStartsWith(t, logWant...)
 	lb.TestEmpty(t)
 }
+
+// Do duplicate lines get a happy response?
+func TestHandler_Duplicate(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		mgr    = &testLineHandler{sendErr: fmt.Errorf(
+			"already sent line with number 1: %w",
+			ErrDuplicateLine,
+		)}
+		mux = newMux(handler{
+			cMgr:   mgr,
+			debugf: tl.Printf,
+			logf:   tl.Printf,
+		})
+		id   = ts("id")
+		line = "1 " + ts("line")
+		req  = httptest.NewRequest(
+			http.MethodGet,
+			"/line/"+id+"?"+url.QueryEscape(line),
+			nil,
+		)
+		rr = httptest.NewRecorder()
+	)
+	mux.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Errorf("Incorrect status\n got: %d\nwant: %d", got, want)
+	}
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"[%s] Ignored duplicate %q for %s",
+		req.RemoteAddr,
+		line,
+		id,
+	))
+	lb.TestEmpty(t)
+}
+
+// Can we get a connection's status and resend lines?
+func TestHandler_StatusResend(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		mgr    = &testLineHandler{status: Status{
+			Contiguous: 2,
+			Highest:    10,
+			Missing: []LineRange{
+				{Start: 3, End: 3},
+				{Start: 5, End: 8},
+			},
+		}}
+		mux = newMux(handler{
+			cMgr:   mgr,
+			debugf: tl.Printf,
+			logf:   tl.Printf,
+		})
+		id   = ts("id")
+		line = "3 " + ts("line")
+	)
+
+	/* Status should be easy to parse. */
+	req := httptest.NewRequest(http.MethodGet, "/status/"+id, nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Errorf("Incorrect status\n got: %d\nwant: %d", got, want)
+	}
+	if got, want := rr.Body.String(), "contiguous 2\n"+
+		"highest 10\n"+
+		"missing 3 3\n"+
+		"missing 5 8\n"; got != want {
+		t.Errorf("Incorrect body\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"[%s] Status for %s: contiguous:2 highest:10 missing:2",
+		req.RemoteAddr,
+		id,
+	))
+
+	/* Resend a missing line. */
+	req = httptest.NewRequest(
+		http.MethodGet,
+		"/resend/"+id+"?"+url.QueryEscape(line),
+		nil,
+	)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Errorf("Incorrect status\n got: %d\nwant: %d", got, want)
+	}
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"[%s] Resent %q to %s",
+		req.RemoteAddr,
+		line,
+		id,
+	))
+	mgr.mu.Lock()
+	if got, want := mgr.buf.String(), "resend "+line+"\n"; got != want {
+		t.Errorf("Incorrect sent data\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	mgr.mu.Unlock()
+
+	/* Unknown IDs should 404. */
+	if err := mgr.CloseConn(id, testRA); nil != err {
+		t.Fatalf("Error closing mock connection: %s", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/status/"+id, nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusNotFound; got != want {
+		t.Errorf("Incorrect status\n got: %d\nwant: %d", got, want)
+	}
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"[%s] Status requested for unknown ID %s",
+		req.RemoteAddr,
+		id,
+	))
+	lb.TestEmpty(t)
+}
+
+// Do lines for full queues get a 503?
+func TestHandler_QueueFull(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		mgr    = &testLineHandler{sendErr: fmt.Errorf(
+			"cannot send line with number 1: %w",
+			ErrQueueFull,
+		)}
+		mux = newMux(handler{
+			cMgr:   mgr,
+			debugf: tl.Printf,
+			logf:   tl.Printf,
+		})
+		id   = ts("id")
+		line = "1 " + ts("line")
+		req  = httptest.NewRequest(
+			http.MethodGet,
+			"/line/"+id+"?"+url.QueryEscape(line),
+			nil,
+		)
+		rr = httptest.NewRecorder()
+	)
+	mux.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Incorrect status\n got: %d\nwant: %d", got, want)
+	}
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"[%s] Rejected %q for %s: %s",
+		req.RemoteAddr,
+		line,
+		id,
+		mgr.sendErr,
+	))
+	lb.TestEmpty(t)
+}
+
+// Do we reject requests without valid tokens when we have a secret?
+func TestHandler_Authenticate(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		mgr    = new(testLineHandler)
+		secret = []byte(ts("secret"))
+		mux    = newMux(handler{
+			cMgr:   mgr,
+			debugf: tl.Printf,
+			logf:   tl.Printf,
+			secret: secret,
+		})
+		id    = ts("id")
+		other = ts("other")
+		line  = "1 " + ts("line")
+		q     = "?" + url.QueryEscape(line)
+		ra    string
+	)
+	for _, c := range []struct {
+		path string
+		want int
+	}{{
+		path: "/line/" + id + q,
+		want: http.StatusForbidden,
+	}, {
+		path: "/line/" + id + "/" + SessionToken(secret, other) + q,
+		want: http.StatusForbidden,
+	}, {
+		path: "/line/" + id + "/kittens" + q,
+		want: http.StatusForbidden,
+	}, {
+		path: "/status/" + id,
+		want: http.StatusForbidden,
+	}, {
+		path: "/line/" + id + "/" + SessionToken(secret, id) + q,
+		want: http.StatusOK,
+	}} {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		ra = req.RemoteAddr
+		if got := rr.Code; got != c.want {
+			t.Errorf(
+				"Incorrect status for %s\n got: %d\nwant: %d",
+				c.path,
+				got,
+				c.want,
+			)
+		}
+		if http.StatusForbidden == c.want {
+			lb.TestStartsWith(t, fmt.Sprintf(
+				"[%s] Rejected unauthenticated request for %s",
+				req.RemoteAddr,
+				id,
+			))
+		}
+	}
+	lb.TestStartsWith(
+		t,
+		fmt.Sprintf("[%s] Opened new connection for %s", ra, id),
+		fmt.Sprintf("[%s] Sent %q to %s", ra, line, id),
+	)
+	lb.TestEmpty(t)
+
+	/* Only the authenticated line should have made it. */
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if got, want := mgr.buf.String(), line+"\n"; got != want {
+		t.Errorf("Incorrect sent data\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// Can we send several lines at once?
+func TestHandler_Lines(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		mgr    = new(testLineHandler)
+		mux    = newMux(handler{
+			cMgr:   mgr,
+			debugf: tl.Printf,
+			logf:   tl.Printf,
+		})
+		id = ts("id")
+	)
+
+	/* A good batch. */
+	req := httptest.NewRequest(
+		http.MethodGet,
+		"/lines/"+id+"?1%20a&2%20b%26c&3",
+		nil,
+	)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if http.StatusOK != rr.Code {
+		t.Errorf("Incorrect status for good batch: %d", rr.Code)
+	}
+	mgr.mu.Lock()
+	if got, want := mgr.buf.String(), "1 a\n2 b&c\n3\n"; got != want {
+		t.Errorf("Incorrect sent data\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	mgr.mu.Unlock()
+	lb.TestStartsWith(
+		t,
+		"["+req.RemoteAddr+"] Opened new connection for "+id,
+		"["+req.RemoteAddr+"] Sent \"1 a\" to "+id,
+		"["+req.RemoteAddr+"] Sent \"2 b&c\" to "+id,
+		"["+req.RemoteAddr+"] Sent \"3\" to "+id,
+	)
+	lb.TestEmpty(t)
+
+	/* A bad batch. */
+	req = httptest.NewRequest(
+		http.MethodGet,
+		"/lines/"+id+"?4%20d&6%20f",
+		nil,
+	)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if http.StatusBadRequest != rr.Code {
+		t.Errorf("Incorrect status for bad batch: %d", rr.Code)
+	}
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"[%s] Error extracting lines for %s: "+
+			"line 2 has number 6, expected 5",
+		req.RemoteAddr,
+		id,
+	))
+	lb.TestEmpty(t)
+}
+
+// Can we send a compressed chunk of lines?
+func TestHandler_Chunk(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		mgr    = new(testLineHandler)
+		mux    = newMux(handler{
+			cMgr:   mgr,
+			debugf: tl.Printf,
+			logf:   tl.Printf,
+		})
+		id  = ts("id")
+		buf bytes.Buffer
+	)
+	gw := gzip.NewWriter(&buf)
+	io.WriteString(gw, "1 a\n2 b\n")
+	gw.Close()
+
+	req := httptest.NewRequest(
+		http.MethodGet,
+		"/chunk/"+id+"?gzip.1."+base64.RawURLEncoding.EncodeToString(
+			buf.Bytes(),
+		),
+		nil,
+	)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if http.StatusOK != rr.Code {
+		t.Errorf("Incorrect status: %d", rr.Code)
+	}
+	mgr.mu.Lock()
+	if got, want := mgr.buf.String(), "1 a\n2 b\n"; got != want {
+		t.Errorf("Incorrect sent data\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	mgr.mu.Unlock()
+	lb.TestStartsWith(
+		t,
+		"["+req.RemoteAddr+"] Opened new connection for "+id,
+		"["+req.RemoteAddr+"] Sent \"1 a\" to "+id,
+		"["+req.RemoteAddr+"] Sent \"2 b\" to "+id,
+	)
+	lb.TestEmpty(t)
+}
+
+// Can we send files?
+func TestHandler_File(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		tl, lb = testlogger.New()
+		id     = ts("id")
+	)
+	fr, err := NewFileReceiver(dir)
+	if nil != err {
+		t.Fatalf("Error creating file receiver: %s", err)
+	}
+	fr.logf = tl.Printf
+	mux := newMux(handler{
+		cMgr:   new(testLineHandler),
+		files:  fr,
+		debugf: func(string, ...any) {},
+		logf:   tl.Printf,
+	})
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodGet,
+			"/file/"+id+"/ai.log?"+query,
+			nil,
+		)
+		req.RemoteAddr = testRA
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	/* Send part of the file, finish, and send the rest. */
+	for _, q := range []string{"b64.1.a2l0", "hex.3.73"} {
+		if rr := get(q); http.StatusOK != rr.Code {
+			t.Fatalf("Incorrect status sending %s: %d", q, rr.Code)
+		}
+	}
+	end := "end.3." + sumOf("kittens")
+	rr := get(end)
+	if got, want := rr.Body.String(), "missing 2 2\n"; got != want {
+		t.Errorf(
+			"Incorrect missing chunks\n got: %q\nwant: %q",
+			got,
+			want,
+		)
+	}
+	if rr := get("b64.2.dGVu"); http.StatusOK != rr.Code {
+		t.Fatalf("Incorrect status sending chunk 2: %d", rr.Code)
+	}
+	rr = get(end)
+	if got, want := rr.Body.String(), "ok "+sumOf("kittens")+"\n"; got !=
+		want {
+		t.Errorf("Incorrect response\n got: %q\nwant: %q", got, want)
+	}
+	if got, err := os.ReadFile(
+		filepath.Join(dir, id, "ai.log"),
+	); nil != err {
+		t.Errorf("Error reading saved file: %s", err)
+	} else if "kittens" != string(got) {
+		t.Errorf("Incorrect saved file: %q", got)
+	}
+
+	/* Files which aren't what was sent and junk should be errors. */
+	get("b64.1.a2l0")
+	if rr := get(
+		"end.1." + sumOf("kittens"),
+	); http.StatusConflict != rr.Code {
+		t.Errorf("Incorrect status for bad checksum: %d", rr.Code)
+	}
+	if rr := get("kittens"); http.StatusBadRequest != rr.Code {
+		t.Errorf("Incorrect status for bad query: %d", rr.Code)
+	}
+
+	lb.TestStartsWith(
+		t,
+		"["+testRA+"] File ai.log from "+id+
+			" is missing 1 chunk ranges",
+		"["+testRA+"] Received ai.log from "+id+
+			", saved as "+id+"/ai.log",
+		"["+testRA+"] Error finishing ai.log from "+id+
+			": checksum mismatch",
+		"["+testRA+"] Error parsing request for file ai.log from "+
+			id+": malformed query",
+	)
+	lb.TestEmpty(t)
+}
+
+// Can shells poll for commands?
+func TestHandler_Input(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			tl, lb = testlogger.New()
+			input  = NewInputQueue()
+			mux    = newMux(handler{
+				cMgr:   new(testLineHandler),
+				input:  input,
+				debugf: func(string, ...any) {},
+				logf:   tl.Printf,
+			})
+			id = ts("id")
+		)
+		get := func(query string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(
+				http.MethodGet,
+				"/input/"+id+query,
+				nil,
+			)
+			req.RemoteAddr = testRA
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			return rr
+		}
+		if _, err := input.Add(id, "uname -a", "ls /tmp"); nil != err {
+			t.Fatalf("Error queueing commands: %s", err)
+		}
+
+		for _, c := range []struct {
+			query string
+			want  string
+		}{
+			{query: "", want: "1 uname -a\n2 ls /tmp\n"},
+			{query: "?1", want: "2 ls /tmp\n"},
+			{query: "?2", want: ""},
+		} {
+			rr := get(c.query)
+			if http.StatusOK != rr.Code {
+				t.Errorf(
+					"Incorrect status for %q: %d",
+					c.query,
+					rr.Code,
+				)
+			}
+			if got := rr.Body.String(); got != c.want {
+				t.Errorf(
+					"Incorrect commands for %q\n"+
+						" got: %q\n"+
+						"want: %q",
+					c.query,
+					got,
+					c.want,
+				)
+			}
+		}
+
+		/* Bad numbers should be rejected. */
+		rr := get("?kittens")
+		if got, want := rr.Code, http.StatusBadRequest; got != want {
+			t.Errorf(
+				"Incorrect status for bad number\n"+
+					" got: %d\n"+
+					"want: %d",
+				got,
+				want,
+			)
+		}
+
+		/* After closing, requests should be refused. */
+		input.Close()
+		rr = get("?2")
+		if got, want := rr.Code, http.StatusServiceUnavailable; got !=
+			want {
+			t.Errorf(
+				"Incorrect status after close\n"+
+					" got: %d\n"+
+					"want: %d",
+				got,
+				want,
+			)
+		}
+
+		lb.TestStartsWith(
+			t,
+			"["+testRA+"] Invalid input request for "+id+
+				`: "kittens"`,
+		)
+		lb.TestEmpty(t)
+	})
+}
+
+// Is the stager served from the right place?
+func TestHandler_Stager(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		secret []byte
+		path   string
+		want   int
+	}{
+		{name: "open", path: "/c", want: http.StatusOK},
+		{
+			name:   "secret",
+			secret: []byte("kittens"),
+			path: "/c/" + SessionToken(
+				[]byte("kittens"),
+				StagerPath,
+			),
+			want: http.StatusOK,
+		},
+		{
+			name:   "no_token",
+			secret: []byte("kittens"),
+			path:   "/c",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "bad_token",
+			secret: []byte("kittens"),
+			path: "/c/" + SessionToken(
+				[]byte("moose"),
+				StagerPath,
+			),
+			want: http.StatusNotFound,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				tl, lb = testlogger.New()
+				mux    = newMux(handler{
+					cMgr: new(testLineHandler),
+					stager: NewStager(
+						testStagerConfig,
+						c.secret,
+					),
+					secret: c.secret,
+					debugf: tl.Printf,
+					logf:   tl.Printf,
+				})
+				req = httptest.NewRequest(
+					http.MethodGet,
+					c.path,
+					nil,
+				)
+				rr = httptest.NewRecorder()
+			)
+			req.RemoteAddr = testRA
+			mux.ServeHTTP(rr, req)
+			if rr.Code != c.want {
+				t.Fatalf(
+					"Incorrect status\n got: %d\nwant: %d",
+					rr.Code,
+					c.want,
+				)
+			}
+			if http.StatusOK != rr.Code {
+				lb.TestEmpty(t)
+				return
+			}
+			ms := regexp.MustCompile(
+				`OUTFILE=/tmp/(\S+)\.out`,
+			).FindStringSubmatch(rr.Body.String())
+			if nil == ms {
+				t.Fatalf(
+					"No ID in script:\n%s",
+					rr.Body.String(),
+				)
+			}
+			lb.TestStartsWith(
+				t,
+				"["+testRA+"] Sent stager for new ID "+ms[1],
+			)
+			lb.TestEmpty(t)
+		})
+	}
+}
+
+// Do we serve downloads?
+func TestHandler_Download(t *testing.T) {
+	var (
+		secret = []byte("kittens")
+		token  = SessionToken(secret, DownloadsPath)
+	)
+	dl, err := NewDownloads(testDownloadsDir(t), secret)
+	if nil != err {
+		t.Fatalf("Error creating Downloads: %s", err)
+	}
+	for _, c := range []struct {
+		path     string
+		want     int
+		wantBody string
+		wantLog  string
+	}{{
+		path:     "/dl/" + token + "/busybox",
+		want:     http.StatusOK,
+		wantBody: "kittens",
+		wantLog:  "[" + testRA + "] Download requested: busybox",
+	}, {
+		path:     "/dl/" + token + "/sub/install.sub",
+		want:     http.StatusOK,
+		wantBody: "moose",
+		wantLog: "[" + testRA + "] Download requested: " +
+			"sub/install.sub",
+	}, {
+		path: "/dl/" + token + "/" + DownloadsSumsName,
+		want: http.StatusOK,
+		wantBody: "SHA256 (busybox) = " + sumOf("kittens") + "\n" +
+			"SHA256 (sub/install.sub) = " + sumOf("moose") + "\n",
+		wantLog: "[" + testRA + "] Sent download checksums",
+	}, {
+		path:    "/dl/" + token + "/nope",
+		want:    http.StatusNotFound,
+		wantLog: "[" + testRA + "] Download requested: nope",
+	}, {
+		path: "/dl/busybox",
+		want: http.StatusNotFound,
+	}, {
+		path: "/dl/" + SessionToken([]byte("moose"), DownloadsPath) +
+			"/busybox",
+		want: http.StatusNotFound,
+	}} {
+		t.Run(c.path, func(t *testing.T) {
+			var (
+				tl, lb = testlogger.New()
+				mux    = newMux(handler{
+					cMgr:   new(testLineHandler),
+					dl:     dl,
+					secret: secret,
+					debugf: tl.Printf,
+					logf:   tl.Printf,
+				})
+				req = httptest.NewRequest(
+					http.MethodGet,
+					c.path,
+					nil,
+				)
+				rr = httptest.NewRecorder()
+			)
+			req.RemoteAddr = testRA
+			mux.ServeHTTP(rr, req)
+			if rr.Code != c.want {
+				t.Errorf(
+					"Incorrect status\n got: %d\nwant: %d",
+					rr.Code,
+					c.want,
+				)
+			}
+			if "" != c.wantBody {
+				if got := rr.Body.String(); got != c.wantBody {
+					t.Errorf(
+						"Incorrect body\n"+
+							" got: %q\n"+
+							"want: %q",
+						got,
+						c.wantBody,
+					)
+				}
+			}
+			if "" != c.wantLog {
+				lb.TestStartsWith(t, c.wantLog)
+			}
+			lb.TestEmpty(t)
+		})
+	}
+}
+
+// Do we count requests per route, even if they're not authenticated?
+func TestHandler_Metrics(t *testing.T) {
+	var (
+		tl, lb = testlogger.New()
+		m      = NewMetrics()
+		secret = []byte("kittens")
+		id     = ts("id")
+		mux    = newMux(handler{
+			cMgr:    new(testLineHandler),
+			metrics: m,
+			secret:  secret,
+			debugf:  tl.Printf,
+			logf:    tl.Printf,
+		})
+	)
+	for _, p := range []string{
+		"/keepalive/" + id + "/" + SessionToken(secret, id),
+		"/line/" + id + "/" + SessionToken(secret, id) + "?1+a",
+		"/line/" + id + "?2+b",
+		"/nope/" + id,
+	} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.RemoteAddr = testRA
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	checkMetrics(
+		t,
+		m,
+		`oqa_requests_total{route="keepalive"} 1`,
+		`oqa_requests_total{route="line"} 2`,
+	)
+	lb.TestStartsWith(
+		t,
+		"["+testRA+"] KeepAlive: "+id,
+		"["+testRA+"] Opened new connection for "+id,
+		"["+testRA+"] Sent \"1 a\" to "+id,
+		"["+testRA+"] Rejected unauthenticated request for "+id,
+	)
+	lb.TestEmpty(t)
+}
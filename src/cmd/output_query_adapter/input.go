@@ -0,0 +1,196 @@
+package main
+
+/*
+ * input.go
+ * Queue commands for shells to poll
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultInputWait is how long a request for input waits for a command by
+// default.
+const DefaultInputWait = 25 * time.Second
+
+// MaxQueuedCommands is the most commands which may be queued for an ID.
+const MaxQueuedCommands = 1024
+
+var (
+	// ErrInputQueueFull is returned by InputQueue.Add when an ID already
+	// has MaxQueuedCommands commands queued.
+	ErrInputQueueFull = errors.New("input queue full")
+	// ErrInputClosed is returned by InputQueue.Get after
+	// InputQueue.Close is called.
+	ErrInputClosed = errors.New("input queue closed")
+)
+
+// InputCommand is a command queued for a shell.
+type InputCommand struct {
+	Seq     int    `json:"seq"`
+	Command string `json:"command"`
+}
+
+// InputQueue holds commands for shells which poll for them.  Each ID's
+// commands are numbered starting at 1.  Commands are kept until a shell asks
+// for commands after them, so a shell which doesn't get a response just asks
+// again.  An ID's commands are forgotten once its connection has closed and
+// it has none left; HandleEvent should be registered with
+// ConnManager.OnEvent.
+type InputQueue struct {
+	// Wait is how long Get waits for a command.  It should not be changed
+	// after Get is first called.
+	Wait time.Duration
+
+	mu      sync.Mutex
+	queues  map[string]*inputQueue /* Only IDs with commands added. */
+	open    map[string]uint64      /* ID -> Open conn's Event.Conn */
+	changed chan struct{}          /* Closed when commands are added. */
+	done    chan struct{}
+}
+
+// inputQueue is a single ID's commands.
+type inputQueue struct {
+	next  int /* Number of the next command. */
+	cmds  []InputCommand
+	ended bool /* Connection closed, forget when empty. */
+}
+
+// NewInputQueue returns a new InputQueue, ready for use.
+func NewInputQueue() *InputQueue {
+	return &InputQueue{
+		Wait:    DefaultInputWait,
+		queues:  make(map[string]*inputQueue),
+		open:    make(map[string]uint64),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Add queues cmds for id and returns the number of the last one.  Commands
+// may not contain newlines.
+func (q *InputQueue) Add(id string, cmds ...string) (int, error) {
+	for _, cmd := range cmds {
+		if strings.ContainsAny(cmd, "\r\n") {
+			return 0, fmt.Errorf("newline in command %q", cmd)
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	iq, ok := q.queues[id]
+	if !ok {
+		iq = &inputQueue{next: 1}
+		q.queues[id] = iq
+	}
+	if MaxQueuedCommands < len(iq.cmds)+len(cmds) {
+		return 0, ErrInputQueueFull
+	}
+	for _, cmd := range cmds {
+		iq.cmds = append(iq.cmds, InputCommand{
+			Seq:     iq.next,
+			Command: cmd,
+		})
+		iq.next++
+	}
+	close(q.changed)
+	q.changed = make(chan struct{})
+	return iq.next - 1, nil
+}
+
+// Get returns id's commands numbered after after, which are forgotten.  If
+// there are none, Get waits up to q.Wait for some, and returns nil if none
+// are added.  If after is higher than any command we've numbered, we've
+// probably been restarted, and queued commands are renumbered to follow it.
+// Get doesn't remember IDs for which no commands have been added.
+func (q *InputQueue) Get(
+	ctx context.Context,
+	id string,
+	after int,
+) ([]InputCommand, error) {
+	t := time.NewTimer(q.Wait)
+	defer t.Stop()
+	for {
+		q.mu.Lock()
+		var cmds []InputCommand
+		if iq, ok := q.queues[id]; ok {
+			cmds = iq.after(after)
+			if iq.ended && 0 == len(iq.cmds) {
+				delete(q.queues, id)
+			}
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		if 0 != len(cmds) {
+			return cmds, nil
+		}
+
+		/* Nothing yet, wait for something. */
+		select {
+		case <-changed:
+		case <-t.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.done:
+			return nil, ErrInputClosed
+		}
+	}
+}
+
+// after forgets commands numbered up to n and returns a copy of the rest.  If
+// n is at least iq.next, the commands are first renumbered to follow n.
+func (iq *inputQueue) after(n int) []InputCommand {
+	if n >= iq.next {
+		for i := range iq.cmds {
+			iq.cmds[i].Seq = n + 1 + i
+		}
+		iq.next = n + 1 + len(iq.cmds)
+	}
+	iq.cmds = slices.DeleteFunc(iq.cmds, func(c InputCommand) bool {
+		return c.Seq <= n
+	})
+	return slices.Clone(iq.cmds)
+}
+
+// HandleEvent keeps track of which IDs have open connections.  When an ID's
+// connection closes, its commands are forgotten once there are none left.
+// A connection closed after a restart has opened another for the same ID
+// doesn't count.
+func (q *InputQueue) HandleEvent(ev Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	iq := q.queues[ev.ID]
+	switch ev.Type {
+	case EventOpened:
+		q.open[ev.ID] = ev.Conn
+		if nil != iq {
+			iq.ended = false
+		}
+	case EventClosed:
+		if q.open[ev.ID] != ev.Conn {
+			return /* Restarted. */
+		}
+		delete(q.open, ev.ID)
+		if nil == iq {
+			return
+		}
+		if 0 == len(iq.cmds) {
+			delete(q.queues, ev.ID)
+		} else {
+			iq.ended = true
+		}
+	}
+}
+
+// Close causes waiting and future calls to Get to return ErrInputClosed.
+// Close must only be called once.
+func (q *InputQueue) Close() { close(q.done) }
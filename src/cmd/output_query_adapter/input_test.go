@@ -0,0 +1,257 @@
+package main
+
+/*
+ * input_test.go
+ * Tests for input.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// checkCommands checks that Get returns want.
+func checkCommands(
+	t *testing.T,
+	q *InputQueue,
+	id string,
+	after int,
+	want []InputCommand,
+) {
+	t.Helper()
+	got, err := q.Get(context.Background(), id, after)
+	if nil != err {
+		t.Fatalf("Error getting commands after %d: %s", after, err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf(
+			"Incorrect commands after %d\n got: %v\nwant: %v",
+			after,
+			got,
+			want,
+		)
+	}
+}
+
+// Do commands get queued, numbered, and forgotten?
+func TestInputQueue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			q   = NewInputQueue()
+			id  = ts("id")
+			id2 = ts("id2")
+		)
+		if n, err := q.Add(id, "a", "b"); nil != err {
+			t.Fatalf("Error adding commands: %s", err)
+		} else if 2 != n {
+			t.Errorf("Incorrect last command number: %d", n)
+		}
+		if _, err := q.Add(id2, "x"); nil != err {
+			t.Fatalf("Error adding command for %s: %s", id2, err)
+		}
+		checkCommands(t, q, id, 0, []InputCommand{
+			{Seq: 1, Command: "a"},
+			{Seq: 2, Command: "b"},
+		})
+		/* Not having gotten the response, we ask again. */
+		checkCommands(t, q, id, 0, []InputCommand{
+			{Seq: 1, Command: "a"},
+			{Seq: 2, Command: "b"},
+		})
+		checkCommands(t, q, id, 1, []InputCommand{
+			{Seq: 2, Command: "b"},
+		})
+
+		/* With nothing queued, we should wait for a command. */
+		go func() {
+			time.Sleep(time.Second)
+			q.Add(id, "c")
+		}()
+		start := time.Now()
+		checkCommands(t, q, id, 2, []InputCommand{
+			{Seq: 3, Command: "c"},
+		})
+		if d := time.Since(start); time.Second != d {
+			t.Errorf("Waited %s for a command, expected 1s", d)
+		}
+
+		/* Or not. */
+		start = time.Now()
+		checkCommands(t, q, id, 3, nil)
+		if d := time.Since(start); DefaultInputWait != d {
+			t.Errorf(
+				"Waited %s for nothing, expected %s",
+				d,
+				DefaultInputWait,
+			)
+		}
+
+		/* Other IDs shouldn't be affected. */
+		checkCommands(t, q, id2, 0, []InputCommand{
+			{Seq: 1, Command: "x"},
+		})
+	})
+}
+
+// Do we renumber commands for a shell which has seen more commands than we
+// have, as after a restart?
+func TestInputQueue_Renumber(t *testing.T) {
+	var (
+		q  = NewInputQueue()
+		id = ts("id")
+	)
+	if _, err := q.Add(id, "a", "b"); nil != err {
+		t.Fatalf("Error adding commands: %s", err)
+	}
+	checkCommands(t, q, id, 10, []InputCommand{
+		{Seq: 11, Command: "a"},
+		{Seq: 12, Command: "b"},
+	})
+	if n, err := q.Add(id, "c"); nil != err {
+		t.Fatalf("Error adding command: %s", err)
+	} else if 13 != n {
+		t.Errorf("Incorrect number after renumbering: %d", n)
+	}
+}
+
+// Do we not remember IDs which only ask for commands, but still wait for
+// commands for them?
+func TestInputQueue_Unknown(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			q  = NewInputQueue()
+			id = ts("id")
+		)
+		for i := range 10 {
+			checkCommands(t, q, ts("unknown"), i, nil)
+		}
+		if 0 != len(q.queues) {
+			t.Errorf("Remembered %d unknown IDs", len(q.queues))
+		}
+
+		/* Adding a command should stop the wait. */
+		go func() {
+			time.Sleep(time.Second)
+			q.Add(ts("other"), "x")
+			time.Sleep(time.Second)
+			q.Add(id, "a")
+		}()
+		start := time.Now()
+		checkCommands(t, q, id, 0, []InputCommand{
+			{Seq: 1, Command: "a"},
+		})
+		if d := time.Since(start); 2*time.Second != d {
+			t.Errorf("Waited %s for a command, expected 2s", d)
+		}
+	})
+}
+
+// Do we forget IDs whose connections have closed?
+func TestInputQueue_Forget(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			q   = NewInputQueue()
+			id  = ts("id")
+			id2 = ts("id2")
+			ev  = func(et EventType, id string, conn uint64) {
+				q.HandleEvent(Event{Type: et, ID: id, Conn: conn})
+			}
+			check = func(when string, want ...string) {
+				t.Helper()
+				got := slices.Sorted(maps.Keys(q.queues))
+				slices.Sort(want)
+				if !slices.Equal(got, want) {
+					t.Errorf(
+						"Incorrect IDs %s\n"+
+							" got: %q\n"+
+							"want: %q",
+						when,
+						got,
+						want,
+					)
+				}
+			}
+		)
+
+		/* Commands left after a close are kept until they're
+		gotten. */
+		if _, err := q.Add(id, "a"); nil != err {
+			t.Fatalf("Error adding command: %s", err)
+		}
+		ev(EventOpened, id, 1)
+		ev(EventClosed, id, 1)
+		check("after close with commands", id)
+		checkCommands(t, q, id, 0, []InputCommand{
+			{Seq: 1, Command: "a"},
+		})
+		check("before commands were acknowledged", id)
+		checkCommands(t, q, id, 1, nil)
+		check("after commands were acknowledged")
+
+		/* A restart's old connection closing shouldn't count. */
+		if _, err := q.Add(id2, "x"); nil != err {
+			t.Fatalf("Error adding command: %s", err)
+		}
+		ev(EventOpened, id2, 2)
+		checkCommands(t, q, id2, 0, []InputCommand{
+			{Seq: 1, Command: "x"},
+		})
+		checkCommands(t, q, id2, 1, nil)
+		ev(EventOpened, id2, 3)
+		ev(EventClosed, id2, 2)
+		check("after restart", id2)
+		ev(EventClosed, id2, 3)
+		check("after close")
+		if 0 != len(q.open) {
+			t.Errorf("Remembered %d open connections", len(q.open))
+		}
+	})
+}
+
+// Do we refuse commands we can't queue?
+func TestInputQueue_Refuse(t *testing.T) {
+	var (
+		q    = NewInputQueue()
+		id   = ts("id")
+		cmds = make([]string, MaxQueuedCommands)
+	)
+	if _, err := q.Add(id, "a\nb"); nil == err {
+		t.Errorf("No error for command with a newline")
+	}
+	if _, err := q.Add(id, cmds...); nil != err {
+		t.Fatalf("Error filling queue: %s", err)
+	}
+	if _, err := q.Add(id, "x"); !errors.Is(err, ErrInputQueueFull) {
+		t.Errorf("Incorrect error for full queue: %v", err)
+	}
+}
+
+// Does Close stop waiting?
+func TestInputQueue_Close(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		q := NewInputQueue()
+		go func() {
+			time.Sleep(time.Second)
+			q.Close()
+		}()
+		start := time.Now()
+		if _, err := q.Get(
+			context.Background(),
+			ts("id"),
+			0,
+		); !errors.Is(err, ErrInputClosed) {
+			t.Errorf("Incorrect error: %v", err)
+		}
+		if d := time.Since(start); time.Second != d {
+			t.Errorf("Waited %s, expected 1s", d)
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+/*
+ * metrics.go
+ * Count things, for Prometheus
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsContentType is the Content-Type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// SendLatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// histogram of how long ConnManager.Send takes.
+var SendLatencyBuckets = []float64{
+	.001, .005, .01, .05, .1, .5, 1, 5, 10, 30,
+}
+
+// Metrics counts requests, lines, and connection lifecycle events, to be
+// exposed in the Prometheus text format.  A nil *Metrics counts nothing.
+type Metrics struct {
+	mu               sync.Mutex
+	requests         map[string]uint64 /* Route -> count. */
+	lines            uint64
+	bytes            uint64
+	replayed         uint64
+	opened           uint64
+	closed           uint64
+	timedOut         uint64
+	keepAlives       uint64
+	upstreamFailures map[string]uint64 /* Status -> count. */
+	sendBuckets      []uint64          /* Per SendLatencyBuckets. */
+	sendCount        uint64
+	sendSum          time.Duration
+}
+
+// NewMetrics returns a new Metrics, ready for use.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:         make(map[string]uint64),
+		upstreamFailures: make(map[string]uint64),
+		sendBuckets:      make([]uint64, len(SendLatencyBuckets)),
+	}
+}
+
+// Request counts a request to the named route.
+func (m *Metrics) Request(route string) {
+	if nil == m {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[route]++
+}
+
+// Send notes that a call to ConnManager.Send took d.
+func (m *Metrics) Send(d time.Duration) {
+	if nil == m {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, b := range SendLatencyBuckets {
+		if d.Seconds() <= b {
+			m.sendBuckets[i]++
+		}
+	}
+	m.sendCount++
+	m.sendSum += d
+}
+
+// Event counts ev.  Replayed lines are counted separately from other lines.
+// Upstream failures are counted by HTTP status, or none if the failure wasn't
+// an HTTP response.
+func (m *Metrics) Event(ev Event) {
+	if nil == m {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch ev.Type {
+	case EventOpened:
+		m.opened++
+	case EventLineDelivered:
+		if ev.Replayed {
+			m.replayed++
+			break
+		}
+		m.lines++
+		m.bytes += uint64(len(ev.Line)) + 1
+	case EventKeepAlive:
+		m.keepAlives++
+	case EventTimedOut:
+		m.timedOut++
+	case EventClosed:
+		m.closed++
+	case EventUpstreamError:
+		status := "none"
+		var se *StatusError
+		if errors.As(ev.Err, &se) {
+			status = strconv.Itoa(se.Code)
+		}
+		m.upstreamFailures[status]++
+	}
+}
+
+// WriteTo writes m to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.mu.Lock()
+	writeCounters(
+		&buf,
+		"oqa_requests_total",
+		"Requests, by route.",
+		"route",
+		m.requests,
+	)
+	for _, c := range []struct {
+		name string
+		help string
+		n    uint64
+	}{
+		{
+			"oqa_lines_forwarded_total",
+			"Lines sent upstream, not counting replays.",
+			m.lines,
+		},
+		{
+			"oqa_bytes_forwarded_total",
+			"Bytes in forwarded lines, including newlines.",
+			m.bytes,
+		},
+		{
+			"oqa_lines_replayed_total",
+			"Lines sent upstream again after reconnecting.",
+			m.replayed,
+		},
+		{"oqa_sessions_opened_total", "Sessions opened.", m.opened},
+		{"oqa_sessions_closed_total", "Sessions closed.", m.closed},
+		{
+			"oqa_sessions_timed_out_total",
+			"Sessions closed for want of a keepalive.",
+			m.timedOut,
+		},
+		{
+			"oqa_keepalives_total",
+			"Keepalive timer resets.",
+			m.keepAlives,
+		},
+	} {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(&buf, "# TYPE %s counter\n", c.name)
+		fmt.Fprintf(&buf, "%s %d\n", c.name, c.n)
+	}
+	writeCounters(
+		&buf,
+		"oqa_upstream_failures_total",
+		"Failed upstream connections, by HTTP status.",
+		"status",
+		m.upstreamFailures,
+	)
+	const hn = "oqa_send_duration_seconds"
+	fmt.Fprintf(&buf, "# HELP %s Time taken to queue a line.\n", hn)
+	fmt.Fprintf(&buf, "# TYPE %s histogram\n", hn)
+	for i, b := range SendLatencyBuckets {
+		fmt.Fprintf(
+			&buf,
+			"%s_bucket{le=\"%s\"} %d\n",
+			hn,
+			strconv.FormatFloat(b, 'g', -1, 64),
+			m.sendBuckets[i],
+		)
+	}
+	fmt.Fprintf(&buf, "%s_bucket{le=\"+Inf\"} %d\n", hn, m.sendCount)
+	fmt.Fprintf(&buf, "%s_sum %g\n", hn, m.sendSum.Seconds())
+	fmt.Fprintf(&buf, "%s_count %d\n", hn, m.sendCount)
+	m.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+// writeCounters writes a counter with a single label to buf, one line per
+// label value, sorted.
+func writeCounters(
+	buf *bytes.Buffer,
+	name string,
+	help string,
+	label string,
+	counts map[string]uint64,
+) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+	for _, k := range slices.Sorted(maps.Keys(counts)) {
+		fmt.Fprintf(buf, "%s{%s=%q} %d\n", name, label, k, counts[k])
+	}
+}
+
+// NewMetricsMux returns a new [http.ServeMux] which serves m at /metrics.
+func NewMetricsMux(m *Metrics) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		w.Header().Set("Content-Type", metricsContentType)
+		m.WriteTo(w)
+	})
+	return mux
+}
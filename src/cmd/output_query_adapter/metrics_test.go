@@ -0,0 +1,226 @@
+package main
+
+/*
+ * metrics_test.go
+ * Tests for metrics.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
+)
+
+// checkMetrics checks that m's output has each of want's lines.
+func checkMetrics(t *testing.T, m *Metrics, want ...string) {
+	t.Helper()
+	var sb strings.Builder
+	if _, err := m.WriteTo(&sb); nil != err {
+		t.Fatalf("Error writing metrics: %s", err)
+	}
+	got := strings.Split(sb.String(), "\n")
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Metrics missing %q\ngot:\n%s", w, sb.String())
+		}
+	}
+}
+
+// Do we count things and write them out properly?
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.Request("line")
+	m.Request("line")
+	m.Request("keepalive")
+	for _, ev := range []Event{
+		{Type: EventOpened},
+		{Type: EventLineDelivered, Line: "kittens"},
+		{Type: EventLineDelivered, Line: ""},
+		{Type: EventLineDelivered, Line: "moose", Replayed: true},
+		{Type: EventKeepAlive},
+		{Type: EventTimedOut},
+		{Type: EventClosed},
+		{Type: EventUpstreamError, Err: &StatusError{Code: 502}},
+		{Type: EventUpstreamError, Err: &StatusError{Code: 502}},
+		{Type: EventUpstreamError, Err: errors.New("kittens")},
+	} {
+		m.Event(ev)
+	}
+	m.Send(2 * time.Millisecond)
+	m.Send(time.Minute)
+
+	var sb strings.Builder
+	if _, err := m.WriteTo(&sb); nil != err {
+		t.Fatalf("Error writing metrics: %s", err)
+	}
+	want := `# HELP oqa_requests_total Requests, by route.
+# TYPE oqa_requests_total counter
+oqa_requests_total{route="keepalive"} 1
+oqa_requests_total{route="line"} 2
+# HELP oqa_lines_forwarded_total Lines sent upstream, not counting replays.
+# TYPE oqa_lines_forwarded_total counter
+oqa_lines_forwarded_total 2
+# HELP oqa_bytes_forwarded_total Bytes in forwarded lines, including newlines.
+# TYPE oqa_bytes_forwarded_total counter
+oqa_bytes_forwarded_total 9
+# HELP oqa_lines_replayed_total Lines sent upstream again after reconnecting.
+# TYPE oqa_lines_replayed_total counter
+oqa_lines_replayed_total 1
+# HELP oqa_sessions_opened_total Sessions opened.
+# TYPE oqa_sessions_opened_total counter
+oqa_sessions_opened_total 1
+# HELP oqa_sessions_closed_total Sessions closed.
+# TYPE oqa_sessions_closed_total counter
+oqa_sessions_closed_total 1
+# HELP oqa_sessions_timed_out_total Sessions closed for want of a keepalive.
+# TYPE oqa_sessions_timed_out_total counter
+oqa_sessions_timed_out_total 1
+# HELP oqa_keepalives_total Keepalive timer resets.
+# TYPE oqa_keepalives_total counter
+oqa_keepalives_total 1
+# HELP oqa_upstream_failures_total Failed upstream connections, by HTTP status.
+# TYPE oqa_upstream_failures_total counter
+oqa_upstream_failures_total{status="502"} 2
+oqa_upstream_failures_total{status="none"} 1
+# HELP oqa_send_duration_seconds Time taken to queue a line.
+# TYPE oqa_send_duration_seconds histogram
+oqa_send_duration_seconds_bucket{le="0.001"} 0
+oqa_send_duration_seconds_bucket{le="0.005"} 1
+oqa_send_duration_seconds_bucket{le="0.01"} 1
+oqa_send_duration_seconds_bucket{le="0.05"} 1
+oqa_send_duration_seconds_bucket{le="0.1"} 1
+oqa_send_duration_seconds_bucket{le="0.5"} 1
+oqa_send_duration_seconds_bucket{le="1"} 1
+oqa_send_duration_seconds_bucket{le="5"} 1
+oqa_send_duration_seconds_bucket{le="10"} 1
+oqa_send_duration_seconds_bucket{le="30"} 1
+oqa_send_duration_seconds_bucket{le="+Inf"} 2
+oqa_send_duration_seconds_sum 60.002
+oqa_send_duration_seconds_count 2
+`
+	if got := sb.String(); got != want {
+		t.Errorf("Incorrect metrics\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	/* A nil Metrics shouldn't do anything. */
+	var nm *Metrics
+	nm.Request("line")
+	nm.Event(Event{Type: EventOpened})
+	nm.Send(time.Second)
+}
+
+// Does the metrics listener serve metrics?
+func TestNewMetricsMux(t *testing.T) {
+	var (
+		m   = NewMetrics()
+		mux = NewMetricsMux(m)
+		rr  = httptest.NewRecorder()
+	)
+	m.Request("line")
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if http.StatusOK != rr.Code {
+		t.Fatalf("Incorrect status %d", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != metricsContentType {
+		t.Errorf("Incorrect Content-Type %q", got)
+	}
+	want := `oqa_requests_total{route="line"} 1` + "\n"
+	if got := rr.Body.String(); !strings.Contains(got, want) {
+		t.Errorf("Metrics missing %q\ngot:\n%s", want, got)
+	}
+}
+
+// Does ConnManager keep count?
+func TestConnManager_Metrics(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm, lb, output = newSynctestConnManager(t)
+			m              = NewMetrics()
+			id             = ts("id")
+		)
+		cm.Metrics = m
+		if _, err := cm.Send(id, testRA, "1 kittens"); nil != err {
+			t.Fatalf("Error sending line 1: %s", err)
+		}
+		if err := cm.KeepAlive(id, testRA); nil != err {
+			t.Fatalf("Error sending keepalive: %s", err)
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+		output()
+		synctest.Wait()
+		checkMetrics(
+			t,
+			m,
+			"oqa_lines_forwarded_total 1",
+			"oqa_bytes_forwarded_total 8",
+			"oqa_sessions_opened_total 1",
+			"oqa_sessions_closed_total 1",
+			"oqa_keepalives_total 1",
+			`oqa_send_duration_seconds_bucket{le="0.001"} 1`,
+			"oqa_send_duration_seconds_count 1",
+		)
+		lb.TestEmpty(t)
+	})
+}
+
+// badGatewayTransport is an http.RoundTripper which always returns a 502.
+type badGatewayTransport struct{}
+
+// RoundTrip implements http.RoundTripper.
+func (badGatewayTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:     "502 Bad Gateway",
+		StatusCode: http.StatusBadGateway,
+		Body:       http.NoBody,
+	}, nil
+}
+
+// Do we count upstream failures by status?
+func TestConnManager_MetricsUpstreamFailure(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			cm = NewConnManager(NewHTTPSink(
+				"https://192.0.2.10:4444/o",
+				&http.Client{Transport: badGatewayTransport{}},
+			))
+			tl, lb = testlogger.New()
+			m      = NewMetrics()
+			id     = ts("id")
+		)
+		cm.logf = tl.Printf
+		cm.ReconnectTries = 0
+		cm.Metrics = m
+		if _, err := cm.Send(id, testRA, "1 a"); nil != err {
+			t.Fatalf("Error sending line 1: %s", err)
+		}
+		synctest.Wait()
+		checkMetrics(
+			t,
+			m,
+			`oqa_upstream_failures_total{status="502"} 1`,
+			"oqa_sessions_opened_total 1",
+			"oqa_sessions_closed_total 1",
+		)
+		lb.TestStartsWith(t, "Connection for "+id+" failed: "+
+			"got non-OK response status 502 Bad Gateway")
+		lb.TestEmpty(t)
+	})
+}
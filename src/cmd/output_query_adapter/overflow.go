@@ -0,0 +1,59 @@
+package main
+
+/*
+ * overflow.go
+ * What to do when a connection's queue is full
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// OverflowPolicy says what ConnManager.Send does with a line when its
+// connection's queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest queues the line and drops the oldest queued
+	// lines to make room.
+	OverflowDropOldest
+	// OverflowReject rejects the line with ErrQueueFull.
+	OverflowReject
+)
+
+// overflowPolicyNames are the names of the OverflowPolicies, in order.
+var overflowPolicyNames = []string{"block", "drop-oldest", "reject"}
+
+// String implements fmt.Stringer.
+func (op OverflowPolicy) String() string {
+	if op < 0 || int(op) >= len(overflowPolicyNames) {
+		return fmt.Sprintf("OverflowPolicy(%d)", int(op))
+	}
+	return overflowPolicyNames[op]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (op OverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (op *OverflowPolicy) UnmarshalText(text []byte) error {
+	i := slices.Index(overflowPolicyNames, string(text))
+	if -1 == i {
+		return fmt.Errorf(
+			"unknown policy %q, must be one of %s",
+			text,
+			strings.Join(overflowPolicyNames, ", "),
+		)
+	}
+	*op = OverflowPolicy(i)
+	return nil
+}
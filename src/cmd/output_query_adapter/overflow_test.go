@@ -0,0 +1,42 @@
+package main
+
+/*
+ * overflow_test.go
+ * Tests for overflow.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import "testing"
+
+// Do policies survive a round-trip through text?
+func TestOverflowPolicy_Text(t *testing.T) {
+	for _, want := range []OverflowPolicy{
+		OverflowBlock,
+		OverflowDropOldest,
+		OverflowReject,
+	} {
+		b, err := want.MarshalText()
+		if nil != err {
+			t.Errorf("Error marshalling %d: %s", want, err)
+			continue
+		}
+		var got OverflowPolicy
+		if err := got.UnmarshalText(b); nil != err {
+			t.Errorf("Error unmarshalling %q: %s", b, err)
+		} else if got != want {
+			t.Errorf(
+				"Round-trip failed\n got: %s\nwant: %s",
+				got,
+				want,
+			)
+		}
+	}
+
+	/* Unknown policies should fail. */
+	var op OverflowPolicy
+	if err := op.UnmarshalText([]byte("kittens")); nil == err {
+		t.Errorf("No error unmarshalling unknown policy")
+	}
+}
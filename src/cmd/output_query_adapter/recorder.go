@@ -0,0 +1,109 @@
+package main
+
+/*
+ * recorder.go
+ * Record sessions' transcripts to disk
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TranscriptSuffix is appended to an ID to name its transcript file.
+const TranscriptSuffix = ".transcript"
+
+// Recorder appends the lines a ConnManager delivers to a transcript file per
+// ID, along with markers for when connections open, close, and time out.
+// Each line in a transcript starts with a timestamp and the remote address
+// of the request which caused it.  Delivered lines then have the line's
+// number and the line itself, and markers have --- and what happened, e.g.
+//
+//	2026-10-18T12:00:00.5Z [192.0.2.1:12345] --- opened
+//	2026-10-18T12:00:00.5Z [192.0.2.1:12345] 1 hello
+//	2026-10-18T12:00:16.5Z [192.0.2.1:12345] --- timed out
+//	2026-10-18T12:00:16.5Z [192.0.2.1:12345] --- closed
+//
+// Lines' timestamps are when they arrived, not when they were delivered.
+// Lines sent again after a reconnect are not recorded twice.
+type Recorder struct {
+	logf func(string, ...any) /* Test-settable. */
+	mu   sync.Mutex
+	root *os.Root
+}
+
+// NewRecorder returns a new Recorder which puts transcripts in dir.  Files
+// will not be created outside of dir.  The Recorder's HandleEvent should be
+// registered with ConnManager.OnEvent.
+func NewRecorder(dir string) (*Recorder, error) {
+	root, err := os.OpenRoot(dir)
+	if nil != err {
+		return nil, fmt.Errorf("opening directory: %w", err)
+	}
+	return &Recorder{logf: log.Printf, root: root}, nil
+}
+
+// HandleEvent records ev in its ID's transcript, if it's worth recording.
+// Errors are logged.
+func (r *Recorder) HandleEvent(ev Event) {
+	var (
+		t    = ev.Time
+		what string
+	)
+	switch ev.Type {
+	case EventOpened:
+		what = "--- opened"
+	case EventLineDelivered:
+		if ev.Replayed {
+			return
+		}
+		t = ev.Received
+		what = fmt.Sprintf("%d %s", ev.Seq, ev.Line)
+	case EventTimedOut:
+		what = "--- timed out"
+	case EventClosed:
+		what = "--- closed"
+		if nil != ev.Err {
+			what += ": " + ev.Err.Error()
+		}
+	default:
+		return
+	}
+
+	if err := r.write(ev.ID, fmt.Sprintf(
+		"%s [%s] %s\n",
+		t.UTC().Format(time.RFC3339Nano),
+		ev.RemoteAddr,
+		what,
+	)); nil != err {
+		r.logf("Error recording transcript for %s: %s", ev.ID, err)
+	}
+}
+
+// write appends s to id's transcript.
+func (r *Recorder) write(id, s string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := r.root.OpenFile(
+		id+TranscriptSuffix,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	if _, err := f.WriteString(s); nil != err {
+		f.Close()
+		return fmt.Errorf("writing: %w", err)
+	}
+	if err := f.Close(); nil != err {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	return nil
+}
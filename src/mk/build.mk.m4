@@ -2,7 +2,7 @@
 # Build ALL the things, with less repetition
 # By J. Stuart McMurray
 # Created 20260110
-# Last Modified 20260205
+# Last Modified 20261018
 
 # Derived variables.
 BSD             = ${TMPD}/bsd_${VERN}_${ARCH}
@@ -17,7 +17,8 @@ SUBMAKES       != find * -name Makefile -mindepth 2 -type f
 .include "src/mk/curlrevshell.mk"
 
 # By default, build a miniroot install image.
-build: ${MINIROOT_CRS} ${CRS_TXTAR} ${CRS_TMPL} ${OQA_BIN} ${START_SH}
+build: ${MINIROOT_CRS} ${CRS_TXTAR} ${CRS_TMPL} ${OQA_BIN} ${OQACTL_BIN}
+build: ${START_SH}
 .MAIN: build
 .PHONY: build
 
@@ -107,6 +108,7 @@ distclean: clean
 	rm -rf\
 		${START_SH}\
 		${OQA_BIN}\
+		${OQACTL_BIN}\
 		${TMPD}\
 		crs.*\
 		miniroot*
@@ -2,7 +2,7 @@
 # Build things used for and with curlrevshell
 # By J. Stuart McMurray
 # Created 20260110
-# Last Modified 20260205
+# Last Modified 20261018
 
 CRS_CAFILE       = /etc/ssl/${CRS_CERT:T}
 CRS_CERT        ?= ${TMPD}/crs_cert.pem
@@ -10,6 +10,7 @@ CRS_KEY         ?= ${TMPD}/crs_key.pem
 CRS_TMPL         = crs.tmpl
 CRS_TXTAR       ?= crs.txtar
 OQA_BIN          = output_query_adapter
+OQACTL_BIN       = oqactl
 START_CALLBACKS  = ${TMPD}/start_callbacks.sh
 START_SH         = start.sh
 
@@ -50,10 +51,17 @@ ${TMPD}/${START_SH} ${START_CALLBACKS} ${CRS_TMPL}: src/${@F}.m4 ${CONFIG}
 		-Dm4_crs_cbaddr=${CRS_CBADDR}\
 		-Dm4_crs_tmpl=${CRS_TMPL}\
 		-Dm4_oqa_cbaddr=${OQA_CBADDR}\
+		-Dm4_oqa_secret=${OQA_SECRET}\
+		-Dm4_oqa_batch_wait=${OQA_BATCH_WAIT}\
+		-Dm4_oqa_compress=${OQA_COMPRESS}\
+		-Dm4_oqa_input=${OQA_INPUT}\
 		-Dm4_tls_txtar=${CRS_TXTAR}\
-		${>:N*.mk} >$@.tmp
+		${>:N*.mk:N*/script.tmpl.m4} >$@.tmp
 	mv $@.tmp $@
 
+# The template's script is shared with output_query_adapter's stager.
+${CRS_TMPL}: src/script.tmpl.m4
+
 # Launcher needs the execute bit, though.
 ${START_SH}: ${TMPD}/${START_SH}
 	cp $> $@
@@ -64,3 +72,9 @@ ${OQA_BIN}: src/cmd/$@/$@
 	cp $> $@
 src/cmd/${OQA_BIN}/${OQA_BIN}!
 	${.MAKE} -C ${@D} ${@F}
+
+# Adapter controller
+${OQACTL_BIN}: src/cmd/$@/$@
+	cp $> $@
+src/cmd/${OQACTL_BIN}/${OQACTL_BIN}!
+	${.MAKE} -C ${@D} ${@F}
@@ -6,17 +6,167 @@ package lineextractor
  * Extract output lines from HTTP requests
  * By J. Stuart McMurray
  * Created 20260119
- * Last Modified 20260119
+ * Last Modified 20261018
  */
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+// BatchSeparator separates lines in a batch of lines.  A separator in a line
+// should be URL-encoded, as should % and +.
+const BatchSeparator = "&"
+
+// Chunk encodings, for ExtractChunk.
+const (
+	// ChunkGzip indicates a chunk is gzip-compressed.
+	ChunkGzip = "gzip"
+	// ChunkDeflate indicates a chunk is raw DEFLATE-compressed, without
+	// a zlib header.
+	ChunkDeflate = "deflate"
+)
+
+// MaxChunkSize is the largest a chunk may be, once decompressed.
+const MaxChunkSize = 1024 * 1024
+
+// numberRE matches the number at the start of a line.
+var numberRE = regexp.MustCompile(`^\s*(\d+)(?:\s|$)`)
+
 // ExtractLine extracts an output line from an HTTP request.
 // It URL-decodes and returns the raw query query string, i.e. the part of
 // the URL after the ?.
 func ExtractLine(r *http.Request) (string, error) {
 	return url.QueryUnescape(r.URL.RawQuery)
 }
+
+// ExtractLines extracts a batch of numbered output lines from an HTTP request.
+// The raw query string is split on BatchSeparator, empty lines are ignored,
+// and the remaining lines are URL-decoded.  Every line must start with a
+// number, one higher than the previous line's number.
+func ExtractLines(r *http.Request) ([]string, error) {
+	var lines []string
+	for _, raw := range strings.Split(r.URL.RawQuery, BatchSeparator) {
+		if "" == raw {
+			continue
+		}
+		line, err := url.QueryUnescape(raw)
+		if nil != err {
+			return nil, fmt.Errorf(
+				"decoding line %d: %w",
+				len(lines)+1,
+				err,
+			)
+		}
+		lines = append(lines, line)
+	}
+	if err := checkNumbers(lines, -1); nil != err {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// ExtractChunk extracts a compressed chunk of numbered output lines from an
+// HTTP request.  The raw query string should be of the form
+//
+//	encoding.number.data
+//
+// where encoding is one of ChunkGzip or ChunkDeflate, number is the number of
+// the first line in the chunk, and data is the base64url-encoded compressed
+// lines, separated by newlines.  Padding on data is optional.  As with
+// ExtractLines, every line must start with a number, one higher than the
+// previous line's number.  Chunks may decompress to no more than
+// MaxChunkSize bytes.
+func ExtractChunk(r *http.Request) ([]string, error) {
+	/* Split into the bits we need. */
+	parts := strings.SplitN(r.URL.RawQuery, ".", 3)
+	if 3 != len(parts) {
+		return nil, errors.New("malformed chunk")
+	}
+	first, err := strconv.Atoi(parts[1])
+	if nil != err {
+		return nil, fmt.Errorf("parsing chunk number: %w", err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(parts[2], "="),
+	)
+	if nil != err {
+		return nil, fmt.Errorf("decoding base64: %w", err)
+	}
+
+	/* Decompress, but not too much. */
+	var dr io.Reader
+	switch parts[0] {
+	case ChunkGzip:
+		if dr, err = gzip.NewReader(bytes.NewReader(b)); nil != err {
+			return nil, fmt.Errorf(
+				"starting decompression: %w",
+				err,
+			)
+		}
+	case ChunkDeflate:
+		dr = flate.NewReader(bytes.NewReader(b))
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", parts[0])
+	}
+	d, err := io.ReadAll(io.LimitReader(dr, MaxChunkSize+1))
+	if nil != err {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	} else if MaxChunkSize < len(d) {
+		return nil, fmt.Errorf(
+			"decompressed chunk larger than %d bytes",
+			MaxChunkSize,
+		)
+	}
+
+	/* Make sure we've got the right lines. */
+	lines := strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")
+	if err := checkNumbers(lines, first); nil != err {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// checkNumbers makes sure every line in lines starts with a number one higher
+// than the previous line's number, and that there's at least one line.  If
+// first isn't negative, the first line's number must be first.
+func checkNumbers(lines []string, first int) error {
+	if 0 == len(lines) || (1 == len(lines) && "" == lines[0]) {
+		return errors.New("no lines")
+	}
+	prev := first - 1
+	for i, line := range lines {
+		ms := numberRE.FindStringSubmatch(line)
+		if nil == ms {
+			return fmt.Errorf("line %d has no number", i+1)
+		}
+		n, err := strconv.Atoi(ms[1])
+		if nil != err {
+			return fmt.Errorf(
+				"parsing line %d's number: %w",
+				i+1,
+				err,
+			)
+		}
+		if (0 != i || 0 <= first) && prev+1 != n {
+			return fmt.Errorf(
+				"line %d has number %d, expected %d",
+				i+1,
+				n,
+				prev+1,
+			)
+		}
+		prev = n
+	}
+	return nil
+}
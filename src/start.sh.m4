@@ -4,7 +4,7 @@ m4_dnl start.sh.m4
 m4_dnl Start curlrevshell and the adatpter
 m4_dnl By J. Stuart McMurray
 m4_dnl Created 20260118
-m4_dnl Last Modified 20260203
+m4_dnl Last Modified 20261018
 m4_changecom(xxxx)# Generated m4_esyscmd(date)m4_changecom(#)m4_dnl
 
 case ${1-} in
@@ -15,8 +15,13 @@ case ${1-} in
                 -callback-address m4_crs_cbaddr \
                 -template m4_crs_tmpl \
                 -tls-certificate-cache m4_tls_txtar ;;
-        oqa|output_query_adapter) set -x; ./output_query_adapter \
+        oqa|output_query_adapter) set -x; mkdir -p transcripts files
+                ./output_query_adapter \
                 -curlrevshell https://m4_crs_cbaddr/o \
+                -secret "m4_oqa_secret" \
+                -admin ./output_query_adapter.sock \
+                -record-dir ./transcripts \
+                -file-dir ./files \
                 -tls m4_tls_txtar ;;
         *) cat >&2 <<_eof
 Usage: $(basename "$0") curlrevshell|output_query_adapter
@@ -4,10 +4,13 @@
 # Start our shell calling back
 # By J. Stuart McMurray
 # Created 20260108
-# Last Modified 20260118
+# Last Modified 20261018
 
 RESTARTWAIT=15
 
+# Shells use this to authenticate to output_query_adapter, if it's set.
+export OQA_SECRET=m4_oqa_secret
+
 # Wait for networking to come up.
 while ! [[ -f /tmp/cgipid ]]; do sleep 1; done
 